@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	srv "github.com/refractionPOINT/lc-service/lcservice-go/servers"
+	svc "github.com/refractionPOINT/lc-service/lcservice-go/service"
+)
+
+// This example declares the D&R rules, lookups and outputs the service
+// needs. The framework installs them when an org installs the service,
+// reconciles them every hour and removes them on uninstall.
+// The service requires the following permissions:
+// - dr.set.managed
+// - dr.del.managed
+// - dr.list.managed
+// - output.set
+// - output.del
+// - output.list
+// - hive.set
+// - hive.del
+// - hive.get
+
+func main() {
+	sv, err := svc.NewService(svc.Descriptor{
+		Name:      "example-managed-config",
+		SecretKey: os.Getenv("SHARED_SECRET"),
+		ManagedConfig: &svc.ManagedConfig{
+			DRRules: map[string]lc.CoreDRRule{
+				"example-bad-domain": {
+					Namespace: "managed",
+					Detect: lc.Dict{
+						"event":    "DNS_REQUEST",
+						"op":       "lookup",
+						"path":     "event/DOMAIN_NAME",
+						"resource": "hive://lookup/example-bad-domains",
+					},
+					Response: lc.List{
+						lc.Dict{"action": "report", "name": "example-bad-domain"},
+					},
+				},
+			},
+			Lookups: map[string]svc.Dict{
+				"example-bad-domains": {
+					"evil.example.com": svc.Dict{},
+				},
+			},
+			// Outputs are templated per org.
+			PerOrg: func(oid string) (svc.ManagedConfig, error) {
+				return svc.ManagedConfig{
+					Outputs: map[string]lc.OutputConfig{
+						"example-detections": {
+							Module:          lc.OutputTypes.Webhook,
+							Type:            lc.OutputType.Detect,
+							DestinationHost: "https://hooks.example.com/" + oid,
+						},
+					},
+				}, nil
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	sr := srv.NewStandalone(sv, 80)
+	if err := sr.Init(); err != nil {
+		panic(err)
+	}
+	if err := sr.Start(); err != nil && err != http.ErrServerClosed {
+		panic(err)
+	}
+}
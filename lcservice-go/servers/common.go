@@ -6,7 +6,9 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
 
 	svc "github.com/refractionPOINT/lc-service/lcservice-go/service"
 )
@@ -19,6 +21,19 @@ func encodeResponse(resp svc.Response, w http.ResponseWriter) {
 }
 
 func handleResponse(resp svc.Response, w http.ResponseWriter) {
+	if resp.IsOverloaded {
+		// Let the caller back off, the body
+		// still says the request is retriable.
+		w.WriteHeader(http.StatusServiceUnavailable)
+		encodeResponse(resp, w)
+		return
+	}
+	if resp.IsRateLimited {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(resp.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		encodeResponse(resp, w)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	encodeResponse(resp, w)
 }
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -155,3 +156,30 @@ func computeSig(data []byte) string {
 	jsonCompatSig := []byte(hex.EncodeToString(mac.Sum(nil)))
 	return string(jsonCompatSig)
 }
+
+func TestOverloadedResponse(t *testing.T) {
+	a := assert.New(t)
+
+	recorder := httptest.NewRecorder()
+	handleResponse(svc.Response{IsRetriable: true, Error: "service overloaded", IsOverloaded: true}, recorder)
+	resp := recorder.Result()
+	a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	respDict := svc.Dict{}
+	a.NoError(json.NewDecoder(resp.Body).Decode(&respDict))
+	a.Equal(true, respDict["retry"])
+	_, isPresent := respDict["IsOverloaded"]
+	a.False(isPresent)
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	a := assert.New(t)
+
+	recorder := httptest.NewRecorder()
+	handleResponse(svc.Response{IsRetriable: true, Error: "rate limit exceeded", IsRateLimited: true, RetryAfter: 1500 * time.Millisecond}, recorder)
+	resp := recorder.Result()
+	a.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	a.Equal("2", resp.Header.Get("Retry-After"))
+	respDict := svc.Dict{}
+	a.NoError(json.NewDecoder(resp.Body).Decode(&respDict))
+	a.Equal(true, respDict["retry"])
+}
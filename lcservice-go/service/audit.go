@@ -0,0 +1,392 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Default number of records kept per org for get_audit_log.
+	DefaultAuditRecentRecords = 100
+)
+
+type AuditKind = string
+
+var AuditKinds = struct {
+	Command  AuditKind
+	Mutation AuditKind
+}{
+	Command:  "command",
+	Mutation: "mutation",
+}
+
+// A record of a command executed or of a change
+// made to an org by the service.
+type AuditRecord struct {
+	Time     time.Time `json:"ts"`
+	Kind     AuditKind `json:"kind"`
+	OID      string    `json:"oid"`
+	UserID   string    `json:"uid,omitempty"`
+	Identity string    `json:"ident,omitempty"`
+
+	// Commands, with their arguments, secrets redacted,
+	// and the room and ID of the command.
+	Command   string `json:"command,omitempty"`
+	Args      Dict   `json:"args,omitempty"`
+	RoomID    string `json:"rid,omitempty"`
+	CommandID string `json:"cid,omitempty"`
+
+	// Mutations, like "dr_rule_add", and the name of
+	// the element changed if any.
+	Operation string `json:"operation,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Details   Dict   `json:"details,omitempty"`
+
+	IsSuccess  bool    `json:"is_success"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Destination of the audit records.
+type AuditSink interface {
+	Write(record AuditRecord) error
+}
+
+// Adapter to use a function as an AuditSink.
+type AuditSinkFunc func(record AuditRecord) error
+
+func (f AuditSinkFunc) Write(record AuditRecord) error {
+	return f(record)
+}
+
+// Writes the records as JSON lines.
+type JSONLAuditSink struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func NewJSONLAuditSink(w io.Writer) *JSONLAuditSink {
+	return &JSONLAuditSink{w: w}
+}
+
+// Write the records as JSON lines to stdout.
+func NewStdoutAuditSink() *JSONLAuditSink {
+	return NewJSONLAuditSink(os.Stdout)
+}
+
+// Append the records as JSON lines to a file, creating it if needed.
+func NewFileAuditSink(path string) (*JSONLAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLAuditSink(f), nil
+}
+
+func (s *JSONLAuditSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close the underlying writer if it can be closed.
+func (s *JSONLAuditSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Audit trail of the commands executed and of the changes
+// made to the orgs through the framework. When set, a
+// get_audit_log command returns the recent records of the org.
+//
+// The changes made by the framework, like the ManagedConfig sync
+// and the interactive rules, are recorded, as are the ones made by
+// handlers through Request.AuditedOrg and its RuleManager. Changes
+// made through Request.Org directly are not, handlers record them
+// with CoreService.RecordMutation.
+type AuditConfig struct {
+	Sinks []AuditSink
+
+	// Number of records kept in memory per org for
+	// get_audit_log, DefaultAuditRecentRecords if 0.
+	RecentRecords int
+}
+
+func (c AuditConfig) isValid() error {
+	if c.RecentRecords < 0 {
+		return fmt.Errorf("recent records must not be negative")
+	}
+	return nil
+}
+
+type auditor struct {
+	cs        *CoreService
+	sinks     []AuditSink
+	maxRecent int
+
+	sync.Mutex
+	recent map[string][]AuditRecord
+}
+
+func newAuditor(cs *CoreService) *auditor {
+	a := &auditor{
+		cs:        cs,
+		sinks:     cs.desc.Audit.Sinks,
+		maxRecent: cs.desc.Audit.RecentRecords,
+		recent:    map[string][]AuditRecord{},
+	}
+	if a.maxRecent == 0 {
+		a.maxRecent = DefaultAuditRecentRecords
+	}
+	return a
+}
+
+func (a *auditor) install() error {
+	return a.cs.desc.addCommand(CommandDescriptor{
+		Name:        "get_audit_log",
+		Description: "Get the recent audit records of this org, newest first.",
+		Args: CommandParams{
+			"limit": {
+				Type:        RequestParamTypes.Int,
+				Description: "maximum number of records to return",
+			},
+		},
+		Handler:             a.cmdGetAuditLog,
+		RequiredPermissions: a.cs.desc.commandPermissions("get_audit_log"),
+	})
+}
+
+func (a *auditor) record(rec AuditRecord) {
+	if a.cs.redactor != nil {
+		rec.Error = a.cs.redactor.redact(rec.Error)
+		rec.Details = a.redactDetails(rec.Details)
+	}
+	a.Lock()
+	recent := append(a.recent[rec.OID], rec)
+	if len(recent) > a.maxRecent {
+		recent = recent[len(recent)-a.maxRecent:]
+	}
+	a.recent[rec.OID] = recent
+	a.Unlock()
+
+	for _, sink := range a.sinks {
+		if err := sink.Write(rec); err != nil {
+			a.cs.Error(fmt.Sprintf("audit.write: %v", err))
+		}
+	}
+}
+
+// Redact the secret values from the details of a mutation,
+// dropping the details if they cannot be redacted.
+func (a *auditor) redactDetails(details Dict) Dict {
+	if details == nil {
+		return nil
+	}
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(details); err != nil {
+		a.cs.Error(fmt.Sprintf("audit.redactDetails: %v", err))
+		return nil
+	}
+	redacted := Dict{}
+	if err := json.Unmarshal([]byte(a.cs.redactor.redact(buf.String())), &redacted); err != nil {
+		a.cs.Error(fmt.Sprintf("audit.redactDetails: %v", err))
+		return nil
+	}
+	return redacted
+}
+
+// Record a command from its raw request, so that commands
+// rejected before reaching their handler are recorded too.
+func (a *auditor) recordCommand(data Dict, resolver handlerResolver, resp Response, start time.Time) {
+	req := lcRequest{}
+	if err := DictToStruct(data, &req); err != nil {
+		return
+	}
+	rec := AuditRecord{
+		Time:       start,
+		Kind:       AuditKinds.Command,
+		OID:        req.OID,
+		IsSuccess:  resp.IsSuccess,
+		Error:      resp.Error,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if req.JWT != "" {
+		if claims, err := ParseJWTClaims(req.JWT); err == nil {
+			rec.UserID = claims.UserID
+			rec.Identity = claims.Identity
+		}
+	}
+	args := Dict{}
+	for k, v := range resolver.redactArgs(req.Data) {
+		switch k {
+		case "command_name":
+			rec.Command, _ = v.(string)
+		case "rid":
+			rec.RoomID, _ = v.(string)
+		case "cid":
+			rec.CommandID, _ = v.(string)
+		default:
+			args[k] = v
+		}
+	}
+	rec.Args = args
+	a.record(rec)
+}
+
+// Record a change made to an org by a handler of the service,
+// on behalf of the user of the Request if any. Does nothing
+// unless the Descriptor has an Audit.
+func (cs *CoreService) RecordMutation(r Request, operation string, target string, details Dict, err error) {
+	if cs.auditor == nil {
+		return
+	}
+	cs.auditor.newRecorder(r).record(operation, target, details, time.Now(), err)
+}
+
+func (a *auditor) getRecent(oid string, limit int) []AuditRecord {
+	a.Lock()
+	defer a.Unlock()
+	recent := a.recent[oid]
+	if limit <= 0 || limit > len(recent) {
+		limit = len(recent)
+	}
+	records := make([]AuditRecord, 0, limit)
+	for i := len(recent) - 1; i >= len(recent)-limit; i-- {
+		records = append(records, recent[i])
+	}
+	return records
+}
+
+func (a *auditor) cmdGetAuditLog(r Request) Response {
+	limit := 0
+	if _, ok := r.Event.Data["limit"]; ok {
+		var err error
+		if limit, err = r.GetInt("limit"); err != nil {
+			return NewErrorResponse(err)
+		}
+	}
+	return MakeSuccessResponse(Dict{
+		"records": a.getRecent(r.OID, limit),
+	})
+}
+
+// Records the mutations made on behalf of the user of a Request.
+type auditRecorder struct {
+	a        *auditor
+	oid      string
+	userID   string
+	identity string
+}
+
+func (a *auditor) newRecorder(r Request) *auditRecorder {
+	rec := &auditRecorder{
+		a:   a,
+		oid: r.OID,
+	}
+	if r.Claims != nil {
+		rec.userID = r.Claims.UserID
+		rec.identity = r.Claims.Identity
+	}
+	return rec
+}
+
+func (ar *auditRecorder) record(operation string, target string, details Dict, start time.Time, err error) {
+	rec := AuditRecord{
+		Time:       start,
+		Kind:       AuditKinds.Mutation,
+		OID:        ar.oid,
+		UserID:     ar.userID,
+		Identity:   ar.identity,
+		Operation:  operation,
+		Target:     target,
+		Details:    details,
+		IsSuccess:  err == nil,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	ar.a.record(rec)
+}
+
+// Wraps the SDK client managing an org to record the changes.
+type auditedOrgConfigClient struct {
+	orgConfigClient
+	*auditRecorder
+}
+
+func (a *auditor) wrapOrgConfigClient(client orgConfigClient, r Request) orgConfigClient {
+	return &auditedOrgConfigClient{
+		orgConfigClient: client,
+		auditRecorder:   a.newRecorder(r),
+	}
+}
+
+func (c *auditedOrgConfigClient) SyncPush(conf lc.OrgConfig, options lc.SyncOptions) ([]lc.OrgSyncOperation, error) {
+	start := time.Now()
+	ops, err := c.orgConfigClient.SyncPush(conf, options)
+	if options.IsDryRun {
+		return ops, err
+	}
+	changes := []lc.OrgSyncOperation{}
+	for _, op := range ops {
+		if op.IsAdded || op.IsRemoved {
+			changes = append(changes, op)
+		}
+	}
+	c.record("sync_push", "", Dict{"operations": changes, "is_force": options.IsForce}, start, err)
+	return ops, err
+}
+
+func (c *auditedOrgConfigClient) DRRuleAdd(name string, detection interface{}, response interface{}, opt ...lc.NewDRRuleOptions) error {
+	start := time.Now()
+	err := c.orgConfigClient.DRRuleAdd(name, detection, response, opt...)
+	c.record("dr_rule_add", name, nil, start, err)
+	return err
+}
+
+func (c *auditedOrgConfigClient) DRRuleDelete(name string, filters ...lc.DRRuleFilter) error {
+	start := time.Now()
+	err := c.orgConfigClient.DRRuleDelete(name, filters...)
+	c.record("dr_rule_delete", name, nil, start, err)
+	return err
+}
+
+func (c *auditedOrgConfigClient) FPRuleDelete(name lc.FPRuleName) error {
+	start := time.Now()
+	err := c.orgConfigClient.FPRuleDelete(name)
+	c.record("fp_rule_delete", string(name), nil, start, err)
+	return err
+}
+
+func (c *auditedOrgConfigClient) OutputDel(name string) (lc.GenericJSON, error) {
+	start := time.Now()
+	resp, err := c.orgConfigClient.OutputDel(name)
+	c.record("output_delete", name, nil, start, err)
+	return resp, err
+}
+
+func (c *auditedOrgConfigClient) LookupDelete(name string) error {
+	start := time.Now()
+	err := c.orgConfigClient.LookupDelete(name)
+	c.record("lookup_delete", name, nil, start, err)
+	return err
+}
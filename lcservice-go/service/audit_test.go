@@ -0,0 +1,227 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudit(t *testing.T) {
+	a := assert.New(t)
+	oid := "11111111-1111-1111-1111-111111111111"
+	dir, err := ioutil.TempDir("", "lcservice")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	_, err = NewService(Descriptor{
+		SecretKey: testSecretKey,
+		Audit:     &AuditConfig{RecentRecords: -1},
+	})
+	a.Error(err)
+
+	fileSink, err := NewFileAuditSink(path)
+	a.NoError(err)
+	records := []AuditRecord{}
+	s, err := NewService(Descriptor{
+		SecretKey: testSecretKey,
+		Audit: &AuditConfig{
+			Sinks: []AuditSink{
+				fileSink,
+				AuditSinkFunc(func(rec AuditRecord) error {
+					records = append(records, rec)
+					return nil
+				}),
+			},
+			RecentRecords: 3,
+		},
+		Commands: CommandsDescriptor{
+			Descriptors: []CommandDescriptor{
+				{
+					Name:        "deploy",
+					Description: "deploys",
+					Args: CommandParams{
+						"target": {Type: RequestParamTypes.String, Description: "target"},
+						"token":  {Type: RequestParamTypes.String, Description: "token", IsSecret: true},
+					},
+					Handler: func(r Request) Response { return MakeSuccessResponse() },
+				},
+				{
+					Name:        "fail",
+					Description: "fails",
+					Args:        CommandParams{},
+					Handler:     func(r Request) Response { return NewErrorResponse(fmt.Errorf("boom")) },
+				},
+			},
+		},
+	})
+	a.NoError(err)
+
+	jwt := makeTestJWT(Dict{"uid": "u1", "ident": "user@example.com", "oid": oid, "exp": time.Now().Add(time.Hour).Unix()})
+	cmd := makeConfigCommand(oid, "deploy", Dict{"target": "prod", "token": "s3cr3t"})
+	cmd["jwt"] = jwt
+	a.True(s.ProcessCommand(cmd).IsSuccess)
+	a.False(s.ProcessCommand(makeConfigCommand(oid, "fail", nil)).IsSuccess)
+
+	a.Len(records, 2)
+	a.Equal(AuditKinds.Command, records[0].Kind)
+	a.Equal(oid, records[0].OID)
+	a.Equal("u1", records[0].UserID)
+	a.Equal("user@example.com", records[0].Identity)
+	a.Equal("deploy", records[0].Command)
+	a.Equal(Dict{"target": "prod", "token": redactedValue}, records[0].Args)
+	a.Equal("123", records[0].RoomID)
+	a.Equal("456", records[0].CommandID)
+	a.True(records[0].IsSuccess)
+	a.Equal("fail", records[1].Command)
+	a.False(records[1].IsSuccess)
+	a.Equal("boom", records[1].Error)
+
+	// Changes made through the framework's client are recorded.
+	client := s.auditor.wrapOrgConfigClient(&fakeOrgConfigClient{}, Request{OID: oid, Claims: &JWTClaims{UserID: "u1"}})
+	a.NoError(client.DRRuleAdd("r1", Dict{}, []Dict{}))
+	_, err = client.SyncPush(lc.OrgConfig{}, lc.SyncOptions{IsDryRun: true})
+	a.NoError(err)
+	a.NoError(client.LookupDelete("l1"))
+	a.Len(records, 4)
+	a.Equal(AuditKinds.Mutation, records[2].Kind)
+	a.Equal("dr_rule_add", records[2].Operation)
+	a.Equal("r1", records[2].Target)
+	a.Equal("u1", records[2].UserID)
+	a.Equal("lookup_delete", records[3].Operation)
+
+	// Handlers record the changes they make through the SDK.
+	s.RecordMutation(Request{OID: oid, Claims: &JWTClaims{UserID: "u2"}}, "output_add", "o1", Dict{"module": "s3"}, fmt.Errorf("denied"))
+	a.Len(records, 5)
+	a.Equal(AuditKinds.Mutation, records[4].Kind)
+	a.Equal("output_add", records[4].Operation)
+	a.Equal("o1", records[4].Target)
+	a.Equal("u2", records[4].UserID)
+	a.False(records[4].IsSuccess)
+	a.Equal("denied", records[4].Error)
+
+	// The audit log requires its permission.
+	getAuditLog := func(oid string, args Dict) Response {
+		cmd := makeConfigCommand(oid, "get_audit_log", args)
+		cmd["jwt"] = makeTestJWT(Dict{"uid": "u1", "oid": oid, "exp": time.Now().Add(time.Hour).Unix(), "perm": []string{"audit.get"}})
+		return s.ProcessCommand(cmd)
+	}
+	resp := s.ProcessCommand(makeConfigCommand(oid, "get_audit_log", nil))
+	a.False(resp.IsSuccess)
+	a.Contains(resp.Error, "permissions required: [audit.get]")
+	a.Len(records, 6)
+
+	// The recent records are returned newest first.
+	resp = getAuditLog(oid, Dict{"limit": 2})
+	a.True(resp.IsSuccess)
+	a.Equal([]AuditRecord{records[5], records[4]}, resp.Data["records"])
+	resp = getAuditLog(oid, nil)
+	a.True(resp.IsSuccess)
+	recent := resp.Data["records"].([]AuditRecord)
+	a.Len(recent, 3)
+	a.Equal("get_audit_log", recent[0].Command)
+	resp = getAuditLog("22222222-2222-2222-2222-222222222222", nil)
+	a.True(resp.IsSuccess)
+	a.Empty(resp.Data["records"])
+
+	a.NoError(fileSink.Close())
+	f, err := os.Open(path)
+	a.NoError(err)
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rec := AuditRecord{}
+		a.NoError(json.Unmarshal(scanner.Bytes(), &rec))
+		a.Equal(records[lines].Kind, rec.Kind)
+		a.NotContains(scanner.Text(), "s3cr3t")
+		lines++
+	}
+	a.Equal(len(records), lines)
+}
+
+func TestAuditedOrg(t *testing.T) {
+	a := assert.New(t)
+	oid := "11111111-1111-1111-1111-111111111111"
+	records := []AuditRecord{}
+	fake := &fakeOrgConfigClient{rules: map[string]map[string]lc.Dict{}}
+	var s *CoreService
+	s, err := NewService(Descriptor{
+		SecretKey:          testSecretKey,
+		SecretsMasterKey:   "master",
+		CommandPermissions: noCommandPermissions(),
+		Audit: &AuditConfig{
+			Sinks: []AuditSink{
+				AuditSinkFunc(func(rec AuditRecord) error {
+					if rec.Kind == AuditKinds.Mutation {
+						records = append(records, rec)
+					}
+					return nil
+				}),
+			},
+		},
+		Commands: CommandsDescriptor{
+			Descriptors: []CommandDescriptor{
+				{
+					Name:        "change",
+					Description: "changes the org",
+					Args:        CommandParams{},
+					Handler: func(r Request) Response {
+						o := r.AuditedOrg()
+						// Keep the SDK from reaching the API.
+						o.client.(*auditedOrgConfigClient).orgConfigClient = fake
+						if err := o.DRRuleAdd("r1", Dict{}, []Dict{}); err != nil {
+							return NewErrorResponse(err)
+						}
+						_, err := o.RuleManager(NewMemoryStore(), OwnedByPrefix("svc-")).Sync(map[string]lc.CoreDRRule{
+							"svc-a": makeTestRule("", "a"),
+						}, RuleSyncOptions{})
+						if err != nil {
+							return NewErrorResponse(err)
+						}
+						token, _, err := s.Secrets().Get(r.OID, "token")
+						if err != nil {
+							return NewErrorResponse(err)
+						}
+						s.RecordMutation(r, "webhook_set", "hook", Dict{"url": "https://example.com/?token=" + token}, nil)
+						return MakeSuccessResponse()
+					},
+				},
+			},
+		},
+	})
+	a.NoError(err)
+	_, err = s.Secrets().Set(oid, "token", "s3cr3t-token")
+	a.NoError(err)
+
+	// Requests without an org have no AuditedOrg.
+	a.Nil(Request{OID: oid}.AuditedOrg())
+
+	cmd := makeConfigCommand(oid, "change", nil)
+	cmd["jwt"] = makeTestJWT(Dict{"uid": "u1", "oid": oid, "exp": time.Now().Add(time.Hour).Unix()})
+	a.True(s.ProcessCommand(cmd).IsSuccess)
+
+	// Changes made by the handler, directly or through a
+	// RuleManager, are recorded on behalf of the user.
+	a.Len(records, 3)
+	a.Equal("dr_rule_add", records[0].Operation)
+	a.Equal("r1", records[0].Target)
+	a.Equal("dr_rule_add", records[1].Operation)
+	a.Equal("svc-a", records[1].Target)
+	for _, rec := range records {
+		a.Equal("u1", rec.UserID)
+		a.Equal(oid, rec.OID)
+	}
+
+	// Secrets are redacted from the details.
+	a.Equal("webhook_set", records[2].Operation)
+	a.Equal(Dict{"url": "https://example.com/?token=" + redactedValue}, records[2].Details)
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+// The SDK client of the org of a Request, recording the changes
+// made through the methods below in the audit trail on behalf of
+// the user of the Request, when the Descriptor has an Audit. The
+// other methods are those of the SDK and are not recorded.
+type AuditedOrg struct {
+	*lc.Organization
+
+	client   orgConfigClient
+	recorder *auditRecorder
+}
+
+// Get the SDK client of the org recording the changes made
+// to it, nil if the Request has no Org.
+func (r Request) AuditedOrg() *AuditedOrg {
+	if r.Org == nil {
+		return nil
+	}
+	o := &AuditedOrg{
+		Organization: r.Org,
+		client:       sdkOrgConfigClient{r.Org},
+		recorder:     r.auditRecorder,
+	}
+	if r.auditRecorder != nil {
+		o.client = &auditedOrgConfigClient{
+			orgConfigClient: o.client,
+			auditRecorder:   r.auditRecorder,
+		}
+	}
+	return o
+}
+
+// Create a RuleManager for the org, its changes being recorded.
+func (o *AuditedOrg) RuleManager(store KVStore, isOwned func(name string) bool) *RuleManager {
+	return newRuleManager(o.client, o.GetOID(), store, isOwned)
+}
+
+func (o *AuditedOrg) record(operation string, target string, details Dict, start time.Time, err error) {
+	if o.recorder == nil {
+		return
+	}
+	o.recorder.record(operation, target, details, start, err)
+}
+
+func (o *AuditedOrg) SyncPush(conf lc.OrgConfig, options lc.SyncOptions) ([]lc.OrgSyncOperation, error) {
+	return o.client.SyncPush(conf, options)
+}
+
+func (o *AuditedOrg) DRRuleAdd(name string, detection interface{}, response interface{}, opt ...lc.NewDRRuleOptions) error {
+	return o.client.DRRuleAdd(name, detection, response, opt...)
+}
+
+func (o *AuditedOrg) DRRuleDelete(name string, filters ...lc.DRRuleFilter) error {
+	return o.client.DRRuleDelete(name, filters...)
+}
+
+func (o *AuditedOrg) FPRuleAdd(name lc.FPRuleName, detection interface{}, opts ...lc.FPRuleOptions) error {
+	start := time.Now()
+	err := o.Organization.FPRuleAdd(name, detection, opts...)
+	o.record("fp_rule_add", string(name), nil, start, err)
+	return err
+}
+
+func (o *AuditedOrg) FPRuleDelete(name lc.FPRuleName) error {
+	return o.client.FPRuleDelete(name)
+}
+
+func (o *AuditedOrg) OutputAdd(output lc.OutputConfig) (lc.OutputConfig, error) {
+	start := time.Now()
+	resp, err := o.Organization.OutputAdd(output)
+	o.record("output_add", output.Name, Dict{"module": output.Module, "type": output.Type}, start, err)
+	return resp, err
+}
+
+func (o *AuditedOrg) OutputDel(name string) (lc.GenericJSON, error) {
+	return o.client.OutputDel(name)
+}
+
+// Delete a lookup of the org.
+func (o *AuditedOrg) LookupDelete(name string) error {
+	return o.client.LookupDelete(name)
+}
+
+func (o *AuditedOrg) ResourceSubscribe(name lc.ResourceName, category lc.ResourceCategory) error {
+	start := time.Now()
+	err := o.Organization.ResourceSubscribe(name, category)
+	o.record("resource_subscribe", name, Dict{"category": category}, start, err)
+	return err
+}
+
+func (o *AuditedOrg) ResourceUnsubscribe(name lc.ResourceName, category lc.ResourceCategory) error {
+	start := time.Now()
+	err := o.Organization.ResourceUnsubscribe(name, category)
+	o.record("resource_unsubscribe", name, Dict{"category": category}, start, err)
+	return err
+}
+
+func (o *AuditedOrg) SubscribeToExtension(name lc.ExtensionName) error {
+	start := time.Now()
+	err := o.Organization.SubscribeToExtension(name)
+	o.record("extension_subscribe", name, nil, start, err)
+	return err
+}
+
+func (o *AuditedOrg) UnsubscribeFromExtension(name lc.ExtensionName) error {
+	start := time.Now()
+	err := o.Organization.UnsubscribeFromExtension(name)
+	o.record("extension_unsubscribe", name, nil, start, err)
+	return err
+}
+
+func (o *AuditedOrg) AddInstallationKey(k lc.InstallationKey) (string, error) {
+	start := time.Now()
+	iid, err := o.Organization.AddInstallationKey(k)
+	o.record("installation_key_add", iid, Dict{"desc": k.Description, "tags": k.Tags}, start, err)
+	return iid, err
+}
+
+func (o *AuditedOrg) DelInstallationKey(iid string) error {
+	start := time.Now()
+	err := o.Organization.DelInstallationKey(iid)
+	o.record("installation_key_delete", iid, nil, start, err)
+	return err
+}
+
+// Set a value of the org, the value is not recorded.
+func (o *AuditedOrg) OrgValueSet(name string, value string) error {
+	start := time.Now()
+	err := o.Organization.OrgValueSet(name, value)
+	o.record("org_value_set", name, nil, start, err)
+	return err
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+)
+
+const (
+	// Module of this framework, to find its version in the build.
+	libraryModulePath = "github.com/refractionPOINT/lc-service/lcservice-go"
+)
+
+// Build values which may be set at link time, taking precedence over
+// the values found in the build, like:
+// -ldflags "-X github.com/refractionPOINT/lc-service/lcservice-go/service.BuildVersion=1.2.3"
+var (
+	BuildVersion string
+	BuildCommit  string
+	BuildTime    string
+)
+
+// Build of the service, reported in health.
+type BuildInfo struct {
+	Name           string `json:"name"`
+	Version        string `json:"version,omitempty"`
+	Commit         string `json:"commit,omitempty"`
+	BuildTime      string `json:"build_time,omitempty"`
+	IsModified     bool   `json:"is_modified,omitempty"`
+	GoVersion      string `json:"go_version"`
+	LibraryVersion string `json:"library_version,omitempty"`
+}
+
+func readBuildInfo(name string) BuildInfo {
+	b := BuildInfo{
+		Name:      name,
+		GoVersion: runtime.Version(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		if info.Main.Path == libraryModulePath {
+			b.LibraryVersion = b.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path != libraryModulePath {
+				continue
+			}
+			b.LibraryVersion = dep.Version
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				b.LibraryVersion = dep.Replace.Version
+			}
+		}
+		readVCSSettings(info, &b)
+	}
+	if BuildVersion != "" {
+		b.Version = BuildVersion
+	}
+	if BuildCommit != "" {
+		b.Commit = BuildCommit
+	}
+	if BuildTime != "" {
+		b.BuildTime = BuildTime
+	}
+	return b
+}
+
+// Get the build of the service.
+func (cs *CoreService) BuildInfo() BuildInfo {
+	return cs.buildInfo
+}
+
+// Mark a framework feature as used by the service, for
+// the features built on top of the CoreService.
+func (cs *CoreService) enableFeature(name string) {
+	cs.features[name] = struct{}{}
+}
+
+// Framework features used by the service, reported in health
+// so that the platform and tooling know what it supports.
+func (cs *CoreService) getFeatures() []string {
+	d := cs.desc
+	isEnabled := map[string]bool{
+		"managed_config":        cs.managedConfig != nil,
+		"org_config":            cs.config != nil,
+		"secrets":               cs.secrets != nil,
+		"org_registry":          cs.orgs != nil,
+		"service_credentials":   cs.orgClients != nil,
+		"audit":                 cs.auditor != nil,
+		"load_shedding":         cs.shedder != nil,
+		"rate_limits":           cs.rateLimiter != nil,
+		"timeouts":              hasTimeouts(d),
+		"detection_router":      d.DetectionRouter != nil,
+		"detection_suppression": d.DetectionSuppression != nil,
+		"event_router":          d.EventRouter != nil,
+		"help":                  d.BuiltinCommands.IsHelp,
+		"ping":                  d.BuiltinCommands.IsPing,
+		"version":               d.BuiltinCommands.IsVersion,
+		"diagnostics":           d.BuiltinCommands.IsDiagnostics,
+	}
+	for _, cmd := range d.Commands.Descriptors {
+		if len(cmd.RequiredPermissions) != 0 {
+			isEnabled["command_permissions"] = true
+		}
+	}
+	for name := range cs.features {
+		isEnabled[name] = true
+	}
+	features := []string{}
+	for name, ok := range isEnabled {
+		if ok {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
@@ -0,0 +1,12 @@
+//go:build !go1.18
+// +build !go1.18
+
+package service
+
+import (
+	"runtime/debug"
+)
+
+// Older toolchains do not record the commit, it
+// can still be set at link time with BuildCommit.
+func readVCSSettings(info *debug.BuildInfo, b *BuildInfo) {}
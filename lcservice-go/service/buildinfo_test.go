@@ -0,0 +1,45 @@
+package service
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfo(t *testing.T) {
+	a := assert.New(t)
+
+	b := readBuildInfo("svc")
+	a.Equal("svc", b.Name)
+	a.Equal(runtime.Version(), b.GoVersion)
+
+	// Values set at link time take precedence.
+	BuildVersion, BuildCommit, BuildTime = "1.2.3", "abc123", "2024-01-01T00:00:00Z"
+	defer func() { BuildVersion, BuildCommit, BuildTime = "", "", "" }()
+	b = readBuildInfo("svc")
+	a.Equal("1.2.3", b.Version)
+	a.Equal("abc123", b.Commit)
+	a.Equal("2024-01-01T00:00:00Z", b.BuildTime)
+}
+
+func TestFeatures(t *testing.T) {
+	a := assert.New(t)
+
+	s, err := NewService(Descriptor{
+		Name:                 "svc",
+		SecretKey:            testSecretKey,
+		SecretsMasterKey:     "master",
+		IsTrackInstalledOrgs: true,
+		RateLimits:           RateLimits{PerType: map[string]RateLimit{"command": {Rate: 1, Burst: 1}}},
+		BuiltinCommands:      BuiltinCommands{IsPing: true},
+		DetectionRouter:      NewDetectionRouter(),
+	})
+	a.NoError(err)
+
+	resp := s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	mtd := resp.Data["mtd"].(Dict)
+	a.Equal("svc", mtd["build"].(BuildInfo).Name)
+	a.Equal([]string{"command_permissions", "detection_router", "org_registry", "ping", "rate_limits", "secrets"}, mtd["features"])
+}
@@ -0,0 +1,23 @@
+//go:build go1.18
+// +build go1.18
+
+package service
+
+import (
+	"runtime/debug"
+)
+
+// Read the commit of the build, recorded by the
+// toolchain since Go 1.18 when building from VCS.
+func readVCSSettings(info *debug.BuildInfo, b *BuildInfo) {
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Commit = s.Value
+		case "vcs.time":
+			b.BuildTime = s.Value
+		case "vcs.modified":
+			b.IsModified = s.Value == "true"
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Built-in commands to introspect a deployed service,
+// each added alongside the commands of the service if set.
+type BuiltinCommands struct {
+	// help: the commands and their arguments.
+	IsHelp bool
+	// ping: check the service answers commands.
+	IsPing bool
+	// version: the build and the protocol version.
+	IsVersion bool
+	// diagnostics: uptime, load, scheduled callbacks
+	// and configuration checks.
+	IsDiagnostics bool
+}
+
+// Result of a check of the configuration of the service.
+type DiagnosticCheck struct {
+	Name    string `json:"name"`
+	IsOK    bool   `json:"is_ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Runs of a scheduled callback, like "org_per_1h".
+type scheduledRuns struct {
+	nRuns   uint64
+	lastRun int64
+}
+
+type builtins struct {
+	cs        *CoreService
+	scheduled map[string]*scheduledRuns
+}
+
+func newBuiltins(cs *CoreService) *builtins {
+	return &builtins{
+		cs:        cs,
+		scheduled: map[string]*scheduledRuns{},
+	}
+}
+
+func isScheduledCallback(cbName string) bool {
+	return strings.HasPrefix(cbName, "org_per_") || strings.HasPrefix(cbName, "once_per_") || strings.HasPrefix(cbName, "sensor_per_")
+}
+
+func (b *builtins) install() error {
+	conf := b.cs.desc.BuiltinCommands
+	cmds := []CommandDescriptor{}
+	if conf.IsHelp {
+		cmds = append(cmds, CommandDescriptor{
+			Name:        "help",
+			Description: "List the commands of the service and their arguments.",
+			Args:        CommandParams{},
+			Handler:     b.cmdHelp,
+		})
+	}
+	if conf.IsPing {
+		cmds = append(cmds, CommandDescriptor{
+			Name:        "ping",
+			Description: "Check the service is responding.",
+			Args:        CommandParams{},
+			Handler:     b.cmdPing,
+		})
+	}
+	if conf.IsVersion {
+		cmds = append(cmds, CommandDescriptor{
+			Name:        "version",
+			Description: "Get the version of the service.",
+			Args:        CommandParams{},
+			Handler:     b.cmdVersion,
+		})
+	}
+	if conf.IsDiagnostics {
+		cmds = append(cmds, CommandDescriptor{
+			Name:        "diagnostics",
+			Description: "Get the state of the service and check its configuration.",
+			Args:        CommandParams{},
+			Handler:     b.cmdDiagnostics,
+		})
+		for cbName := range b.cs.cbMap {
+			if !isScheduledCallback(cbName) {
+				continue
+			}
+			b.scheduled[cbName] = &scheduledRuns{}
+			b.cs.interceptCallback(cbName, b.onScheduled)
+		}
+	}
+	for _, cmd := range cmds {
+		if err := b.cs.desc.addCommand(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *builtins) onScheduled(r Request, next ServiceCallback) Response {
+	if runs, ok := b.scheduled[r.Event.Type]; ok {
+		atomic.AddUint64(&runs.nRuns, 1)
+		atomic.StoreInt64(&runs.lastRun, time.Now().Unix())
+	}
+	return callNext(next, r)
+}
+
+type helpArg struct {
+	Name string
+	Def  RequestParamDef
+}
+
+func sortedArgs(args CommandParams) []helpArg {
+	sorted := []helpArg{}
+	for name, def := range args {
+		sorted = append(sorted, helpArg{name, def})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Def.Index != sorted[j].Def.Index {
+			return sorted[i].Def.Index < sorted[j].Def.Index
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// Render the commands as text, one command per line
+// followed by one line per argument.
+func renderHelp(cmds []CommandDescriptor) string {
+	lines := []string{}
+	for _, cmd := range cmds {
+		lines = append(lines, fmt.Sprintf("%s: %s", cmd.Name, cmd.Description))
+		for _, arg := range sortedArgs(cmd.Args) {
+			attrs := []string{arg.Def.Type}
+			if arg.Def.IsRequired {
+				attrs = append(attrs, "required")
+			}
+			if len(arg.Def.Values) != 0 {
+				attrs = append(attrs, strings.Join(arg.Def.Values, "|"))
+			}
+			lines = append(lines, fmt.Sprintf("  --%s (%s): %s", arg.Name, strings.Join(attrs, ", "), arg.Def.Description))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (b *builtins) cmdHelp(r Request) Response {
+	cmds := append([]CommandDescriptor{}, b.cs.desc.Commands.Descriptors...)
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return MakeSuccessResponse(Dict{
+		"commands": cmds,
+		"text":     renderHelp(cmds),
+	})
+}
+
+func (b *builtins) cmdPing(r Request) Response {
+	return MakeSuccessResponse(Dict{
+		"pong": time.Now().Unix(),
+	})
+}
+
+func (b *builtins) cmdVersion(r Request) Response {
+	return MakeSuccessResponse(Dict{
+		"protocol_version": PROTOCOL_VERSION,
+		"build":            b.cs.buildInfo,
+	})
+}
+
+func (b *builtins) cmdDiagnostics(r Request) Response {
+	scheduled := Dict{}
+	for cbName, runs := range b.scheduled {
+		scheduled[cbName] = Dict{
+			"runs":     atomic.LoadUint64(&runs.nRuns),
+			"last_run": atomic.LoadInt64(&runs.lastRun),
+		}
+	}
+	return MakeSuccessResponse(Dict{
+		"uptime_s":          time.Now().Unix() - b.cs.startedAt,
+		"calls_in_progress": atomic.LoadUint32(&b.cs.callsInProgress),
+		"scheduled":         scheduled,
+		"checks":            b.checks(r.OID),
+	})
+}
+
+// Check the configuration of the service, and of
+// the org requesting the diagnostics if any.
+func (b *builtins) checks(oid string) []DiagnosticCheck {
+	cs := b.cs
+	checks := []DiagnosticCheck{}
+	add := func(name string, err error) {
+		c := DiagnosticCheck{Name: name, IsOK: err == nil}
+		if err != nil {
+			c.Message = err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	add("descriptor", cs.desc.IsValid())
+	var storeErr error
+	if s, ok := cs.desc.StateStore.(*kvStore); ok && s.path == "" {
+		storeErr = fmt.Errorf("state store is in memory only, state is lost on restart")
+	}
+	add("state_store", storeErr)
+	if oid == "" {
+		return checks
+	}
+	if cs.config != nil {
+		_, _, err := cs.config.merge(oid, Dict{})
+		add("org_config", err)
+	}
+	if cs.orgClients != nil {
+		_, err := cs.orgClients.clientOptions(oid)
+		add("org_credentials", err)
+	}
+	return checks
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinCommands(t *testing.T) {
+	a := assert.New(t)
+
+	// Nothing is added unless asked for.
+	s, err := NewService(Descriptor{SecretKey: testSecretKey})
+	a.NoError(err)
+	a.Empty(s.desc.Commands.Descriptors)
+
+	s, err = NewService(Descriptor{
+		Name:               "svc",
+		SecretKey:          testSecretKey,
+		CommandPermissions: noCommandPermissions(),
+		ConfigSchema: RequestParams{
+			"api_url": {Type: RequestParamTypes.String, Description: "url of the api", IsRequired: true},
+		},
+		BuiltinCommands: BuiltinCommands{
+			IsHelp:        true,
+			IsPing:        true,
+			IsVersion:     true,
+			IsDiagnostics: true,
+		},
+		Callbacks: DescriptorCallbacks{
+			OnOrgPer1H: func(r Request) Response { return MakeSuccessResponse() },
+		},
+		Commands: CommandsDescriptor{
+			Descriptors: []CommandDescriptor{
+				{
+					Name:        "scan",
+					Description: "scans a sensor",
+					Args: CommandParams{
+						"sid":  {Type: RequestParamTypes.SID, Description: "sensor to scan", IsRequired: true, Index: 1},
+						"mode": {Type: RequestParamTypes.Enum, Description: "scan mode", Values: []string{"fast", "full"}, Index: 2},
+					},
+					Handler: func(r Request) Response { return MakeSuccessResponse() },
+				},
+			},
+		},
+	})
+	a.NoError(err)
+
+	resp := s.ProcessCommand(makeConfigCommand("o1", "ping", nil))
+	a.True(resp.IsSuccess)
+	a.Contains(resp.Data, "pong")
+
+	resp = s.ProcessCommand(makeConfigCommand("o1", "help", nil))
+	a.True(resp.IsSuccess)
+	text := resp.Data["text"].(string)
+	a.Contains(text, "scan: scans a sensor\n  --sid (sid, required): sensor to scan\n  --mode (enum, fast|full): scan mode")
+	a.Contains(text, "ping: Check the service is responding.")
+	a.Contains(text, "get_config:")
+	names := []string{}
+	for _, cmd := range resp.Data["commands"].([]CommandDescriptor) {
+		names = append(names, cmd.Name)
+	}
+	a.Equal([]string{"diagnostics", "get_config", "help", "ping", "scan", "set_config", "validate_config", "version"}, names)
+
+	resp = s.ProcessCommand(makeConfigCommand("o1", "version", nil))
+	a.True(resp.IsSuccess)
+	a.Equal(PROTOCOL_VERSION, resp.Data["protocol_version"])
+	a.Equal("svc", resp.Data["build"].(BuildInfo).Name)
+	a.NotEmpty(resp.Data["build"].(BuildInfo).GoVersion)
+
+	a.True(s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "org_per_1h", Data: Dict{}})).IsSuccess)
+	resp = s.ProcessCommand(makeConfigCommand("o1", "diagnostics", nil))
+	a.True(resp.IsSuccess)
+	a.Equal(uint32(1), resp.Data["calls_in_progress"])
+	scheduled := resp.Data["scheduled"].(Dict)
+	a.Len(scheduled, 1)
+	a.Equal(uint64(1), scheduled["org_per_1h"].(Dict)["runs"])
+	a.NotZero(scheduled["org_per_1h"].(Dict)["last_run"])
+	checks := resp.Data["checks"].([]DiagnosticCheck)
+	a.Len(checks, 3)
+	a.Equal(DiagnosticCheck{Name: "descriptor", IsOK: true}, checks[0])
+	a.Equal("state_store", checks[1].Name)
+	a.False(checks[1].IsOK)
+	a.Equal("org_config", checks[2].Name)
+	a.False(checks[2].IsOK)
+	a.Contains(checks[2].Message, "'api_url' is required")
+
+	a.True(s.ProcessCommand(makeConfigCommand("o1", "set_config", Dict{"api_url": "https://example.com"})).IsSuccess)
+	resp = s.ProcessCommand(makeConfigCommand("o1", "diagnostics", nil))
+	checks = resp.Data["checks"].([]DiagnosticCheck)
+	a.True(checks[2].IsOK)
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 type CommandsDescriptor struct {
@@ -30,6 +31,16 @@ type CommandDescriptor struct {
 	Description string          `json:"desc" msgpack:"desc"`
 	Args        CommandParams   `json:"args" msgpack:"args"`
 	Handler     ServiceCallback `json:"-" msgpack:"-"`
+
+	// Permissions the JWT of the request must grant,
+	// like "sensor.task", checked before calling the Handler.
+	RequiredPermissions []string `json:"required_permissions,omitempty" msgpack:"required_permissions,omitempty"`
+
+	// Optional per-org rate limit of the command.
+	RateLimit *RateLimit `json:"-" msgpack:"-"`
+
+	// Optional maximum runtime of the handler.
+	Timeout time.Duration `json:"-" msgpack:"-"`
 }
 
 func (d CommandDescriptor) isValid() error {
@@ -45,5 +56,13 @@ func (d CommandDescriptor) isValid() error {
 	if d.Handler == nil {
 		return fmt.Errorf("command %s has a nil handler", d.Name)
 	}
+	if d.Timeout < 0 {
+		return fmt.Errorf("command '%s' timeout is negative", d.Name)
+	}
+	if d.RateLimit != nil {
+		if err := d.RateLimit.isValid(); err != nil {
+			return fmt.Errorf("command '%s' rate limit: %v", d.Name, err)
+		}
+	}
 	return nil
 }
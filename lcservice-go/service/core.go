@@ -23,6 +23,24 @@ type CoreService struct {
 	startedAt       int64
 
 	cbMap map[string]ServiceCallback
+
+	// Additional metadata reported in health by
+	// the components built on top of the CoreService.
+	healthMtd map[string]func() interface{}
+
+	managedConfig *managedConfigManager
+	orgs          *OrgRegistry
+	config        *orgConfigManager
+	secrets       *SecretStore
+	redactor      *secretRedactor
+	shedder       *loadShedder
+	rateLimiter   *rateLimiter
+	timeouts      *handlerTimeouts
+	orgClients    *orgClientFactory
+	auditor       *auditor
+
+	buildInfo BuildInfo
+	features  map[string]struct{}
 }
 
 type lcRequest struct {
@@ -40,9 +58,15 @@ func NewService(descriptor Descriptor) (*CoreService, error) {
 		return nil, err
 	}
 
+	descriptor.applyDetectionRouter()
+	descriptor.applyDetectionSuppression()
+	descriptor.applyEventRouter()
 	cs := &CoreService{
 		desc:      descriptor,
 		startedAt: time.Now().Unix(),
+		healthMtd: map[string]func() interface{}{},
+		buildInfo: readBuildInfo(descriptor.Name),
+		features:  map[string]struct{}{},
 	}
 	// Initialize some of the values we prefer to be ready.
 	if cs.desc.DetectionsSubscribed == nil {
@@ -51,7 +75,60 @@ func NewService(descriptor Descriptor) (*CoreService, error) {
 	if cs.desc.RequestParameters == nil {
 		cs.desc.RequestParameters = map[string]RequestParamDef{}
 	}
+	if cs.desc.StateStore == nil {
+		cs.desc.StateStore = NewMemoryStore()
+	}
 	cs.cbMap = cs.buildCallbackMap()
+	if cs.desc.ManagedConfig != nil {
+		cs.managedConfig = newManagedConfigManager(cs, *cs.desc.ManagedConfig)
+		cs.managedConfig.install()
+	}
+	if cs.desc.SecretsMasterKey != "" {
+		cs.enableRedaction()
+		cs.secrets = newSecretStore(cs, cs.redactor)
+		if err := cs.secrets.install(); err != nil {
+			return nil, err
+		}
+	}
+	if cs.desc.Credentials != nil {
+		cs.orgClients = newOrgClientFactory(cs)
+		cs.orgClients.install()
+	}
+	if len(cs.desc.ConfigSchema) != 0 {
+		cs.config = newOrgConfigManager(cs)
+		if err := cs.config.install(); err != nil {
+			return nil, err
+		}
+	}
+	if cs.desc.Concurrency.isEnabled() {
+		cs.shedder = newLoadShedder(cs.desc.Concurrency)
+		cs.addHealthMetadata("load", cs.shedder.getHealthMetadata)
+	}
+	cs.timeouts = newHandlerTimeouts(cs)
+	if hasTimeouts(cs.desc) {
+		cs.addHealthMetadata("timeouts", cs.timeouts.getHealthMetadata)
+	}
+	if isRateLimited(cs.desc) {
+		if err := cs.enableRateLimits(); err != nil {
+			return nil, err
+		}
+	}
+	if cs.desc.suppressor != nil {
+		cs.desc.suppressor.install(cs)
+	}
+	if cs.desc.IsTrackInstalledOrgs {
+		cs.orgs = newOrgRegistry(cs)
+		cs.orgs.install()
+	}
+	if cs.desc.Audit != nil {
+		cs.auditor = newAuditor(cs)
+		if err := cs.auditor.install(); err != nil {
+			return nil, err
+		}
+	}
+	if err := newBuiltins(cs).install(); err != nil {
+		return nil, err
+	}
 
 	return cs, nil
 }
@@ -60,6 +137,54 @@ func (cs *CoreService) Init() error {
 	return nil
 }
 
+// Get the registry of installed orgs, nil unless
+// Descriptor.IsTrackInstalledOrgs is set.
+func (cs *CoreService) Orgs() *OrgRegistry {
+	return cs.orgs
+}
+
+// Get a client of an org using the Descriptor.Credentials,
+// for the requests without a JWT like the once_per_* callbacks
+// and for background tasks. Clients are cached and re-created
+// with fresh credentials every RefreshInterval.
+func (cs *CoreService) OrgClient(oid string) (*lc.Organization, error) {
+	if cs.orgClients == nil {
+		return nil, fmt.Errorf("no service credentials")
+	}
+	return cs.orgClients.get(oid)
+}
+
+// Build the client managing the configuration of the
+// org of a Request, recording the changes when audited.
+func (cs *CoreService) orgConfigClient(r Request) (orgConfigClient, error) {
+	client, err := newOrgConfigClient(r)
+	if err != nil || cs.auditor == nil {
+		return client, err
+	}
+	return cs.auditor.wrapOrgConfigClient(client, r), nil
+}
+
+// Get the per-org secrets, nil unless
+// Descriptor.SecretsMasterKey is set.
+func (cs *CoreService) Secrets() *SecretStore {
+	return cs.secrets
+}
+
+// Redact secret values from everything logged.
+func (cs *CoreService) enableRedaction() {
+	cs.redactor = newSecretRedactor()
+	if log := cs.desc.Log; log != nil {
+		cs.desc.Log = func(msg string) {
+			log(cs.redactor.redact(msg))
+		}
+	}
+	if logCritical := cs.desc.LogCritical; logCritical != nil {
+		cs.desc.LogCritical = func(msg string) {
+			logCritical(cs.redactor.redact(msg))
+		}
+	}
+}
+
 func (cs *CoreService) GetSecretKey() []byte {
 	return []byte(cs.desc.SecretKey)
 }
@@ -70,6 +195,8 @@ type handlerResolver interface {
 	get(requestEvent RequestEvent) ServiceCallback
 	preHandlerHook(request *Request) error
 	errorHandlerHook(request Request, errorMessage string) error
+	redactArgs(data Dict) Dict
+	timeout(requestEvent RequestEvent) time.Duration
 }
 
 type requestHandlerResolver struct {
@@ -99,6 +226,10 @@ func (r *requestHandlerResolver) get(requestEvent RequestEvent) ServiceCallback
 	return handler
 }
 
+func (r *requestHandlerResolver) timeout(requestEvent RequestEvent) time.Duration {
+	return r.cs.desc.CallbackTimeouts[requestEvent.Type]
+}
+
 func (r *requestHandlerResolver) preHandlerHook(request *Request) error {
 	return nil
 }
@@ -107,6 +238,10 @@ func (r *requestHandlerResolver) errorHandlerHook(request Request, errorMessage
 	return nil
 }
 
+func (r *requestHandlerResolver) redactArgs(data Dict) Dict {
+	return data
+}
+
 type commandHandlerResolver struct {
 	commandsDesc *CommandsDescriptor
 	desc         *Descriptor
@@ -145,7 +280,21 @@ func (c *commandHandlerResolver) get(requestEvent RequestEvent) ServiceCallback
 	return nil
 }
 
+func (c *commandHandlerResolver) timeout(requestEvent RequestEvent) time.Duration {
+	for _, commandHandler := range c.commandsDesc.Descriptors {
+		if requestEvent.Data["command_name"] == commandHandler.Name {
+			return commandHandler.Timeout
+		}
+	}
+	return 0
+}
+
 func (r *commandHandlerResolver) preHandlerHook(request *Request) error {
+	for _, commandHandler := range r.commandsDesc.Descriptors {
+		if request.Event.Data["command_name"] == commandHandler.Name {
+			return checkPermissions(*request, commandHandler.RequiredPermissions)
+		}
+	}
 	return nil
 }
 
@@ -153,6 +302,24 @@ func (r *commandHandlerResolver) errorHandlerHook(request Request, errorMessage
 	return nil
 }
 
+// Hide the values of the arguments marked as secret.
+func (r *commandHandlerResolver) redactArgs(data Dict) Dict {
+	for _, commandHandler := range r.commandsDesc.Descriptors {
+		if data["command_name"] != commandHandler.Name {
+			continue
+		}
+		redacted := Dict{}
+		for k, v := range data {
+			if arg, ok := commandHandler.Args[k]; ok && arg.IsSecret {
+				v = redactedValue
+			}
+			redacted[k] = v
+		}
+		return redacted
+	}
+	return data
+}
+
 func (cs *CoreService) Log(log string) {
 	if cs.desc.IsDebug {
 		cs.desc.Log(log)
@@ -166,9 +333,17 @@ func (cs *CoreService) LogError(errStr string) {
 }
 
 func (cs *CoreService) processGenericRequest(data Dict, resolver handlerResolver) Response {
+	// Release what the call holds once done, which may be after
+	// returning if the handler keeps running past its timeout.
 	atomic.AddUint32(&cs.callsInProgress, 1)
-	defer func() {
+	release := func() {
 		atomic.AddUint32(&cs.callsInProgress, ^uint32(0))
+	}
+	isReleaseDeferred := false
+	defer func() {
+		if !isReleaseDeferred {
+			release()
+		}
 	}()
 
 	// Parse the request format.
@@ -182,14 +357,28 @@ func (cs *CoreService) processGenericRequest(data Dict, resolver handlerResolver
 		return NewErrorResponse(fmt.Errorf("unsupported version (> %d)", PROTOCOL_VERSION))
 	}
 
+	// Shed the load over the limits, but always
+	// report our health.
+	if cs.shedder != nil && req.Type != "health" {
+		if !cs.shedder.acquire(req.Type) {
+			cs.Warn(fmt.Sprintf("shedding '%s' request (%s)", req.Type, req.MsgID))
+			return newOverloadedResponse(req.Type)
+		}
+		releaseCall := release
+		release = func() {
+			cs.shedder.release(req.Type)
+			releaseCall()
+		}
+	}
+
 	if cs.desc.IsDebug {
-		cs.desc.Log(fmt.Sprintf("REQ (%s): %s => %+v", req.MsgID, req.Type, req.Data))
+		cs.desc.Log(fmt.Sprintf("REQ (%s): %s => %+v", req.MsgID, req.Type, resolver.redactArgs(req.Data)))
 	}
 
 	// Check if we're still within the deadline.
 	deadline := time.Time{}
 	if req.Deadline != 0 {
-		deadline := time.Unix(int64(math.Trunc(req.Deadline)), 0)
+		deadline = time.Unix(int64(math.Trunc(req.Deadline)), 0)
 		if time.Now().After(deadline) {
 			cs.LogError("deadline exceeded")
 			return NewErrorResponse(fmt.Errorf("deadline exceeded"))
@@ -207,6 +396,12 @@ func (cs *CoreService) processGenericRequest(data Dict, resolver handlerResolver
 		},
 	}
 	var err error
+	if cs.config != nil && req.OID != "" {
+		if serviceRequest.Config, err = cs.config.get(req.OID); err != nil {
+			cs.LogError(fmt.Sprintf("error loading config: %v", err))
+			return NewRetriableResponse(err)
+		}
+	}
 	parsedData, err := resolver.parse(serviceRequest.Event)
 	if err != nil {
 		cs.LogError(err.Error())
@@ -220,6 +415,26 @@ func (cs *CoreService) processGenericRequest(data Dict, resolver handlerResolver
 		return NewErrorResponse(fmt.Errorf("not implemented"))
 	}
 
+	// Only requests the service handles take from the limits.
+	if cs.rateLimiter != nil && req.OID != "" && req.Type != "health" {
+		if isAllowed, retryAfter := cs.rateLimiter.take(req.OID, req.Type, req.Data); !isAllowed {
+			return newRateLimitedResponse(req.Type, retryAfter)
+		}
+	}
+
+	if req.JWT != "" {
+		// Tokens the service cannot decode are left to the SDK, the
+		// handlers requiring permissions will reject the request.
+		if claims, err := ParseJWTClaims(req.JWT); err != nil {
+			cs.LogError(fmt.Sprintf("jwt claims not available: %v", err))
+		} else if err := checkJWTClaims(claims, req.OID); err != nil {
+			cs.LogError(err.Error())
+			return NewErrorResponse(err)
+		} else {
+			serviceRequest.Claims = &claims
+		}
+	}
+
 	// health request will not be providing a jwt - if you want an org provide an oid and a jwt
 	if req.OID != "" && req.JWT != "" {
 		// Create an SDK instance.
@@ -230,6 +445,17 @@ func (cs *CoreService) processGenericRequest(data Dict, resolver handlerResolver
 			cs.LogError(err.Error())
 			return NewErrorResponse(err)
 		}
+	} else if req.OID != "" && cs.orgClients != nil {
+		// Best effort, the handler may not need the SDK.
+		if org, err := cs.orgClients.get(req.OID); err != nil {
+			cs.LogError(fmt.Sprintf("no org client: %v", err))
+		} else {
+			serviceRequest.Org = requestOrg(org)
+		}
+	}
+
+	if cs.auditor != nil && req.OID != "" {
+		serviceRequest.auditRecorder = cs.auditor.newRecorder(serviceRequest)
 	}
 
 	if err := resolver.preHandlerHook(&serviceRequest); err != nil {
@@ -237,7 +463,15 @@ func (cs *CoreService) processGenericRequest(data Dict, resolver handlerResolver
 	}
 
 	// Send it.
-	resp := handler(serviceRequest)
+	var resp Response
+	if timeout := resolver.timeout(serviceRequest.Event); timeout != 0 {
+		resp, isReleaseDeferred = cs.timeouts.run(handler, serviceRequest, timeout, release)
+	} else {
+		resp = handler(serviceRequest)
+	}
+	if cs.redactor != nil {
+		resp = cs.redactor.redactResponse(resp)
+	}
 	if cs.desc.IsDebug {
 		cs.desc.Log(fmt.Sprintf("REQ (%s) result: err(%s)", req.MsgID, resp.Error))
 	}
@@ -252,7 +486,14 @@ func (cs *CoreService) processGenericRequest(data Dict, resolver handlerResolver
 }
 
 func (cs *CoreService) ProcessCommand(data Dict) Response {
-	return cs.processGenericRequest(data, &commandHandlerResolver{commandsDesc: &cs.desc.Commands, desc: &cs.desc})
+	resolver := &commandHandlerResolver{commandsDesc: &cs.desc.Commands, desc: &cs.desc}
+	if cs.auditor == nil {
+		return cs.processGenericRequest(data, resolver)
+	}
+	start := time.Now()
+	resp := cs.processGenericRequest(data, resolver)
+	cs.auditor.recordCommand(data, resolver, resp, start)
+	return resp
 }
 
 func (cs *CoreService) ProcessRequest(data Dict) Response {
@@ -288,22 +529,51 @@ func (cs *CoreService) cbHealth(r Request) Response {
 		commandsSupported[commandDescriptor.Name] = commandDescriptor
 	}
 
+	mtd := Dict{
+		"detect_subscriptions": cs.desc.DetectionsSubscribed,
+		"callbacks":            cbSupported,
+		"request_params":       cs.desc.RequestParameters,
+		"commands":             commandsSupported,
+		"build":                cs.buildInfo,
+		"features":             cs.getFeatures(),
+	}
+	for k, f := range cs.healthMtd {
+		mtd[k] = f()
+	}
+
 	return Response{
 		IsSuccess: true,
 		Data: Dict{
 			"version":           PROTOCOL_VERSION,
 			"start_time":        cs.startedAt,
-			"calls_in_progress": cs.callsInProgress,
-			"mtd": Dict{
-				"detect_subscriptions": cs.desc.DetectionsSubscribed,
-				"callbacks":            cbSupported,
-				"request_params":       cs.desc.RequestParameters,
-				"commands":             commandsSupported,
-			},
+			"calls_in_progress": atomic.LoadUint32(&cs.callsInProgress),
+			"mtd":               mtd,
 		},
 	}
 }
 
+// Register a function generating metadata reported
+// under the given key of the health metadata.
+func (cs *CoreService) addHealthMetadata(key string, f func() interface{}) {
+	cs.healthMtd[key] = f
+}
+
+// Wrap the callback with the given name, the interceptor
+// receives the original callback which may be nil.
+func (cs *CoreService) interceptCallback(cbName string, interceptor func(r Request, next ServiceCallback) Response) {
+	next := cs.cbMap[cbName]
+	cs.cbMap[cbName] = func(r Request) Response {
+		return interceptor(r, next)
+	}
+}
+
+func callNext(next ServiceCallback, r Request) Response {
+	if next == nil {
+		return MakeSuccessResponse()
+	}
+	return next(r)
+}
+
 func (cs *CoreService) buildCallbackMap() map[string]ServiceCallback {
 	cb := cs.desc.Callbacks
 	t := reflect.TypeOf(cb)
@@ -330,37 +600,37 @@ func (cs *CoreService) buildCallbackMap() map[string]ServiceCallback {
 }
 
 // LC.Logger Interface Compatibility
-func (cs CoreService) Fatal(msg string) {
+func (cs *CoreService) Fatal(msg string) {
 	if cs.desc.LogCritical == nil {
 		return
 	}
 	cs.desc.LogCritical(msg)
 }
-func (cs CoreService) Error(msg string) {
+func (cs *CoreService) Error(msg string) {
 	if cs.desc.LogCritical == nil {
 		return
 	}
 	cs.desc.LogCritical(msg)
 }
-func (cs CoreService) Warn(msg string) {
+func (cs *CoreService) Warn(msg string) {
 	if cs.desc.LogCritical == nil {
 		return
 	}
 	cs.desc.LogCritical(msg)
 }
-func (cs CoreService) Info(msg string) {
+func (cs *CoreService) Info(msg string) {
 	if cs.desc.Log == nil {
 		return
 	}
 	cs.desc.Log(msg)
 }
-func (cs CoreService) Debug(msg string) {
+func (cs *CoreService) Debug(msg string) {
 	if cs.desc.Log == nil {
 		return
 	}
 	cs.desc.Log(msg)
 }
-func (cs CoreService) Trace(msg string) {
+func (cs *CoreService) Trace(msg string) {
 	if cs.desc.Log == nil {
 		return
 	}
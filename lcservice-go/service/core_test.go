@@ -62,6 +62,8 @@ func TestHealth(t *testing.T) {
 				"detect_subscriptions": []string{"d1", "d2"},
 				"callbacks":            []string{"health", "org_uninstall"},
 				"commands":             Dict{},
+				"build":                s.BuildInfo(),
+				"features":             []string{},
 			},
 		},
 	}) {
@@ -180,7 +182,7 @@ func TestResourceSupply(t *testing.T) {
 	}
 
 	resp := r.SupplyResponse(s)
-	if fmt.Sprintf("%+v", resp) != `{IsSuccess:true IsRetriable:false Error: Data:map[resources:map[test1:map[hash:5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9 res_cat:lookup res_data:ZGF0YTE=] test2:map[hash:d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c res_cat:lookup res_data:ZGF0YTI=]]] Jobs:[]}` {
+	if fmt.Sprintf("%+v", resp) != `{IsSuccess:true IsRetriable:false Error: Data:map[resources:map[test1:map[hash:5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9 res_cat:lookup res_data:ZGF0YTE=] test2:map[hash:d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c res_cat:lookup res_data:ZGF0YTI=]]] Jobs:[] IsOverloaded:false IsRateLimited:false RetryAfter:0s}` {
 		t.Errorf("unexpected supply: %+v", resp)
 	}
 
@@ -201,7 +203,7 @@ func TestResourceSupply(t *testing.T) {
 	}
 
 	resp = r.SupplyResponse(s)
-	if fmt.Sprintf("%+v", resp) != `{IsSuccess:true IsRetriable:false Error: Data:map[hash:5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9 res_cat:lookup res_data:ZGF0YTE=] Jobs:[]}` {
+	if fmt.Sprintf("%+v", resp) != `{IsSuccess:true IsRetriable:false Error: Data:map[hash:5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9 res_cat:lookup res_data:ZGF0YTE=] Jobs:[] IsOverloaded:false IsRateLimited:false RetryAfter:0s}` {
 		t.Errorf("unexpected supply: %+v", resp)
 	}
 }
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Name of the secret holding the API key of an org.
+	orgAPIKeySecretName = "lc_api_key"
+
+	// Default lifetime of the org clients before they
+	// are re-created with fresh credentials.
+	DefaultCredentialsRefreshInterval = 30 * time.Minute
+)
+
+// Credentials of the service used to create org clients when
+// a request has no JWT, like the once_per_* callbacks, or in
+// background tasks. See CoreService.OrgClient().
+type ServiceCredentials struct {
+	// API key valid for all the orgs, and the UID
+	// it belongs to if it is a user API key.
+	APIKey string
+	UID    string
+
+	// Field of the org_install data holding an API key of the
+	// org to use instead of the APIKey. The API keys are kept
+	// in the Secrets, which requires the SecretsMasterKey.
+	InstallAPIKeyField string
+
+	// Lifetime of the org clients, DefaultCredentialsRefreshInterval if 0.
+	RefreshInterval time.Duration
+}
+
+func (c ServiceCredentials) isValid(d Descriptor) error {
+	if c.APIKey == "" && c.InstallAPIKeyField == "" {
+		return fmt.Errorf("no api key or install api key field")
+	}
+	if c.InstallAPIKeyField != "" && d.SecretsMasterKey == "" {
+		return fmt.Errorf("per-org api keys require a SecretsMasterKey")
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("refresh interval must not be negative")
+	}
+	return nil
+}
+
+type cachedOrgClient struct {
+	org       *lc.Organization
+	createdAt time.Time
+}
+
+// A client being created, shared by the callers
+// asking for the same org in the meantime.
+type pendingOrgClient struct {
+	wg  sync.WaitGroup
+	org *lc.Organization
+	err error
+}
+
+type orgClientFactory struct {
+	cs              *CoreService
+	creds           ServiceCredentials
+	refreshInterval time.Duration
+	now             func() time.Time
+	newOrg          func(opts lc.ClientOptions) (*lc.Organization, error)
+
+	sync.Mutex
+	clients map[string]cachedOrgClient
+	pending map[string]*pendingOrgClient
+}
+
+func newOrgClientFactory(cs *CoreService) *orgClientFactory {
+	f := &orgClientFactory{
+		cs:              cs,
+		creds:           *cs.desc.Credentials,
+		refreshInterval: cs.desc.Credentials.RefreshInterval,
+		now:             time.Now,
+		clients:         map[string]cachedOrgClient{},
+		pending:         map[string]*pendingOrgClient{},
+	}
+	if f.refreshInterval == 0 {
+		f.refreshInterval = DefaultCredentialsRefreshInterval
+	}
+	f.newOrg = func(opts lc.ClientOptions) (*lc.Organization, error) {
+		return lc.NewOrganizationFromClientOptions(opts, cs)
+	}
+	return f
+}
+
+func (f *orgClientFactory) install() {
+	if f.creds.InstallAPIKeyField != "" {
+		f.cs.interceptCallback("org_install", f.onOrgInstall)
+	}
+	f.cs.interceptCallback("org_uninstall", f.onOrgUninstall)
+}
+
+// Get the credentials to use for an org.
+func (f *orgClientFactory) clientOptions(oid string) (lc.ClientOptions, error) {
+	opts := lc.ClientOptions{OID: oid}
+	if f.creds.InstallAPIKeyField != "" {
+		key, isFound, err := f.cs.secrets.Get(oid, orgAPIKeySecretName)
+		if err != nil {
+			return opts, err
+		}
+		if isFound {
+			opts.APIKey = key
+			return opts, nil
+		}
+	}
+	if f.creds.APIKey == "" {
+		return opts, fmt.Errorf("no credentials for org %s", oid)
+	}
+	opts.APIKey = f.creds.APIKey
+	opts.UID = f.creds.UID
+	return opts, nil
+}
+
+func (f *orgClientFactory) get(oid string) (*lc.Organization, error) {
+	if oid == "" {
+		return nil, fmt.Errorf("missing oid")
+	}
+	now := f.now()
+	f.Lock()
+	if c, ok := f.clients[oid]; ok && now.Sub(c.createdAt) < f.refreshInterval {
+		f.Unlock()
+		return c.org, nil
+	}
+	// Only create one client per org at a time, without
+	// holding the lock while the SDK gets its credentials.
+	if p, ok := f.pending[oid]; ok {
+		f.Unlock()
+		p.wg.Wait()
+		return p.org, p.err
+	}
+	p := &pendingOrgClient{}
+	p.wg.Add(1)
+	f.pending[oid] = p
+	f.Unlock()
+
+	p.org, p.err = f.create(oid)
+
+	f.Lock()
+	// Not cached if invalidated in the meantime.
+	if f.pending[oid] == p {
+		delete(f.pending, oid)
+		if p.err == nil {
+			f.clients[oid] = cachedOrgClient{
+				org:       p.org,
+				createdAt: now,
+			}
+		}
+	}
+	f.Unlock()
+	p.wg.Done()
+	return p.org, p.err
+}
+
+func (f *orgClientFactory) create(oid string) (*lc.Organization, error) {
+	opts, err := f.clientOptions(oid)
+	if err != nil {
+		return nil, err
+	}
+	return f.newOrg(opts)
+}
+
+// Forget the client of an org, the next one
+// is created with fresh credentials.
+func (f *orgClientFactory) invalidate(oid string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.clients, oid)
+	delete(f.pending, oid)
+}
+
+func (f *orgClientFactory) onOrgInstall(r Request, next ServiceCallback) Response {
+	if key, ok := r.Event.Data[f.creds.InstallAPIKeyField].(string); ok && key != "" {
+		if _, err := f.cs.secrets.Set(r.OID, orgAPIKeySecretName, key); err != nil {
+			return NewRetriableResponse(fmt.Errorf("failed storing api key: %v", err))
+		}
+		f.invalidate(r.OID)
+	}
+	return callNext(next, r)
+}
+
+func (f *orgClientFactory) onOrgUninstall(r Request, next ServiceCallback) Response {
+	// The API key is deleted with the other secrets of the org.
+	resp := callNext(next, r)
+	f.invalidate(r.OID)
+	return resp
+}
+
+// Copy of a shared client for a Request, so that handlers
+// setting an investigation ID do not affect other requests.
+func requestOrg(org *lc.Organization) *lc.Organization {
+	o := *org
+	return &o
+}
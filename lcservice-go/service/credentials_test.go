@@ -0,0 +1,141 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceCredentials(t *testing.T) {
+	a := assert.New(t)
+	oid1 := "11111111-1111-1111-1111-111111111111"
+	oid2 := "22222222-2222-2222-2222-222222222222"
+	serviceKey := "33333333-3333-3333-3333-333333333333"
+	orgKey := "44444444-4444-4444-4444-444444444444"
+
+	_, err := NewService(Descriptor{
+		SecretKey:   testSecretKey,
+		Credentials: &ServiceCredentials{InstallAPIKeyField: "api_key"},
+	})
+	a.Error(err)
+	_, err = NewService(Descriptor{
+		SecretKey:   testSecretKey,
+		Credentials: &ServiceCredentials{},
+	})
+	a.Error(err)
+
+	s, err := NewService(Descriptor{SecretKey: testSecretKey})
+	a.NoError(err)
+	_, err = s.OrgClient(oid1)
+	a.Error(err)
+
+	var orgInCallback *lc.Organization
+	s, err = NewService(Descriptor{
+		SecretKey:        testSecretKey,
+		SecretsMasterKey: "master",
+		Credentials: &ServiceCredentials{
+			APIKey:             serviceKey,
+			InstallAPIKeyField: "api_key",
+			RefreshInterval:    time.Hour,
+		},
+		Callbacks: DescriptorCallbacks{
+			OnOrgPer1H: func(r Request) Response {
+				orgInCallback = r.Org
+				return MakeSuccessResponse()
+			},
+		},
+	})
+	a.NoError(err)
+	now := time.Now()
+	s.orgClients.now = func() time.Time { return now }
+	created := []lc.ClientOptions{}
+	newOrg := s.orgClients.newOrg
+	s.orgClients.newOrg = func(opts lc.ClientOptions) (*lc.Organization, error) {
+		created = append(created, opts)
+		return newOrg(opts)
+	}
+
+	// The API key of the org is kept as a secret.
+	resp := s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: oid1, Type: "org_install", Data: Dict{"api_key": orgKey}}))
+	a.True(resp.IsSuccess)
+	key, isFound, err := s.Secrets().Get(oid1, orgAPIKeySecretName)
+	a.NoError(err)
+	a.True(isFound)
+	a.Equal(orgKey, key)
+
+	org, err := s.OrgClient(oid1)
+	a.NoError(err)
+	a.Equal(oid1, org.GetOID())
+	cached, err := s.OrgClient(oid1)
+	a.NoError(err)
+	a.True(org == cached)
+
+	// Orgs without their own key use the service's.
+	_, err = s.OrgClient(oid2)
+	a.NoError(err)
+	a.Equal([]lc.ClientOptions{
+		// Made for the org_install, before the key was known.
+		{OID: oid1, APIKey: serviceKey},
+		{OID: oid1, APIKey: orgKey},
+		{OID: oid2, APIKey: serviceKey},
+	}, created)
+
+	// Requests without a JWT get a client.
+	a.True(s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: oid1, Type: "org_per_1h", Data: Dict{}})).IsSuccess)
+	a.Equal(*org, *orgInCallback)
+
+	// Clients are re-created once expired.
+	now = now.Add(time.Hour)
+	refreshed, err := s.OrgClient(oid1)
+	a.NoError(err)
+	a.False(refreshed == org)
+	a.Len(created, 4)
+
+	// Uninstalling forgets the client and the key.
+	a.True(s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: oid1, Type: "org_uninstall", Data: Dict{}})).IsSuccess)
+	_, isFound, err = s.Secrets().Get(oid1, orgAPIKeySecretName)
+	a.NoError(err)
+	a.False(isFound)
+	_, err = s.OrgClient(oid1)
+	a.NoError(err)
+	a.Equal(lc.ClientOptions{OID: oid1, APIKey: serviceKey}, created[len(created)-1])
+}
+
+func TestServiceCredentialsConcurrency(t *testing.T) {
+	a := assert.New(t)
+	oid := "11111111-1111-1111-1111-111111111111"
+	s, err := NewService(Descriptor{
+		SecretKey:   testSecretKey,
+		Credentials: &ServiceCredentials{APIKey: "33333333-3333-3333-3333-333333333333"},
+	})
+	a.NoError(err)
+	nCreated := int32(0)
+	newOrg := s.orgClients.newOrg
+	s.orgClients.newOrg = func(opts lc.ClientOptions) (*lc.Organization, error) {
+		atomic.AddInt32(&nCreated, 1)
+		time.Sleep(10 * time.Millisecond)
+		return newOrg(opts)
+	}
+
+	// Concurrent callers share the client being created.
+	orgs := make([]*lc.Organization, 10)
+	wg := sync.WaitGroup{}
+	for i := range orgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			org, err := s.OrgClient(oid)
+			a.NoError(err)
+			orgs[i] = org
+		}(i)
+	}
+	wg.Wait()
+	a.Equal(int32(1), atomic.LoadInt32(&nCreated))
+	for _, org := range orgs {
+		a.True(org == orgs[0])
+	}
+}
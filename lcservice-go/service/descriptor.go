@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"time"
@@ -16,6 +17,34 @@ type Request struct {
 	OID      string
 	Deadline time.Time
 	Event    RequestEvent
+
+	// Configuration of the org, when the
+	// Descriptor declares a ConfigSchema.
+	Config Config
+
+	// Claims of the JWT of the request,
+	// nil if it came without a JWT.
+	Claims *JWTClaims
+
+	// Cancelled when the handler times out.
+	ctx context.Context
+
+	// Records the changes made through AuditedOrg,
+	// nil unless the Descriptor has an Audit.
+	auditRecorder *auditRecorder
+}
+
+// Get a context expiring at the deadline of the Request, if any,
+// and cancelled if the handler exceeds its timeout.
+func (r Request) Context() (context.Context, context.CancelFunc) {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if r.Deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, r.Deadline)
 }
 
 func (r Request) Get(key string) (interface{}, error) {
@@ -138,6 +167,15 @@ type Response struct {
 	Error       string `json:"error,omitempty" msgpack:"error,omitempty"`
 	Data        Dict   `json:"data" msgpack:"data"`
 	Jobs        []*Job `json:"jobs,omitempty" msgpack:"jobs,omitempty"`
+
+	// Set when the request was shed because the
+	// service is over its ConcurrencyLimits.
+	IsOverloaded bool `json:"-" msgpack:"-"`
+
+	// Set when the request was over the RateLimits
+	// of its org, with how long to wait to retry.
+	IsRateLimited bool          `json:"-" msgpack:"-"`
+	RetryAfter    time.Duration `json:"-" msgpack:"-"`
 }
 
 func MakeErrorResponse(err error) Response {
@@ -190,6 +228,15 @@ type RequestParamDef struct {
 
 	// Optional index for parameter ordering
 	Index int `json:"index" msgpack:"index"`
+
+	// The value is sensitive and is redacted from logs. In
+	// the ConfigSchema, it is also encrypted at rest and
+	// redacted from the configuration returned.
+	IsSecret bool `json:"is_secret,omitempty" msgpack:"is_secret,omitempty"`
+
+	// Optional default value, only used by the ConfigSchema,
+	// where secret values cannot have one.
+	Default interface{} `json:"default,omitempty" msgpack:"default,omitempty"`
 }
 type RequestParams map[RequestParamName]RequestParamDef
 
@@ -258,15 +305,81 @@ type Descriptor struct {
 	// Detections to subscribe to
 	DetectionsSubscribed []string
 
+	// Optional router of the detections to handlers per
+	// detection name, wrapping the OnDetection callback.
+	DetectionRouter   *DetectionRouter
+	isDetectionRouted bool
+
+	// Limits of the calls processed at the same time.
+	Concurrency ConcurrencyLimits
+
+	// Per-org rate limits of the requests.
+	RateLimits RateLimits
+
+	// Maximum runtime of the callbacks by name, like "sensor_per_1h".
+	// Commands have theirs in their CommandDescriptor.
+	CallbackTimeouts map[string]time.Duration
+
+	// Optional suppression of repeated detections.
+	DetectionSuppression *DetectionSuppression
+	suppressor           *detectionSuppressor
+
+	// Optional router of the deployment and log events to
+	// handlers per event type.
+	EventRouter   *EventRouter
+	isEventRouted bool
+
 	// General purpose
 	Log         func(msg string)
 	LogCritical func(msg string)
 
+	// Store used by the framework to keep state across
+	// requests, defaults to an in-memory store.
+	StateStore KVStore
+
+	// Org configuration managed by the framework.
+	ManagedConfig *ManagedConfig
+
+	// Schema of the per-org configuration of the service. When set,
+	// get_config, set_config and validate_config commands are added
+	// and the configuration of the org is available in every Request.
+	ConfigSchema RequestParams
+
+	// Master key encrypting the per-org secrets, separate from the
+	// SecretKey. When set, set_secret, rotate_secret and delete_secret
+	// commands are added, see CoreService.Secrets().
+	SecretsMasterKey string
+	// Master keys previously used, still accepted for decryption.
+	PreviousSecretsMasterKeys []string
+	// Store of the encrypted secrets, defaults to the StateStore.
+	SecretsStore KVStore
+
+	// Keep a registry of the orgs which installed the
+	// service in the StateStore, see CoreService.Orgs().
+	// Orgs which installed the service before are only
+	// registered if the service has an org_per_* callback.
+	IsTrackInstalledOrgs bool
+
+	// Optional audit trail of the commands and org changes.
+	Audit *AuditConfig
+
+	// Optional credentials to access the orgs outside of the
+	// requests of the org, see CoreService.OrgClient().
+	Credentials *ServiceCredentials
+
 	// Callbacks
 	Callbacks DescriptorCallbacks
 
 	// Commands
 	Commands CommandsDescriptor
+
+	// Optional built-in commands like help and ping.
+	BuiltinCommands BuiltinCommands
+
+	// Permissions required by the commands added by the framework,
+	// like set_secret, overriding DefaultCommandPermissions. An
+	// empty list removes the requirement.
+	CommandPermissions map[CommandName][]string
 }
 
 // Optional callbacks available.
@@ -310,6 +423,35 @@ type DescriptorCallbacks struct {
 }
 
 func (d Descriptor) IsValid() error {
+	if err := d.Concurrency.isValid(); err != nil {
+		return fmt.Errorf("invalid concurrency limits: %v", err)
+	}
+	if err := d.RateLimits.isValid(); err != nil {
+		return fmt.Errorf("invalid rate limits: %v", err)
+	}
+	for cbName, timeout := range d.CallbackTimeouts {
+		if timeout < 0 {
+			return fmt.Errorf("invalid timeout of '%s'", cbName)
+		}
+	}
+	if d.DetectionSuppression != nil {
+		if err := d.DetectionSuppression.isValid(); err != nil {
+			return fmt.Errorf("invalid detection suppression: %v", err)
+		}
+	}
+	if d.Audit != nil {
+		if err := d.Audit.isValid(); err != nil {
+			return fmt.Errorf("invalid audit: %v", err)
+		}
+	}
+	if d.Credentials != nil {
+		if err := d.Credentials.isValid(d); err != nil {
+			return fmt.Errorf("invalid credentials: %v", err)
+		}
+	}
+	if err := configSchemaIsValid(d.ConfigSchema, d.SecretsMasterKey != ""); err != nil {
+		return fmt.Errorf("invalid config schema: %v", err)
+	}
 	return d.Commands.isValid()
 }
 
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A Detection as received by the OnDetection callback.
+// Use the `RequestEvent.AsDetection()` to generate
+// this structure from a Request.
+type Detection struct {
+	// Name of the detection, as reported by the D&R rule.
+	Name       string       `json:"cat" msgpack:"cat"`
+	DetectID   string       `json:"detect_id,omitempty" msgpack:"detect_id,omitempty"`
+	Source     string       `json:"source,omitempty" msgpack:"source,omitempty"`
+	SourceRule string       `json:"source_rule,omitempty" msgpack:"source_rule,omitempty"`
+	Namespace  string       `json:"namespace,omitempty" msgpack:"namespace,omitempty"`
+	Author     string       `json:"author,omitempty" msgpack:"author,omitempty"`
+	Priority   int          `json:"priority,omitempty" msgpack:"priority,omitempty"`
+	Link       string       `json:"link,omitempty" msgpack:"link,omitempty"`
+	Detect     Dict         `json:"detect,omitempty" msgpack:"detect,omitempty"`
+	DetectData Dict         `json:"detect_data,omitempty" msgpack:"detect_data,omitempty"`
+	DetectMtd  Dict         `json:"detect_mtd,omitempty" msgpack:"detect_mtd,omitempty"`
+	Routing    EventRouting `json:"routing" msgpack:"routing"`
+}
+
+func (re RequestEvent) AsDetection() (Detection, error) {
+	d := Detection{}
+	if err := DictToStruct(re.Data, &d); err != nil {
+		return d, fmt.Errorf("invalid detection: %v", err)
+	}
+	return d, nil
+}
+
+type DetectionHandler = func(r Request, d Detection) Response
+
+// Dispatches the detections received to handlers registered per
+// detection name. The names handled are automatically added to
+// the Descriptor's DetectionsSubscribed.
+type DetectionRouter struct {
+	handlers map[string]DetectionHandler
+	fallback DetectionHandler
+}
+
+func NewDetectionRouter() *DetectionRouter {
+	return &DetectionRouter{
+		handlers: map[string]DetectionHandler{},
+	}
+}
+
+// Register the handler of a detection name.
+func (dr *DetectionRouter) Handle(name string, handler DetectionHandler) *DetectionRouter {
+	dr.handlers[name] = handler
+	return dr
+}
+
+// Register the handler of the detections not matching any
+// other handler. If not set, those are given to the
+// Descriptor's OnDetection callback if any.
+func (dr *DetectionRouter) Fallback(handler DetectionHandler) *DetectionRouter {
+	dr.fallback = handler
+	return dr
+}
+
+// Names of the detections handled, sorted.
+func (dr *DetectionRouter) Names() []string {
+	names := []string{}
+	for name := range dr.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (dr *DetectionRouter) callback(next ServiceCallback) ServiceCallback {
+	return func(r Request) Response {
+		d, err := r.Event.AsDetection()
+		if err != nil {
+			return NewErrorResponse(err)
+		}
+		if handler, ok := dr.handlers[d.Name]; ok {
+			return handler(r, d)
+		}
+		if dr.fallback != nil {
+			return dr.fallback(r, d)
+		}
+		if next == nil {
+			return MakeSuccessResponse()
+		}
+		return next(r)
+	}
+}
+
+// Route the detections through the Descriptor's DetectionRouter,
+// only done once even if called again on a copy.
+func (d *Descriptor) applyDetectionRouter() {
+	if d.DetectionRouter == nil || d.isDetectionRouted {
+		return
+	}
+	d.isDetectionRouted = true
+	d.Callbacks.OnDetection = d.DetectionRouter.callback(d.Callbacks.OnDetection)
+	subscribed := map[string]struct{}{}
+	for _, name := range d.DetectionsSubscribed {
+		subscribed[name] = struct{}{}
+	}
+	for _, name := range d.DetectionRouter.Names() {
+		if _, ok := subscribed[name]; !ok {
+			d.DetectionsSubscribed = append(d.DetectionsSubscribed, name)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeDetectionRequest(name string, sid string) Dict {
+	return makeRequest(lcRequest{
+		Version: 1,
+		OID:     "o1",
+		Type:    "detection",
+		Data: Dict{
+			"cat":       name,
+			"detect_id": "d-123",
+			"detect":    Dict{"event": Dict{"FILE_PATH": "c:\\evil.exe"}},
+			"routing": Dict{
+				"sid":        sid,
+				"hostname":   "host1",
+				"event_type": "NEW_PROCESS",
+				"event_time": 1600000000000,
+				"tags":       []string{"t1"},
+			},
+		},
+	})
+}
+
+func TestDetectionRouter(t *testing.T) {
+	a := assert.New(t)
+
+	seen := map[string][]Detection{}
+	record := func(key string) DetectionHandler {
+		return func(r Request, d Detection) Response {
+			seen[key] = append(seen[key], d)
+			return MakeSuccessResponse()
+		}
+	}
+	isRawCalled := false
+	router := NewDetectionRouter().
+		Handle("evil-exe", record("evil")).
+		Handle("d1", record("d1"))
+	s, err := NewService(Descriptor{
+		SecretKey:            testSecretKey,
+		DetectionsSubscribed: []string{"d1", "other"},
+		DetectionRouter:      router,
+		Callbacks: DescriptorCallbacks{
+			OnDetection: func(r Request) Response {
+				isRawCalled = true
+				return MakeSuccessResponse()
+			},
+		},
+	})
+	a.NoError(err)
+
+	// Handled names are subscribed to once.
+	resp := s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	a.Equal([]string{"d1", "other", "evil-exe"}, resp.Data["mtd"].(Dict)["detect_subscriptions"])
+
+	resp = s.ProcessRequest(makeDetectionRequest("evil-exe", "s1"))
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(seen["evil"]))
+	d := seen["evil"][0]
+	a.Equal("evil-exe", d.Name)
+	a.Equal("d-123", d.DetectID)
+	a.Equal("s1", d.Routing.SID)
+	a.Equal("host1", d.Routing.Hostname)
+	a.Equal("NEW_PROCESS", d.Routing.EventType)
+	a.Equal(int64(1600000000000), d.Routing.EventTime)
+	a.Equal([]string{"t1"}, d.Routing.Tags)
+	a.Equal(Dict{"FILE_PATH": "c:\\evil.exe"}, d.Detect["event"])
+	a.False(isRawCalled)
+
+	// Unmatched names go to the OnDetection callback,
+	// or to the fallback handler if set.
+	resp = s.ProcessRequest(makeDetectionRequest("other", "s2"))
+	a.True(resp.IsSuccess)
+	a.True(isRawCalled)
+	a.Empty(seen["fallback"])
+
+	router.Fallback(record("fallback"))
+	resp = s.ProcessRequest(makeDetectionRequest("another", "s2"))
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(seen["fallback"]))
+	a.Equal("another", seen["fallback"][0].Name)
+}
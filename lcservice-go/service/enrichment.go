@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Time given to a pipeline when the Request has no deadline.
+	DefaultEnrichmentBudget = 30 * time.Second
+)
+
+// An enricher adding fields to a Detection under its Namespace.
+type Enricher struct {
+	// Namespace the fields returned are added under.
+	Namespace string
+	// Maximum time given to the enricher, within what remains
+	// of the pipeline's budget. 0 means all the remaining budget.
+	Timeout time.Duration
+	// Get the fields to add. The EnrichedDetection includes the
+	// fields added by the enrichers before this one.
+	Enrich func(ctx context.Context, r Request, e EnrichedDetection) (Dict, error)
+}
+
+// A Detection with the fields added by the enrichers.
+type EnrichedDetection struct {
+	Detection   Detection         `json:"detection"`
+	Enrichments map[string]Dict   `json:"enrichments"`
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+func (e EnrichedDetection) copy() EnrichedDetection {
+	c := EnrichedDetection{
+		Detection:   e.Detection,
+		Enrichments: map[string]Dict{},
+		Errors:      map[string]string{},
+	}
+	for k, v := range e.Enrichments {
+		c.Enrichments[k] = v
+	}
+	for k, v := range e.Errors {
+		c.Errors[k] = v
+	}
+	return c
+}
+
+// Pipeline running the Enrichers in order on the detections
+// received and reporting the enriched detections back.
+// Use `EnrichmentPipeline.Handler()` with a DetectionRouter
+// or `EnrichmentPipeline.Callback()` as the OnDetection callback.
+type EnrichmentPipeline struct {
+	Enrichers []Enricher
+	// Total time given to the enrichers, bounded by the
+	// deadline of the Request. Defaults to DefaultEnrichmentBudget
+	// when the Request has no deadline.
+	Budget time.Duration
+
+	// Report the enriched detection in a Job.
+	IsReportJob bool
+	// Send the enriched detection back to the org through
+	// the webhook adapter with this name and secret.
+	WebhookName   string
+	WebhookSecret string
+
+	// Optional callback receiving the enriched detection
+	// once reported.
+	OnEnriched func(r Request, e EnrichedDetection) Response
+
+	sendWebhook func(org *lc.Organization, name string, secret string, data interface{}) error
+}
+
+func (p *EnrichmentPipeline) IsValid() error {
+	namespaces := map[string]struct{}{}
+	for i, e := range p.Enrichers {
+		if e.Namespace == "" {
+			return fmt.Errorf("enricher %d has no namespace", i)
+		}
+		if e.Enrich == nil {
+			return fmt.Errorf("enricher '%s' has no function", e.Namespace)
+		}
+		if _, ok := namespaces[e.Namespace]; ok {
+			return fmt.Errorf("namespace '%s' used by multiple enrichers", e.Namespace)
+		}
+		namespaces[e.Namespace] = struct{}{}
+	}
+	if p.WebhookName != "" && p.WebhookSecret == "" {
+		return fmt.Errorf("webhook '%s' has no secret", p.WebhookName)
+	}
+	return nil
+}
+
+// Get the pipeline as a handler for a DetectionRouter.
+func (p *EnrichmentPipeline) Handler() DetectionHandler {
+	return p.handle
+}
+
+// Get the pipeline as the OnDetection callback.
+func (p *EnrichmentPipeline) Callback() ServiceCallback {
+	return func(r Request) Response {
+		d, err := r.Event.AsDetection()
+		if err != nil {
+			return NewErrorResponse(err)
+		}
+		return p.handle(r, d)
+	}
+}
+
+// Run the enrichers on a Detection.
+func (p *EnrichmentPipeline) Enrich(r Request, d Detection) EnrichedDetection {
+	ctx, cancel := r.Context()
+	defer cancel()
+	budget := p.Budget
+	if budget == 0 && r.Deadline.IsZero() {
+		budget = DefaultEnrichmentBudget
+	}
+	if budget != 0 {
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+
+	e := EnrichedDetection{
+		Detection:   d,
+		Enrichments: map[string]Dict{},
+		Errors:      map[string]string{},
+	}
+	for _, enricher := range p.Enrichers {
+		fields, err := p.runEnricher(ctx, r, enricher, e.copy())
+		if err != nil {
+			e.Errors[enricher.Namespace] = err.Error()
+			continue
+		}
+		if fields != nil {
+			e.Enrichments[enricher.Namespace] = fields
+		}
+	}
+	return e
+}
+
+type enricherResult struct {
+	fields Dict
+	err    error
+}
+
+func (p *EnrichmentPipeline) runEnricher(ctx context.Context, r Request, enricher Enricher, e EnrichedDetection) (Dict, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("not run: %v", err)
+	}
+	if enricher.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, enricher.Timeout)
+		defer cancel()
+	}
+	// Buffered so a late enricher does not block forever.
+	results := make(chan enricherResult, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				results <- enricherResult{err: fmt.Errorf("panic: %v", rec)}
+			}
+		}()
+		fields, err := enricher.Enrich(ctx, r, e)
+		results <- enricherResult{fields: fields, err: err}
+	}()
+	select {
+	case res := <-results:
+		return res.fields, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *EnrichmentPipeline) handle(r Request, d Detection) Response {
+	e := p.Enrich(r, d)
+
+	if p.WebhookName != "" {
+		if r.Org == nil {
+			return NewErrorResponse(fmt.Errorf("no org to report the enriched detection to"))
+		}
+		send := p.sendWebhook
+		if send == nil {
+			send = sendWebhook
+		}
+		if err := send(r.Org, p.WebhookName, p.WebhookSecret, e); err != nil {
+			return NewRetriableResponse(fmt.Errorf("failed reporting enriched detection: %v", err))
+		}
+	}
+
+	resp := MakeSuccessResponse()
+	if p.OnEnriched != nil {
+		resp = p.OnEnriched(r, e)
+	}
+	if p.IsReportJob {
+		resp.Jobs = append(resp.Jobs, p.makeJob(e))
+	}
+	return resp
+}
+
+func (p *EnrichmentPipeline) makeJob(e EnrichedDetection) *Job {
+	j := NewJob()
+	j.SetCause(fmt.Sprintf("enrichment of %s", e.Detection.Name))
+	if e.Detection.Routing.SID != "" {
+		j.AddSensor(e.Detection.Routing.SID)
+	}
+	j.Narrate(fmt.Sprintf("detection %s enriched by %d of %d enrichers", e.Detection.Name, len(e.Enrichments), len(p.Enrichers)), false, NewJSONAttachment("enrichments", e.Enrichments))
+	failed := []string{}
+	for ns := range e.Errors {
+		failed = append(failed, ns)
+	}
+	sort.Strings(failed)
+	for _, ns := range failed {
+		j.Narrate(fmt.Sprintf("enricher %s failed: %s", ns, e.Errors[ns]), true)
+	}
+	j.Close()
+	return j
+}
+
+func sendWebhook(org *lc.Organization, name string, secret string, data interface{}) error {
+	sender, err := org.NewWebhookSender(name, secret)
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	return sender.Send(data)
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnrichmentPipeline(t *testing.T) {
+	a := assert.New(t)
+
+	sent := []interface{}{}
+	p := &EnrichmentPipeline{
+		Enrichers: []Enricher{
+			{
+				Namespace: "hash",
+				Enrich: func(ctx context.Context, r Request, e EnrichedDetection) (Dict, error) {
+					return Dict{"path": e.Detection.Detect["event"].(Dict)["FILE_PATH"], "reputation": "bad"}, nil
+				},
+			},
+			{
+				Namespace: "failing",
+				Enrich: func(ctx context.Context, r Request, e EnrichedDetection) (Dict, error) {
+					return nil, fmt.Errorf("lookup failed")
+				},
+			},
+			{
+				Namespace: "panicking",
+				Enrich: func(ctx context.Context, r Request, e EnrichedDetection) (Dict, error) {
+					panic("oops")
+				},
+			},
+			{
+				Namespace: "slow",
+				Timeout:   10 * time.Millisecond,
+				Enrich: func(ctx context.Context, r Request, e EnrichedDetection) (Dict, error) {
+					time.Sleep(time.Second)
+					return Dict{"late": true}, nil
+				},
+			},
+			{
+				Namespace: "summary",
+				Enrich: func(ctx context.Context, r Request, e EnrichedDetection) (Dict, error) {
+					// Later enrichers see the previous results.
+					return Dict{"reputation": e.Enrichments["hash"]["reputation"]}, nil
+				},
+			},
+		},
+		IsReportJob:   true,
+		WebhookName:   "enriched",
+		WebhookSecret: "s3cr3t",
+		sendWebhook: func(org *lc.Organization, name string, secret string, data interface{}) error {
+			sent = append(sent, data)
+			return nil
+		},
+	}
+	a.NoError(p.IsValid())
+
+	isEnrichedCalled := false
+	p.OnEnriched = func(r Request, e EnrichedDetection) Response {
+		isEnrichedCalled = true
+		return MakeSuccessResponse()
+	}
+
+	s, err := NewService(Descriptor{
+		SecretKey:       testSecretKey,
+		DetectionRouter: NewDetectionRouter().Handle("evil-exe", p.Handler()),
+	})
+	a.NoError(err)
+
+	// Reporting back requires an org.
+	start := time.Now()
+	resp := s.ProcessRequest(makeDetectionRequest("evil-exe", "s1"))
+	a.False(resp.IsSuccess)
+	a.True(time.Since(start) < time.Second)
+	a.False(isEnrichedCalled)
+
+	d, err := sampleEvent(t, `{"cat": "evil-exe", "detect": {"event": {"FILE_PATH": "c:\\evil.exe"}}, "routing": {"sid": "s1"}}`).AsDetection()
+	a.NoError(err)
+	resp = p.Handler()(Request{Org: &lc.Organization{}}, d)
+	a.True(resp.IsSuccess)
+	a.True(isEnrichedCalled)
+	a.Equal(1, len(sent))
+	e := sent[0].(EnrichedDetection)
+	a.Equal(Dict{"path": "c:\\evil.exe", "reputation": "bad"}, e.Enrichments["hash"])
+	a.Equal(Dict{"reputation": "bad"}, e.Enrichments["summary"])
+	a.Equal("lookup failed", e.Errors["failing"])
+	a.Equal("panic: oops", e.Errors["panicking"])
+	a.Equal(context.DeadlineExceeded.Error(), e.Errors["slow"])
+	a.Equal(2, len(e.Enrichments))
+
+	a.Equal(1, len(resp.Jobs))
+	a.Equal([]string{"s1"}, resp.Jobs[0].sensors)
+	a.Equal(4, len(resp.Jobs[0].entries))
+
+	// Enrichers are not run past the deadline of the request.
+	e = p.Enrich(Request{Deadline: time.Now().Add(-time.Second)}, d)
+	a.Empty(e.Enrichments)
+	a.Equal(5, len(e.Errors))
+
+	p.Enrichers = append(p.Enrichers, Enricher{Namespace: "hash", Enrich: p.Enrichers[0].Enrich})
+	a.Error(p.IsValid())
+}
+
+func TestRequestDeadline(t *testing.T) {
+	a := assert.New(t)
+	var deadline time.Time
+	s, err := NewService(Descriptor{
+		SecretKey: testSecretKey,
+		Callbacks: DescriptorCallbacks{
+			OnDetection: func(r Request) Response {
+				deadline = r.Deadline
+				return MakeSuccessResponse()
+			},
+		},
+	})
+	a.NoError(err)
+
+	expected := time.Now().Add(time.Minute).Truncate(time.Second)
+	resp := s.ProcessRequest(makeRequest(lcRequest{
+		Version:  1,
+		OID:      "o1",
+		Type:     "detection",
+		Deadline: float64(expected.Unix()),
+		Data:     Dict{"cat": "d1"},
+	}))
+	a.True(resp.IsSuccess)
+	a.True(expected.Equal(deadline))
+
+	ctx, cancel := Request{Deadline: deadline}.Context()
+	defer cancel()
+	ctxDeadline, isSet := ctx.Deadline()
+	a.True(isSet)
+	a.True(expected.Equal(ctxDeadline))
+}
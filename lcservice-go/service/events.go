@@ -0,0 +1,180 @@
+package service
+
+import (
+	"fmt"
+)
+
+// Routing information of the events received, describing
+// the sensor and event they originate from.
+type EventRouting struct {
+	OID             string   `json:"oid,omitempty" msgpack:"oid,omitempty"`
+	SID             string   `json:"sid,omitempty" msgpack:"sid,omitempty"`
+	DID             string   `json:"did,omitempty" msgpack:"did,omitempty"`
+	IID             string   `json:"iid,omitempty" msgpack:"iid,omitempty"`
+	Hostname        string   `json:"hostname,omitempty" msgpack:"hostname,omitempty"`
+	EventType       string   `json:"event_type,omitempty" msgpack:"event_type,omitempty"`
+	EventID         string   `json:"event_id,omitempty" msgpack:"event_id,omitempty"`
+	EventTime       int64    `json:"event_time,omitempty" msgpack:"event_time,omitempty"`
+	InvestigationID string   `json:"investigation_id,omitempty" msgpack:"investigation_id,omitempty"`
+	This            string   `json:"this,omitempty" msgpack:"this,omitempty"`
+	Parent          string   `json:"parent,omitempty" msgpack:"parent,omitempty"`
+	Target          string   `json:"target,omitempty" msgpack:"target,omitempty"`
+	Platform        uint32   `json:"plat,omitempty" msgpack:"plat,omitempty"`
+	Architecture    uint32   `json:"arch,omitempty" msgpack:"arch,omitempty"`
+	ExternalIP      string   `json:"ext_ip,omitempty" msgpack:"ext_ip,omitempty"`
+	InternalIP      string   `json:"int_ip,omitempty" msgpack:"int_ip,omitempty"`
+	ModuleID        int      `json:"moduleid,omitempty" msgpack:"moduleid,omitempty"`
+	Tags            []string `json:"tags,omitempty" msgpack:"tags,omitempty"`
+}
+
+// Event types of the deployment events, as found
+// in `DeploymentEvent.Routing.EventType`.
+var DeploymentEventTypes = struct {
+	Enrollment      string
+	SensorClone     string
+	SensorOverQuota string
+	DeletedSensor   string
+}{
+	Enrollment:      "enrollment",
+	SensorClone:     "sensor_clone",
+	SensorOverQuota: "sensor_over_quota",
+	DeletedSensor:   "deleted_sensor",
+}
+
+// A deployment event as received by the OnDeploymentEvent callback.
+// Use the `RequestEvent.AsDeploymentEvent()` to generate
+// this structure from a Request.
+type DeploymentEvent struct {
+	Routing EventRouting `json:"routing" msgpack:"routing"`
+	Event   Dict         `json:"event,omitempty" msgpack:"event,omitempty"`
+}
+
+// Routing information of a log event, adding
+// the log specific information.
+type LogRouting struct {
+	EventRouting `msgpack:",inline"`
+
+	LogType      string `json:"log_type,omitempty" msgpack:"log_type,omitempty"`
+	LogID        string `json:"log_id,omitempty" msgpack:"log_id,omitempty"`
+	OriginalPath string `json:"original_path,omitempty" msgpack:"original_path,omitempty"`
+}
+
+// A log event as received by the OnLogEvent callback.
+// Use the `RequestEvent.AsLogEvent()` to generate
+// this structure from a Request.
+type LogEvent struct {
+	Routing LogRouting `json:"routing" msgpack:"routing"`
+	Event   Dict       `json:"event,omitempty" msgpack:"event,omitempty"`
+}
+
+// The sensor a OnNewSensor or OnSensorPer* callback is about.
+// Use the `RequestEvent.AsSensorRef()` to generate
+// this structure from a Request.
+type SensorRef struct {
+	SID          string   `json:"sid" msgpack:"sid"`
+	Hostname     string   `json:"hostname,omitempty" msgpack:"hostname,omitempty"`
+	Platform     uint32   `json:"plat,omitempty" msgpack:"plat,omitempty"`
+	Architecture uint32   `json:"arch,omitempty" msgpack:"arch,omitempty"`
+	ExternalIP   string   `json:"ext_ip,omitempty" msgpack:"ext_ip,omitempty"`
+	InternalIP   string   `json:"int_ip,omitempty" msgpack:"int_ip,omitempty"`
+	Tags         []string `json:"tags,omitempty" msgpack:"tags,omitempty"`
+}
+
+func (re RequestEvent) AsDeploymentEvent() (DeploymentEvent, error) {
+	e := DeploymentEvent{}
+	if err := DictToStruct(re.Data, &e); err != nil {
+		return e, fmt.Errorf("invalid deployment event: %v", err)
+	}
+	return e, nil
+}
+
+func (re RequestEvent) AsLogEvent() (LogEvent, error) {
+	e := LogEvent{}
+	if err := DictToStruct(re.Data, &e); err != nil {
+		return e, fmt.Errorf("invalid log event: %v", err)
+	}
+	return e, nil
+}
+
+func (re RequestEvent) AsSensorRef() (SensorRef, error) {
+	s := SensorRef{}
+	if err := DictToStruct(re.Data, &s); err != nil {
+		return s, fmt.Errorf("invalid sensor reference: %v", err)
+	}
+	if s.SID == "" {
+		return s, fmt.Errorf("missing sid")
+	}
+	return s, nil
+}
+
+type DeploymentEventHandler = func(r Request, e DeploymentEvent) Response
+type LogEventHandler = func(r Request, e LogEvent) Response
+
+// Dispatches the deployment and log events received to handlers
+// registered per event type. Events not matching any handler are
+// given to the Descriptor's OnDeploymentEvent or OnLogEvent callback.
+type EventRouter struct {
+	deploymentHandlers map[string]DeploymentEventHandler
+	logHandlers        map[string]LogEventHandler
+}
+
+func NewEventRouter() *EventRouter {
+	return &EventRouter{
+		deploymentHandlers: map[string]DeploymentEventHandler{},
+		logHandlers:        map[string]LogEventHandler{},
+	}
+}
+
+// Register the handler of a type of deployment event,
+// like `DeploymentEventTypes.Enrollment`.
+func (er *EventRouter) HandleDeployment(eventType string, handler DeploymentEventHandler) *EventRouter {
+	er.deploymentHandlers[eventType] = handler
+	return er
+}
+
+// Register the handler of a type of log event.
+func (er *EventRouter) HandleLog(eventType string, handler LogEventHandler) *EventRouter {
+	er.logHandlers[eventType] = handler
+	return er
+}
+
+func (er *EventRouter) deploymentCallback(next ServiceCallback) ServiceCallback {
+	return func(r Request) Response {
+		e, err := r.Event.AsDeploymentEvent()
+		if err != nil {
+			return NewErrorResponse(err)
+		}
+		if handler, ok := er.deploymentHandlers[e.Routing.EventType]; ok {
+			return handler(r, e)
+		}
+		return callNext(next, r)
+	}
+}
+
+func (er *EventRouter) logCallback(next ServiceCallback) ServiceCallback {
+	return func(r Request) Response {
+		e, err := r.Event.AsLogEvent()
+		if err != nil {
+			return NewErrorResponse(err)
+		}
+		if handler, ok := er.logHandlers[e.Routing.EventType]; ok {
+			return handler(r, e)
+		}
+		return callNext(next, r)
+	}
+}
+
+// Route the events through the Descriptor's EventRouter,
+// only done once even if called again on a copy.
+func (d *Descriptor) applyEventRouter() {
+	if d.EventRouter == nil || d.isEventRouted {
+		return
+	}
+	d.isEventRouted = true
+	if len(d.EventRouter.deploymentHandlers) != 0 {
+		d.Callbacks.OnDeploymentEvent = d.EventRouter.deploymentCallback(d.Callbacks.OnDeploymentEvent)
+	}
+	if len(d.EventRouter.logHandlers) != 0 {
+		d.Callbacks.OnLogEvent = d.EventRouter.logCallback(d.Callbacks.OnLogEvent)
+	}
+}
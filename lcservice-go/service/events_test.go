@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	sampleDeploymentEvent = `{
+		"routing": {
+			"oid": "8cbe27f4-bfa1-4afb-ba19-138cd51389cd",
+			"sid": "d3d17f12-eecf-4d3c-9a5d-ac2f13e5d0b2",
+			"iid": "2b6bd7c1-19a5-4d8c-9d56-b5c2f17a5d7e",
+			"hostname": "host1",
+			"event_type": "enrollment",
+			"event_time": 1600000000000,
+			"plat": 268435456,
+			"arch": 2,
+			"ext_ip": "1.2.3.4",
+			"int_ip": "10.0.0.4",
+			"moduleid": 2,
+			"tags": ["t1", "t2"]
+		},
+		"event": {"hostname": "host1", "plat": "windows"}
+	}`
+	sampleLogEvent = `{
+		"routing": {
+			"oid": "8cbe27f4-bfa1-4afb-ba19-138cd51389cd",
+			"sid": "d3d17f12-eecf-4d3c-9a5d-ac2f13e5d0b2",
+			"hostname": "host1",
+			"event_type": "json",
+			"event_time": 1600000000000,
+			"log_type": "json",
+			"log_id": "f5e0d3a8-58c0-4f62-8d7c-1c0e65d4e4f5",
+			"original_path": "/var/log/app.json"
+		},
+		"event": {"msg": "hello", "level": "info"}
+	}`
+	sampleSensorRef = `{
+		"sid": "d3d17f12-eecf-4d3c-9a5d-ac2f13e5d0b2",
+		"hostname": "host1",
+		"plat": 268435456,
+		"arch": 2,
+		"ext_ip": "1.2.3.4",
+		"int_ip": "10.0.0.4",
+		"tags": ["t1"]
+	}`
+)
+
+func sampleEvent(t *testing.T, sample string) RequestEvent {
+	d := Dict{}
+	if err := json.Unmarshal([]byte(sample), &d); err != nil {
+		t.Fatal(err)
+	}
+	return RequestEvent{Data: d}
+}
+
+func assertRoundTrip(a *assert.Assertions, expected Dict, s interface{}) {
+	d := Dict{}
+	a.NoError(StructToDict(s, &d))
+	a.Equal(expected, d)
+}
+
+func TestEventPayloads(t *testing.T) {
+	a := assert.New(t)
+
+	re := sampleEvent(t, sampleDeploymentEvent)
+	de, err := re.AsDeploymentEvent()
+	a.NoError(err)
+	a.Equal(DeploymentEventTypes.Enrollment, de.Routing.EventType)
+	a.Equal("host1", de.Routing.Hostname)
+	a.Equal(uint32(268435456), de.Routing.Platform)
+	a.Equal(int64(1600000000000), de.Routing.EventTime)
+	a.Equal([]string{"t1", "t2"}, de.Routing.Tags)
+	a.Equal("windows", de.Event["plat"])
+	assertRoundTrip(a, re.Data, de)
+
+	re = sampleEvent(t, sampleLogEvent)
+	le, err := re.AsLogEvent()
+	a.NoError(err)
+	a.Equal("json", le.Routing.EventType)
+	a.Equal("json", le.Routing.LogType)
+	a.Equal("/var/log/app.json", le.Routing.OriginalPath)
+	a.Equal("d3d17f12-eecf-4d3c-9a5d-ac2f13e5d0b2", le.Routing.SID)
+	a.Equal("hello", le.Event["msg"])
+	assertRoundTrip(a, re.Data, le)
+
+	re = sampleEvent(t, sampleSensorRef)
+	sr, err := re.AsSensorRef()
+	a.NoError(err)
+	a.Equal("d3d17f12-eecf-4d3c-9a5d-ac2f13e5d0b2", sr.SID)
+	a.Equal("host1", sr.Hostname)
+	assertRoundTrip(a, re.Data, sr)
+
+	_, err = RequestEvent{Data: Dict{"hostname": "host1"}}.AsSensorRef()
+	a.Error(err)
+	_, err = RequestEvent{Data: Dict{"routing": "oops"}}.AsDeploymentEvent()
+	a.Error(err)
+}
+
+func TestEventRouter(t *testing.T) {
+	a := assert.New(t)
+
+	enrolled := []DeploymentEvent{}
+	logs := []LogEvent{}
+	raw := []string{}
+	s, err := NewService(Descriptor{
+		SecretKey: testSecretKey,
+		EventRouter: NewEventRouter().
+			HandleDeployment(DeploymentEventTypes.Enrollment, func(r Request, e DeploymentEvent) Response {
+				enrolled = append(enrolled, e)
+				return MakeSuccessResponse()
+			}).
+			HandleLog("json", func(r Request, e LogEvent) Response {
+				logs = append(logs, e)
+				return MakeSuccessResponse()
+			}),
+		Callbacks: DescriptorCallbacks{
+			OnDeploymentEvent: func(r Request) Response {
+				raw = append(raw, r.Event.Type)
+				return MakeSuccessResponse()
+			},
+		},
+	})
+	a.NoError(err)
+
+	makeEvent := func(eventType string, sample string) Dict {
+		return makeRequest(lcRequest{
+			Version: 1,
+			OID:     "o1",
+			Type:    eventType,
+			Data:    sampleEvent(t, sample).Data,
+		})
+	}
+
+	resp := s.ProcessRequest(makeEvent("deployment_event", sampleDeploymentEvent))
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(enrolled))
+	a.Empty(raw)
+
+	// Unhandled types go to the original callback.
+	unhandled := sampleEvent(t, sampleDeploymentEvent).Data
+	unhandled["routing"].(Dict)["event_type"] = DeploymentEventTypes.DeletedSensor
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "deployment_event", Data: unhandled}))
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(enrolled))
+	a.Equal([]string{"deployment_event"}, raw)
+
+	resp = s.ProcessRequest(makeEvent("log_event", sampleLogEvent))
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(logs))
+	a.Equal("f5e0d3a8-58c0-4f62-8d7c-1c0e65d4e4f5", logs[0].Routing.LogID)
+}
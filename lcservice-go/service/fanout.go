@@ -0,0 +1,357 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Prefix of the keys of fan-out operation records.
+	fanOutStorePrefix = "fanout/"
+
+	// Key of the context of per-sensor taskings
+	// pointing to their fan-out operation.
+	fanOutContextKey = "__fanout"
+)
+
+type FanOutCallback = func(FanOutResult) Response
+
+type FanOutOptions struct {
+	// Context made available to the aggregate callback.
+	Context   Dict
+	SessionID string
+
+	// Job the per-sensor outcomes are narrated in,
+	// a new Job is created if empty.
+	JobID string
+
+	// Deadline of the whole operation, defaults to the
+	// InteractiveServiceOptions.DefaultTaskingTimeout.
+	Timeout time.Duration
+
+	// Number of responses after which the aggregate
+	// callback is called, all sensors if 0.
+	Quorum int
+}
+
+// Outcome of the tasking of a single sensor.
+type FanOutOutcome struct {
+	Status TaskingStatus `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Event  Dict          `json:"event,omitempty"`
+}
+
+// Result of a fan-out operation given to its aggregate callback.
+type FanOutResult struct {
+	OperationID string
+	Org         *lc.Organization
+	OID         string
+	Context     Dict
+	Job         *Job
+
+	// Responses received from sensors so far.
+	Responses []InteractiveRequest
+	// Outcome of the tasking of each sensor.
+	Outcomes map[string]FanOutOutcome
+
+	// All sensors responded.
+	IsComplete bool
+	// The requested Quorum of responses was reached.
+	IsQuorumReached bool
+	// The deadline passed before all sensors responded.
+	IsTimedOut bool
+}
+
+type fanOutOperation struct {
+	ID                  string                   `json:"id"`
+	OID                 string                   `json:"oid"`
+	AggregateCallbackID string                   `json:"cb"`
+	Context             Dict                     `json:"ctx,omitempty"`
+	JobID               string                   `json:"job_id"`
+	SessionID           string                   `json:"session_id,omitempty"`
+	Deadline            int64                    `json:"deadline"`
+	Quorum              int                      `json:"quorum"`
+	Sensors             map[string]FanOutOutcome `json:"sensors"`
+	IsAggregated        bool                     `json:"is_aggregated"`
+}
+
+func (op fanOutOperation) countStatus(status TaskingStatus) int {
+	n := 0
+	for _, o := range op.Sensors {
+		if o.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func fanOutKey(oid string, opID string) string {
+	return fmt.Sprintf("%s%s/%s", fanOutStorePrefix, oid, opID)
+}
+
+// Register the aggregate callbacks usable with FanOutTasking.
+func (is *InteractiveService) RegisterFanOutCallbacks(callbacks ...FanOutCallback) {
+	for _, cb := range callbacks {
+		for _, secret := range is.sealer.secrets {
+			is.fanOutCallbacks[is.getCbHashWithKey(cb, secret)] = cb
+		}
+	}
+}
+
+// Task all the sensors matching a sensor selector, like
+// `plat == windows` or `"server" in tags`, with FanOutTasking.
+func (is *InteractiveService) FanOutTaskingFromSelector(org *lc.Organization, selector string, task string, opts FanOutOptions, cb FanOutCallback) (string, *Job, error) {
+	sensors, err := org.ListSensorsFromSelector(selector)
+	if err != nil {
+		return "", nil, err
+	}
+	sensorList := []*lc.Sensor{}
+	for _, s := range sensors {
+		sensorList = append(sensorList, s)
+	}
+	sort.Slice(sensorList, func(i, j int) bool { return sensorList[i].SID < sensorList[j].SID })
+	return is.FanOutTasking(org.GetOID(), sensorList, task, opts, cb)
+}
+
+// Task a set of sensors under a single operation. The aggregate
+// callback is called once, when all sensors responded, the Quorum
+// is reached or the deadline passes. Returns the operation ID and
+// the Job narrating the outcomes, which should be reported in the
+// Response of the calling callback.
+func (is *InteractiveService) FanOutTasking(oid string, sensors []*lc.Sensor, task string, opts FanOutOptions, cb FanOutCallback) (string, *Job, error) {
+	cbHash := is.getCbHash(cb)
+	if _, ok := is.fanOutCallbacks[cbHash]; !ok {
+		panic(fmt.Sprintf("fan-out callback not registered: %v", cbHash))
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = is.opts.DefaultTaskingTimeout
+	}
+	if timeout == 0 {
+		return "", nil, fmt.Errorf("a timeout is required for fan-out taskings")
+	}
+	if len(sensors) == 0 {
+		return "", nil, fmt.Errorf("no sensors to task")
+	}
+
+	job := NewJob()
+	if opts.JobID != "" {
+		job = NewJob(opts.JobID)
+	}
+	job.SetCause(fmt.Sprintf("fan-out of '%s' to %d sensors", task, len(sensors)))
+
+	op := fanOutOperation{
+		ID:                  uuid.New().String(),
+		OID:                 oid,
+		AggregateCallbackID: cbHash,
+		Context:             opts.Context,
+		JobID:               job.GetID(),
+		SessionID:           opts.SessionID,
+		Deadline:            time.Now().Add(timeout).Unix(),
+		Quorum:              opts.Quorum,
+		Sensors:             map[string]FanOutOutcome{},
+	}
+	for _, s := range sensors {
+		op.Sensors[s.SID] = FanOutOutcome{Status: TaskingStatuses.Pending}
+	}
+	if err := is.saveFanOut(op); err != nil {
+		return "", nil, err
+	}
+
+	nTasked := 0
+	for _, s := range sensors {
+		job.AddSensor(s.SID)
+		_, err := is.StartTrackedTasking(s, task, TrackedTaskingOptions{
+			Context:   Dict{fanOutContextKey: op.ID},
+			JobID:     job.GetID(),
+			SessionID: opts.SessionID,
+			OID:       oid,
+			Timeout:   timeout,
+			OnTimeout: is.onFanOutTimeout,
+		}, is.onFanOutResponse)
+		if err == nil {
+			nTasked++
+			continue
+		}
+		job.Narrate(fmt.Sprintf("failed to task sensor %s: %v", s.SID, err), true)
+		readyOp, err := is.updateFanOut(oid, op.ID, s.SID, FanOutOutcome{
+			Status: TaskingStatuses.Failed,
+			Error:  err.Error(),
+		})
+		if err != nil {
+			return op.ID, job, err
+		}
+		if readyOp != nil {
+			// The other sensors already responded, or none could
+			// be tasked, so nothing else will aggregate it.
+			resp := is.aggregateFanOut(*readyOp, InteractiveRequest{OID: oid, Job: job})
+			if !resp.IsSuccess {
+				job.Narrate(fmt.Sprintf("fan-out aggregation failed: %s", resp.Error), true)
+			}
+		}
+	}
+	if nTasked == 0 {
+		return op.ID, job, fmt.Errorf("failed to task all sensors")
+	}
+	job.Narrate(fmt.Sprintf("tasked %d of %d sensors with '%s'", nTasked, len(sensors), task), false)
+	return op.ID, job, nil
+}
+
+func (is *InteractiveService) saveFanOut(op fanOutOperation) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	ttl := taskingRecordRetention
+	if untilDeadline := time.Until(time.Unix(op.Deadline, 0)); untilDeadline > 0 {
+		ttl += untilDeadline
+	}
+	return is.cs.desc.StateStore.Set(fanOutKey(op.OID, op.ID), data, ttl)
+}
+
+func (is *InteractiveService) loadFanOut(oid string, opID string) (fanOutOperation, bool, error) {
+	op := fanOutOperation{}
+	data, isFound, err := is.cs.desc.StateStore.Get(fanOutKey(oid, opID))
+	if err != nil || !isFound {
+		return op, false, err
+	}
+	if err := json.Unmarshal(data, &op); err != nil {
+		return op, false, err
+	}
+	return op, true, nil
+}
+
+// Record the outcome of a sensor, returning the operation if
+// it is now ready to be aggregated. The operation is only ever
+// returned once.
+func (is *InteractiveService) updateFanOut(oid string, opID string, sid string, outcome FanOutOutcome) (*fanOutOperation, error) {
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	op, isFound, err := is.loadFanOut(oid, opID)
+	if err != nil {
+		return nil, err
+	}
+	if !isFound {
+		return nil, fmt.Errorf("fan-out operation '%s' not found", opID)
+	}
+	if current, ok := op.Sensors[sid]; ok && current.Status == TaskingStatuses.Responded {
+		// Keep the first response of each sensor.
+		return nil, nil
+	}
+	op.Sensors[sid] = outcome
+
+	isReady := op.countStatus(TaskingStatuses.Pending) == 0
+	if op.Quorum != 0 && op.countStatus(TaskingStatuses.Responded) >= op.Quorum {
+		isReady = true
+	}
+	isAggregate := isReady && !op.IsAggregated
+	if isAggregate {
+		op.IsAggregated = true
+	}
+	if err := is.saveFanOut(op); err != nil {
+		return nil, err
+	}
+	if !isAggregate {
+		return nil, nil
+	}
+	return &op, nil
+}
+
+func (is *InteractiveService) onFanOutResponse(r InteractiveRequest) Response {
+	return is.recordFanOutOutcome(r, FanOutOutcome{
+		Status: TaskingStatuses.Responded,
+		Event:  r.Event,
+	})
+}
+
+func (is *InteractiveService) onFanOutTimeout(r InteractiveRequest) Response {
+	return is.recordFanOutOutcome(r, FanOutOutcome{
+		Status: TaskingStatuses.TimedOut,
+	})
+}
+
+func (is *InteractiveService) recordFanOutOutcome(r InteractiveRequest, outcome FanOutOutcome) Response {
+	opID, err := r.GetStringFromContext(fanOutContextKey)
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+	op, err := is.updateFanOut(r.OID, opID, r.SID, outcome)
+	if err != nil {
+		is.cs.desc.LogCritical(fmt.Sprintf("error updating fan-out %s: %v", opID, err))
+		return NewRetriableResponse(err)
+	}
+	if r.Job != nil {
+		r.Job.Narrate(fmt.Sprintf("sensor %s: %s", r.SID, outcome.Status), false)
+	}
+	if op == nil {
+		resp := MakeSuccessResponse()
+		if r.Job != nil {
+			resp.Jobs = []*Job{r.Job}
+		}
+		return resp
+	}
+	return is.aggregateFanOut(*op, r)
+}
+
+func (is *InteractiveService) aggregateFanOut(op fanOutOperation, r InteractiveRequest) Response {
+	cb, ok := is.fanOutCallbacks[op.AggregateCallbackID]
+	if !ok || cb == nil {
+		is.cs.desc.LogCritical(fmt.Sprintf("fan-out %s has unknown callbackID: %s", op.ID, op.AggregateCallbackID))
+		return NewErrorResponse(fmt.Errorf("not implemented"))
+	}
+	result := FanOutResult{
+		OperationID: op.ID,
+		Org:         r.Org,
+		OID:         op.OID,
+		Context:     op.Context,
+		Job:         r.Job,
+		Responses:   []InteractiveRequest{},
+		Outcomes:    op.Sensors,
+	}
+	if result.Job == nil {
+		result.Job = NewJob(op.JobID)
+	}
+	nResponded := op.countStatus(TaskingStatuses.Responded)
+	result.IsComplete = nResponded == len(op.Sensors)
+	result.IsQuorumReached = op.Quorum != 0 && nResponded >= op.Quorum
+	result.IsTimedOut = op.countStatus(TaskingStatuses.TimedOut) != 0
+
+	rows := [][]string{}
+	sids := []string{}
+	for sid := range op.Sensors {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	for _, sid := range sids {
+		outcome := op.Sensors[sid]
+		rows = append(rows, []string{sid, outcome.Status, outcome.Error})
+		if outcome.Status != TaskingStatuses.Responded {
+			continue
+		}
+		result.Responses = append(result.Responses, InteractiveRequest{
+			Org:            r.Org,
+			OID:            op.OID,
+			SID:            sid,
+			Event:          outcome.Event,
+			Job:            result.Job,
+			Context:        op.Context,
+			ServiceRequest: r.ServiceRequest,
+		})
+	}
+	result.Job.Narrate(fmt.Sprintf("%d of %d sensors responded", nResponded, len(op.Sensors)), true,
+		NewTableAttachment("outcomes", []string{"sid", "status", "error"}, rows))
+
+	resp := cb(result)
+	for _, j := range resp.Jobs {
+		if j == result.Job {
+			return resp
+		}
+	}
+	resp.Jobs = append(resp.Jobs, result.Job)
+	return resp
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanOutTasking(t *testing.T) {
+	a := assert.New(t)
+	results := []FanOutResult{}
+	aggregateCB := func(r FanOutResult) Response {
+		results = append(results, r)
+		return Response{IsSuccess: true}
+	}
+	s, err := NewInteractiveService(Descriptor{
+		Name:        "testService",
+		SecretKey:   testSecretKey,
+		Log:         func(m string) { fmt.Println(m) },
+		LogCritical: func(m string) { fmt.Println(m) },
+	}, []InteractiveCallback{}, InteractiveServiceOptions{
+		DefaultTaskingTimeout: time.Hour,
+	})
+	a.NoError(err)
+	s.RegisterFanOutCallbacks(aggregateCB)
+
+	// Capture the taskings instead of sending them.
+	taskings := map[string]lc.TaskingOptions{}
+	s.taskSensor = func(sensor *lc.Sensor, task string, opts lc.TaskingOptions) error {
+		if sensor.SID == "sid4" {
+			return fmt.Errorf("offline")
+		}
+		taskings[sensor.SID] = opts
+		return nil
+	}
+	respond := func(sid string) Response {
+		req := makeInteractiveDetection(s, taskings[sid].InvestigationContext)
+		req["oid"] = "oid1"
+		req["data"].(Dict)["routing"].(Dict)["sid"] = sid
+		req["data"].(Dict)["detect"] = Dict{"from": sid}
+		return s.ProcessRequest(req)
+	}
+	sensors := []*lc.Sensor{{SID: "sid1"}, {SID: "sid2"}, {SID: "sid3"}, {SID: "sid4"}}
+
+	// Aggregate once the quorum is reached.
+	opID, job, err := s.FanOutTasking("oid1", sensors, "os_version", FanOutOptions{
+		Context: Dict{"k": "v"},
+		Quorum:  2,
+	}, aggregateCB)
+	a.NoError(err)
+	a.NotEmpty(opID)
+	a.NotNil(job)
+	a.Len(taskings, 3)
+
+	resp := respond("sid1")
+	a.True(resp.IsSuccess)
+	a.Len(results, 0)
+	a.Len(resp.Jobs, 1)
+	a.Equal(job.GetID(), resp.Jobs[0].GetID())
+	resp = respond("sid2")
+	a.True(resp.IsSuccess)
+	a.Len(results, 1)
+	r := results[0]
+	a.Equal(opID, r.OperationID)
+	a.Equal(Dict{"k": "v"}, r.Context)
+	a.True(r.IsQuorumReached)
+	a.False(r.IsComplete)
+	a.False(r.IsTimedOut)
+	a.Len(r.Responses, 2)
+	a.Equal(Dict{"from": "sid1"}, r.Responses[0].Event)
+	a.Equal(TaskingStatuses.Pending, r.Outcomes["sid3"].Status)
+	a.Equal(TaskingStatuses.Failed, r.Outcomes["sid4"].Status)
+
+	// Further responses do not aggregate again.
+	respond("sid3")
+	a.Len(results, 1)
+
+	// Without a quorum, the deadline triggers the aggregation.
+	results = results[:0]
+	taskings = map[string]lc.TaskingOptions{}
+	_, _, err = s.FanOutTasking("oid1", sensors[:2], "os_version", FanOutOptions{}, aggregateCB)
+	a.NoError(err)
+	respond("sid1")
+	a.Len(results, 0)
+	outstanding, err := s.ListOutstandingTaskings("oid1")
+	a.NoError(err)
+	a.Len(outstanding, 1)
+	tasking := outstanding[0]
+	tasking.Deadline = 0
+	a.NoError(s.saveTasking(tasking))
+	n, err := s.SweepExpiredTaskings("oid1", nil)
+	a.NoError(err)
+	a.Equal(1, n)
+	a.Len(results, 1)
+	a.True(results[0].IsTimedOut)
+	a.False(results[0].IsComplete)
+	a.Len(results[0].Responses, 1)
+	a.Equal(TaskingStatuses.TimedOut, results[0].Outcomes["sid2"].Status)
+
+	// Sensors failing to be tasked after the others responded
+	// still trigger the aggregation.
+	results = results[:0]
+	taskings = map[string]lc.TaskingOptions{}
+	taskSensor := s.taskSensor
+	s.taskSensor = func(sensor *lc.Sensor, task string, opts lc.TaskingOptions) error {
+		if sensor.SID == "sid4" {
+			respond("sid1")
+		}
+		return taskSensor(sensor, task, opts)
+	}
+	_, job, err = s.FanOutTasking("oid1", []*lc.Sensor{{SID: "sid1"}, {SID: "sid4"}}, "os_version", FanOutOptions{}, aggregateCB)
+	a.NoError(err)
+	a.Len(results, 1)
+	a.Equal(job, results[0].Job)
+	a.Len(results[0].Responses, 1)
+	a.Equal(TaskingStatuses.Failed, results[0].Outcomes["sid4"].Status)
+
+	// Without any sensor tasked, the aggregation still
+	// happens but an error is returned.
+	results = results[:0]
+	_, _, err = s.FanOutTasking("oid1", []*lc.Sensor{{SID: "sid4"}}, "os_version", FanOutOptions{}, aggregateCB)
+	a.Error(err)
+	a.Len(results, 1)
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -9,30 +10,20 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-
-	"gopkg.in/yaml.v2"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
 )
 
 const (
-	interactiveRuleTemplate = `
-%s:
-  namespace: managed
-  detect:
-    op: and
-    rules:
-      - op: starts with
-        path: routing/investigation_id
-        value: %s
-      - op: is
-        not: true
-        path: routing/event_type
-        value: CLOUD_NOTIFICATION
-  respond:
-    - action: report
-      name: __%s`
+	// Default duration externally stored contexts are kept.
+	defaultContextTTL = 24 * time.Hour
+
+	// Prefix of the keys of externally stored contexts.
+	contextStorePrefix = "ictx/"
 )
 
 type InteractiveService struct {
@@ -40,7 +31,10 @@ type InteractiveService struct {
 
 	// Rule used to get responses back.
 	detectionName   string
-	interactiveRule map[string]lc.CoreDRRule
+	interactiveRule lc.CoreDRRule
+
+	// Builds the client used to manage the rule in an org.
+	getOrgClient func(r Request) (orgConfigClient, error)
 
 	// Original user-defined callbacks
 	// that we need to overload.
@@ -50,6 +44,87 @@ type InteractiveService struct {
 	originalOnOrgUninstall ServiceCallback
 
 	interactiveCallbacks map[string]InteractiveCallback
+	fanOutCallbacks      map[string]FanOutCallback
+
+	// Sends a tasking to a sensor.
+	taskSensor func(sensor *lc.Sensor, task string, opts lc.TaskingOptions) error
+
+	// Seals the contexts of tracked taskings.
+	sealer *contextSealer
+
+	// Number of contexts that failed authentication.
+	rejectedContexts uint64
+
+	// Number of responses received after their context expired.
+	expiredContexts uint64
+
+	// Number of responses received after their tasking
+	// timed out or was canceled.
+	lateResponses uint64
+
+	// Serializes the updates to tracked tasking records.
+	taskingMutex sync.Mutex
+
+	opts InteractiveServiceOptions
+}
+
+// Optional configuration of an InteractiveService.
+type InteractiveServiceOptions struct {
+	// Encrypt the context of tracked taskings
+	// instead of only signing it.
+	IsEncryptContext bool
+
+	// Secret keys previously used by the service. Contexts
+	// sealed with those keys are still accepted so that
+	// in-flight taskings survive a rotation of the SecretKey.
+	PreviousSecretKeys []string
+
+	// Keep the context of tracked taskings in this store instead
+	// of embedding it in the investigation ID. Only a reference
+	// to the stored context then travels with the tasking.
+	ContextStore KVStore
+
+	// How long externally stored contexts are kept, defaults to
+	// 24 hours. Can be overridden per tasking.
+	ContextTTL time.Duration
+
+	// Delete an externally stored context as soon as a first
+	// response is received instead of waiting for its TTL.
+	IsDeleteContextOnResponse bool
+
+	// Called instead of the tasking's callback when a response is
+	// received after its context expired. If not set, the tasking's
+	// callback is called with IsContextExpired set.
+	OnContextExpired InteractiveCallback
+
+	// Deadline applied to tracked taskings that do not specify
+	// a Timeout. Taskings without a deadline are not tracked.
+	// Only applied to taskings with an OID, which options from
+	// GetTaskingOptionsForTrackedTasking only have if it is set.
+	// Expired taskings are swept on every org_per_1h, so timeouts
+	// fire up to an hour late unless SweepExpiredTaskings is also
+	// called more often, like from a ticker of the service.
+	DefaultTaskingTimeout time.Duration
+
+	// Called for responses received after their tasking timed
+	// out or was canceled. If not set, those are acknowledged
+	// and dropped without calling the tasking's callback.
+	OnLateResponse InteractiveCallback
+
+	// How long a Session is kept without activity,
+	// defaults to 24 hours.
+	SessionTTL time.Duration
+
+	// Template of the D&R rule getting responses back, see
+	// InteractiveRuleParams for the values available to it.
+	// Defaults to DefaultInteractiveRuleTemplate.
+	RuleTemplate string
+
+	// Version of the rule, embedded in its name. Bump it when
+	// changing the RuleTemplate so that orgs get the new rule
+	// and the previous versions removed on the next reconcile.
+	// Defaults to 1.
+	RuleVersion int
 }
 
 type InteractiveRequest struct {
@@ -60,6 +135,22 @@ type InteractiveRequest struct {
 	Job            *Job
 	Context        Dict
 	ServiceRequest Request
+
+	// The context of the tasking was stored externally
+	// and expired before this response was received.
+	IsContextExpired bool
+
+	// ID of the tracked tasking, if it has a deadline.
+	TaskingID string
+
+	// The tasking's deadline passed without a response,
+	// set when calling a timeout callback.
+	IsTimedOut bool
+
+	// Session the tasking belongs to. The Session is nil
+	// if it was closed or expired.
+	SessionID string
+	Session   *Session
 }
 
 func (r InteractiveRequest) GetFromContext(key string) (interface{}, error) {
@@ -154,35 +245,68 @@ type interactiveContext struct {
 	JobID      string `json:"j,omitempty" msgpack:"j,omitempty"`
 	SessionID  string `json:"s,omitempty" msgpack:"s,omitempty"`
 	Context    Dict   `json:"c" msgpack:"c"`
-}
-
-type inboundDetection struct {
-	Detect  Dict `json:"detect" msgpack:"detect"`
-	Routing struct {
-		InvestigationID string `json:"investigation_id" msgpack:"investigation_id"`
-		SensorID        string `json:"sid,omitempty" msgpack:"sid,omitempty"`
-	} `json:"routing" msgpack:"routing"`
+	ContextRef string `json:"r,omitempty" msgpack:"r,omitempty"`
+	TaskingID  string `json:"t,omitempty" msgpack:"t,omitempty"`
+	Deadline   int64  `json:"d,omitempty" msgpack:"d,omitempty"`
 }
 
 type TrackedTaskingOptions struct {
 	Context   Dict
 	JobID     string
 	SessionID string
+
+	// Override the InteractiveServiceOptions.ContextTTL
+	// of an externally stored Context.
+	ContextTTL time.Duration
+
+	// Org and sensor tasked, required to track a tasking
+	// with a deadline. Set automatically by TrackedTasking.
+	OID string
+	SID string
+
+	// Deadline after which the tasking times out, overrides
+	// the InteractiveServiceOptions.DefaultTaskingTimeout.
+	// Requires the OID, unlike the default which only applies
+	// to the taskings with an OID.
+	Timeout time.Duration
+
+	// Called when the deadline passes without a response,
+	// must be registered like other interactive callbacks.
+	OnTimeout InteractiveCallback
+
+	task string
 }
 
-func NewInteractiveService(descriptor Descriptor, callbacks []InteractiveCallback) (is *InteractiveService, err error) {
-	is = &InteractiveService{}
+func NewInteractiveService(descriptor Descriptor, callbacks []InteractiveCallback, options ...InteractiveServiceOptions) (is *InteractiveService, err error) {
+	opts := InteractiveServiceOptions{}
+	if len(options) != 0 {
+		opts = options[0]
+	}
+	if opts.ContextTTL == 0 {
+		opts.ContextTTL = defaultContextTTL
+	}
+	if opts.SessionTTL == 0 {
+		opts.SessionTTL = defaultSessionTTL
+	}
+	is = &InteractiveService{
+		sealer: newContextSealer(descriptor.SecretKey, opts.PreviousSecretKeys, opts.IsEncryptContext),
+		opts:   opts,
+		taskSensor: func(sensor *lc.Sensor, task string, opts lc.TaskingOptions) error {
+			return sensor.Task(task, opts)
+		},
+	}
 
 	// Install a D&R rule and a Detection subscription.
 	is.detectionName = fmt.Sprintf("svc-%s-ex", descriptor.Name)
-	is.interactiveRule = map[string]lc.CoreDRRule{}
-	templatedRule := fmt.Sprintf(interactiveRuleTemplate, is.detectionName, is.detectionName, is.detectionName)
-	if err := yaml.Unmarshal([]byte(templatedRule), &is.interactiveRule); err != nil {
-		panic(fmt.Sprintf("error parsing interactive rule (%v): %s", err, templatedRule))
+	if is.interactiveRule, err = is.buildInteractiveRule(descriptor.Name); err != nil {
+		return nil, err
 	}
 	descriptor.DetectionsSubscribed = append(descriptor.DetectionsSubscribed, fmt.Sprintf("__%s", is.detectionName))
 
-	// Overload a few callbacks.
+	// Overload a few callbacks, the detections
+	// we receive back go around the router.
+	descriptor.applyDetectionRouter()
+	descriptor.applyDetectionSuppression()
 	is.originalOnDetection = descriptor.Callbacks.OnDetection
 	is.originalOnOrgPer1H = descriptor.Callbacks.OnOrgPer1H
 	is.originalOnOrgInstall = descriptor.Callbacks.OnOrgInstall
@@ -196,17 +320,26 @@ func NewInteractiveService(descriptor Descriptor, callbacks []InteractiveCallbac
 	if err != nil {
 		return nil, err
 	}
+	is.cs.addHealthMetadata("interactive", is.getHealthMetadata)
+	is.cs.enableFeature("interactive")
+	is.getOrgClient = is.cs.orgConfigClient
 
 	// Compute the callbacks.
 	is.interactiveCallbacks = map[string]InteractiveCallback{}
+	is.fanOutCallbacks = map[string]FanOutCallback{}
 	is.registerInteractiveCallbacks(callbacks)
+	is.registerInteractiveCallbacks([]InteractiveCallback{is.onFanOutResponse, is.onFanOutTimeout})
 
 	return is, err
 }
 
 func (is *InteractiveService) registerInteractiveCallbacks(callbacks []InteractiveCallback) {
 	for _, cb := range callbacks {
-		is.interactiveCallbacks[is.getCbHash(cb)] = cb
+		// Callbacks are also reachable through the IDs generated
+		// with previous secret keys to survive key rotations.
+		for _, secret := range is.sealer.secrets {
+			is.interactiveCallbacks[is.getCbHashWithKey(cb, secret)] = cb
+		}
 	}
 }
 
@@ -214,6 +347,11 @@ func (is *InteractiveService) RegisterCommand(cmdDescriptor CommandDescriptor, i
 	if err := is.cs.desc.addCommand(cmdDescriptor); err != nil {
 		return err
 	}
+	if cmdDescriptor.RateLimit != nil {
+		if err := is.cs.enableRateLimits(); err != nil {
+			return err
+		}
+	}
 	if len(interactiveCb) == 0 {
 		return nil
 	}
@@ -226,6 +364,30 @@ func (is *InteractiveService) Init() error {
 	return is.cs.Init()
 }
 
+func (is *InteractiveService) BuildInfo() BuildInfo {
+	return is.cs.BuildInfo()
+}
+
+func (is *InteractiveService) Orgs() *OrgRegistry {
+	return is.cs.Orgs()
+}
+
+func (is *InteractiveService) Secrets() *SecretStore {
+	return is.cs.Secrets()
+}
+
+func (is *InteractiveService) OrgClient(oid string) (*lc.Organization, error) {
+	return is.cs.OrgClient(oid)
+}
+
+func (is *InteractiveService) ParallelExec(objects []interface{}, f func(ctx context.Context, o interface{}) (interface{}, error), opts ParallelOptions) []ParallelResult {
+	return is.cs.ParallelExec(objects, f, opts)
+}
+
+func (is *InteractiveService) ParallelExecMap(objects map[string]interface{}, f func(ctx context.Context, key string, o interface{}) (interface{}, error), opts ParallelOptions) map[string]ParallelResult {
+	return is.cs.ParallelExecMap(objects, f, opts)
+}
+
 func (is *InteractiveService) GetSecretKey() []byte {
 	return []byte(is.cs.desc.SecretKey)
 }
@@ -239,33 +401,44 @@ func (is *InteractiveService) ProcessCommand(commandArguments map[string]interfa
 }
 
 func (is *InteractiveService) getCbHash(cb interface{}) string {
+	return is.getCbHashWithKey(cb, is.cs.desc.SecretKey)
+}
+
+func (is *InteractiveService) getCbHashWithKey(cb interface{}, secretKey string) string {
 	name := runtime.FuncForPC(reflect.ValueOf(cb).Pointer()).Name()
-	h := md5.Sum([]byte(fmt.Sprintf("%s/%s", is.cs.desc.SecretKey, name)))
+	h := md5.Sum([]byte(fmt.Sprintf("%s/%s", secretKey, name)))
 	return hex.EncodeToString(h[:])[:8]
 }
 
 func (is *InteractiveService) onDetection(r Request) Response {
-	detection := inboundDetection{}
 	// Get the basic headers we use to tell if this is
 	// for the interactive service, or the user.
-	if err := DictToStruct(r.Event.Data, &detection); err != nil {
+	detection, err := r.Event.AsDetection()
+	if err != nil {
 		// Pass through to user.
-		return is.originalOnDetection(r)
+		return is.passThroughDetection(r)
 	}
 	// Check the routing investigation ID to see if it's for us.
 	if !strings.HasPrefix(detection.Routing.InvestigationID, is.detectionName) {
 		// Pass through to user.
-		return is.originalOnDetection(r)
+		return is.passThroughDetection(r)
 	}
-	ic, isICValid := parseInteractiveContext(detection.Routing.InvestigationID)
-	if !isICValid {
+	ic, isICPresent, err := is.parseInteractiveContext(detection.Routing.InvestigationID)
+	if !isICPresent {
 		// Pass through to user.
-		return is.originalOnDetection(r)
+		return is.passThroughDetection(r)
+	}
+	if err != nil {
+		// The context is ours but was tampered with or
+		// sealed with an unknown key, never trust it.
+		atomic.AddUint64(&is.rejectedContexts, 1)
+		is.cs.desc.LogCritical(fmt.Sprintf("rejected interactive context (%v): %s", err, detection.Routing.InvestigationID))
+		return NewErrorResponse(fmt.Errorf("invalid interactive context"))
 	}
 	req := InteractiveRequest{
 		Org:            r.Org,
 		OID:            r.OID,
-		SID:            detection.Routing.SensorID,
+		SID:            detection.Routing.SID,
 		Event:          detection.Detect,
 		Context:        ic.Context,
 		ServiceRequest: r,
@@ -275,49 +448,169 @@ func (is *InteractiveService) onDetection(r Request) Response {
 		req.Job = NewJob(ic.JobID)
 	}
 
+	if ic.ContextRef != "" {
+		ctx, isFound, err := is.loadContext(ic.ContextRef)
+		if err != nil {
+			is.cs.desc.LogCritical(fmt.Sprintf("error loading interactive context %s: %v", ic.ContextRef, err))
+			return NewRetriableResponse(err)
+		}
+		if isFound {
+			req.Context = ctx
+		} else {
+			atomic.AddUint64(&is.expiredContexts, 1)
+			req.IsContextExpired = true
+		}
+	}
+
 	// Get the right callback.
 	if ic.CallbackID == "" {
 		is.cs.desc.LogCritical(fmt.Sprintf("received interactive callback without callbackID: %s", detection.Routing.InvestigationID))
-		return is.originalOnDetection(r)
+		return is.passThroughDetection(r)
 	}
 
 	cb, ok := is.interactiveCallbacks[ic.CallbackID]
 	if !ok {
 		is.cs.desc.LogCritical(fmt.Sprintf("received interactive callback with unknown callbackID: %s", detection.Routing.InvestigationID))
-		return is.originalOnDetection(r)
+		return is.passThroughDetection(r)
 	}
 	if cb == nil {
 		return NewErrorResponse(fmt.Errorf("not implemented"))
 	}
+	if ic.TaskingID != "" {
+		req.TaskingID = ic.TaskingID
+		isDeliver, err := is.recordTaskingResponse(r.OID, ic)
+		if err != nil {
+			is.cs.desc.LogCritical(fmt.Sprintf("error recording response to tasking %s: %v", ic.TaskingID, err))
+			return NewRetriableResponse(err)
+		}
+		if !isDeliver {
+			atomic.AddUint64(&is.lateResponses, 1)
+			if is.opts.OnLateResponse != nil {
+				return is.opts.OnLateResponse(req)
+			}
+			return MakeSuccessResponse()
+		}
+	}
+	if ic.SessionID != "" {
+		req.SessionID = ic.SessionID
+		req.Session, err = is.recordSessionEvent(r.OID, ic.SessionID, SessionEvent{
+			Type:       SessionEventTypes.Response,
+			SID:        req.SID,
+			TaskingID:  ic.TaskingID,
+			CallbackID: ic.CallbackID,
+		})
+		if err != nil {
+			is.cs.desc.LogCritical(fmt.Sprintf("error recording response in session %s: %v", ic.SessionID, err))
+		}
+	}
+	if req.IsContextExpired && is.opts.OnContextExpired != nil {
+		return is.opts.OnContextExpired(req)
+	}
 	return cb(req)
 }
 
-func parseInteractiveContext(invID string) (interactiveContext, bool) {
+func (is *InteractiveService) passThroughDetection(r Request) Response {
+	if is.originalOnDetection == nil {
+		return NewErrorResponse(fmt.Errorf("not implemented"))
+	}
+	return is.originalOnDetection(r)
+}
+
+// Parse the sealed context out of an investigation ID. Also returns
+// whether a context was present at all, in which case any error
+// indicates the context is not authentic.
+func (is *InteractiveService) parseInteractiveContext(invID string) (interactiveContext, bool, error) {
 	ic := interactiveContext{}
 	components := strings.SplitN(invID, "/", 2)
 	if len(components) != 2 {
-		return ic, false
+		return ic, false, nil
 	}
-	if err := json.Unmarshal([]byte(components[1]), &ic); err != nil {
-		return ic, false
+	payload, err := is.sealer.open(components[1])
+	if err != nil {
+		return ic, true, err
+	}
+	if err := json.Unmarshal(payload, &ic); err != nil {
+		return ic, true, err
+	}
+	return ic, true, nil
+}
+
+func (is *InteractiveService) sealInteractiveContext(ic interactiveContext) (string, error) {
+	serialCtx, err := json.Marshal(ic)
+	if err != nil {
+		return "", err
+	}
+	return is.sealer.seal(serialCtx)
+}
+
+// Store a context externally, returning the reference to it.
+func (is *InteractiveService) storeContext(ctx Dict, ttl time.Duration) (string, error) {
+	serialCtx, err := json.Marshal(ctx)
+	if err != nil {
+		return "", err
+	}
+	if ttl == 0 {
+		ttl = is.opts.ContextTTL
+	}
+	ref := uuid.New().String()
+	if err := is.opts.ContextStore.Set(contextStorePrefix+ref, serialCtx, ttl); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+func (is *InteractiveService) loadContext(ref string) (Dict, bool, error) {
+	if is.opts.ContextStore == nil {
+		return nil, false, fmt.Errorf("no context store configured")
+	}
+	serialCtx, isFound, err := is.opts.ContextStore.Get(contextStorePrefix + ref)
+	if err != nil || !isFound {
+		return nil, false, err
+	}
+	ctx := Dict{}
+	if err := json.Unmarshal(serialCtx, &ctx); err != nil {
+		return nil, false, err
+	}
+	if is.opts.IsDeleteContextOnResponse {
+		if err := is.opts.ContextStore.Delete(contextStorePrefix + ref); err != nil {
+			is.cs.desc.LogCritical(fmt.Sprintf("error deleting interactive context %s: %v", ref, err))
+		}
+	}
+	return ctx, true, nil
+}
+
+func (is *InteractiveService) getHealthMetadata() interface{} {
+	return Dict{
+		"rejected_contexts": atomic.LoadUint64(&is.rejectedContexts),
+		"expired_contexts":  atomic.LoadUint64(&is.expiredContexts),
+		"late_responses":    atomic.LoadUint64(&is.lateResponses),
 	}
-	return ic, true
 }
 
 func (is *InteractiveService) onOrgPer1H(r Request) Response {
-	if err := is.applyInteractiveRule(r.Org); err != nil {
+	if err := is.applyInteractiveRule(r); err != nil {
 		is.cs.desc.LogCritical(fmt.Sprintf("onOrgPer1H.applyInteractiveRule: %v", err))
 	}
 
-	if is.originalOnOrgPer1H == nil {
-		return NewErrorResponse(fmt.Errorf("not implemented"))
+	timeoutResponses, err := is.sweepExpiredTaskings(r.OID, r.Org)
+	if err != nil {
+		is.cs.desc.LogCritical(fmt.Sprintf("onOrgPer1H.sweepExpiredTaskings: %v", err))
 	}
 
-	return is.originalOnOrgPer1H(r)
+	// The sweep runs even if the service has no callback of its own.
+	resp := MakeSuccessResponse()
+	if is.originalOnOrgPer1H != nil {
+		resp = is.originalOnOrgPer1H(r)
+	}
+	// Report the Jobs narrated by the timeout callbacks.
+	for _, tr := range timeoutResponses {
+		resp.Jobs = append(resp.Jobs, tr.Jobs...)
+	}
+	return resp
 }
 
 func (is *InteractiveService) onOrgInstall(r Request) Response {
-	if err := is.applyInteractiveRule(r.Org); err != nil {
+	if err := is.applyInteractiveRule(r); err != nil {
 		is.cs.desc.LogCritical(fmt.Sprintf("onOrgInstall.applyInteractiveRule: %v", err))
 	}
 
@@ -329,9 +622,12 @@ func (is *InteractiveService) onOrgInstall(r Request) Response {
 }
 
 func (is *InteractiveService) onOrgUninstall(r Request) Response {
-	if err := is.removeInteractiveRule(r.Org); err != nil {
+	if err := is.removeInteractiveRule(r); err != nil {
 		is.cs.desc.LogCritical(fmt.Sprintf("onOrgUninstall.removeInteractiveRule: %v", err))
 	}
+	if err := is.closeOrgSessions(r.OID); err != nil {
+		is.cs.desc.LogCritical(fmt.Sprintf("onOrgUninstall.closeOrgSessions: %v", err))
+	}
 
 	if is.originalOnOrgUninstall == nil {
 		return NewErrorResponse(fmt.Errorf("not implemented"))
@@ -341,58 +637,156 @@ func (is *InteractiveService) onOrgUninstall(r Request) Response {
 	return is.originalOnOrgUninstall(r)
 }
 
-func (is *InteractiveService) applyInteractiveRule(org *lc.Organization) error {
-	c := lc.OrgConfig{
-		DRRules: is.interactiveRule,
-	}
-	if _, err := org.SyncPush(c, lc.SyncOptions{
-		SyncDRRules: true,
-	}); err != nil {
-		is.cs.desc.LogCritical(fmt.Sprintf("error syncing interactive rule: %v", err))
-		return err
+// The tasking is recorded in its Session when the options are
+// generated since the service sends the tasking itself.
+func (is *InteractiveService) GetTaskingOptionsForTrackedTasking(opts TrackedTaskingOptions, cb InteractiveCallback) (lc.TaskingOptions, error) {
+	to, taskingID, _, err := is.prepareTrackedTasking(opts, cb)
+	if err != nil {
+		return to, err
 	}
-	return nil
-}
-
-func (is *InteractiveService) removeInteractiveRule(org *lc.Organization) error {
-	if err := org.DRRuleDelete(is.detectionName, lc.WithNamespace("managed")); err != nil {
-		is.cs.desc.LogCritical(fmt.Sprintf("error removing interactive rule: %v", err))
-		return err
+	if err := is.recordSessionTasking(opts, is.getCbHash(cb), taskingID); err != nil {
+		return lc.TaskingOptions{}, err
 	}
-	return nil
+	return to, nil
 }
 
-func (is *InteractiveService) GetTaskingOptionsForTrackedTasking(opts TrackedTaskingOptions, cb InteractiveCallback) (lc.TaskingOptions, error) {
+// Generate the tasking options of a tracked tasking, also returning
+// the ID of the tracked tasking and the reference of the externally
+// stored context, if any, to discard them if the tasking is not sent.
+func (is *InteractiveService) prepareTrackedTasking(opts TrackedTaskingOptions, cb InteractiveCallback) (lc.TaskingOptions, string, string, error) {
 	cbHash := is.getCbHash(cb)
 	if _, ok := is.interactiveCallbacks[cbHash]; !ok {
 		panic(fmt.Sprintf("tracked sensor task callback not registered: %v", cbHash))
 	}
-	serialCtx, err := json.Marshal(interactiveContext{
+	ic := interactiveContext{
 		CallbackID: cbHash,
 		JobID:      opts.JobID,
 		SessionID:  opts.SessionID,
 		Context:    opts.Context,
-	})
+	}
+	timeout := opts.Timeout
+	if timeout == 0 && opts.OID != "" {
+		timeout = is.opts.DefaultTaskingTimeout
+	}
+	if timeout != 0 {
+		t, err := is.trackTasking(opts, cbHash, timeout)
+		if err != nil {
+			return lc.TaskingOptions{}, "", "", err
+		}
+		ic.TaskingID = t.ID
+		ic.Deadline = t.Deadline
+	}
+	if is.opts.ContextStore != nil && len(opts.Context) != 0 {
+		ref, err := is.storeContext(opts.Context, opts.ContextTTL)
+		if err != nil {
+			is.discardTasking(opts.OID, ic.TaskingID, "")
+			return lc.TaskingOptions{}, "", "", err
+		}
+		ic.Context = nil
+		ic.ContextRef = ref
+	}
+	sealedCtx, err := is.sealInteractiveContext(ic)
 	if err != nil {
-		return lc.TaskingOptions{}, err
+		is.discardTasking(opts.OID, ic.TaskingID, ic.ContextRef)
+		return lc.TaskingOptions{}, "", "", err
 	}
 
 	return lc.TaskingOptions{
 		InvestigationID:      is.detectionName,
-		InvestigationContext: string(serialCtx),
-	}, nil
+		InvestigationContext: sealedCtx,
+	}, ic.TaskingID, ic.ContextRef, nil
+}
+
+// Remove the tracked tasking and the stored context
+// of a tasking which was not sent, if any.
+func (is *InteractiveService) discardTasking(oid string, taskingID string, contextRef string) {
+	if taskingID != "" {
+		if err := is.cs.desc.StateStore.Delete(taskingKey(oid, taskingID)); err != nil {
+			is.cs.desc.LogCritical(fmt.Sprintf("error removing tasking %s: %v", taskingID, err))
+		}
+	}
+	if contextRef != "" {
+		if err := is.opts.ContextStore.Delete(contextStorePrefix + contextRef); err != nil {
+			is.cs.desc.LogCritical(fmt.Sprintf("error deleting interactive context %s: %v", contextRef, err))
+		}
+	}
+}
+
+func (is *InteractiveService) trackTasking(opts TrackedTaskingOptions, cbHash string, timeout time.Duration) (OutstandingTasking, error) {
+	if opts.OID == "" {
+		return OutstandingTasking{}, fmt.Errorf("an OID is required to track a tasking with a timeout")
+	}
+	t := OutstandingTasking{
+		ID:         uuid.New().String(),
+		OID:        opts.OID,
+		SID:        opts.SID,
+		Task:       opts.task,
+		CallbackID: cbHash,
+		JobID:      opts.JobID,
+		SessionID:  opts.SessionID,
+		Context:    opts.Context,
+		CreatedAt:  time.Now().Unix(),
+		Deadline:   time.Now().Add(timeout).Unix(),
+		Status:     TaskingStatuses.Pending,
+	}
+	if opts.OnTimeout != nil {
+		t.TimeoutCallbackID = is.getCbHash(opts.OnTimeout)
+		if _, ok := is.interactiveCallbacks[t.TimeoutCallbackID]; !ok {
+			panic(fmt.Sprintf("tracked sensor task timeout callback not registered: %v", t.TimeoutCallbackID))
+		}
+	}
+	if err := is.saveTasking(t); err != nil {
+		return OutstandingTasking{}, err
+	}
+	return t, nil
+}
+
+func (is *InteractiveService) recordSessionTasking(opts TrackedTaskingOptions, cbHash string, taskingID string) error {
+	if opts.SessionID == "" || opts.OID == "" {
+		return nil
+	}
+	if _, err := is.GetOrCreateSession(opts.OID, opts.SessionID); err != nil {
+		return err
+	}
+	_, err := is.recordSessionEvent(opts.OID, opts.SessionID, SessionEvent{
+		Type:       SessionEventTypes.Tasking,
+		SID:        opts.SID,
+		TaskingID:  taskingID,
+		Task:       opts.task,
+		CallbackID: cbHash,
+	})
+	return err
 }
 
 func (is *InteractiveService) TrackedTasking(sensor *lc.Sensor, task string, opts TrackedTaskingOptions, cb InteractiveCallback) error {
-	to, err := is.GetTaskingOptionsForTrackedTasking(opts, cb)
+	_, err := is.StartTrackedTasking(sensor, task, opts, cb)
+	return err
+}
+
+// Same as TrackedTasking but also returns the ID of the
+// tracked tasking, empty if the tasking has no deadline.
+func (is *InteractiveService) StartTrackedTasking(sensor *lc.Sensor, task string, opts TrackedTaskingOptions, cb InteractiveCallback) (string, error) {
+	if opts.OID == "" {
+		opts.OID = sensor.OID
+	}
+	if opts.SID == "" {
+		opts.SID = sensor.SID
+	}
+	opts.task = task
+	to, taskingID, contextRef, err := is.prepareTrackedTasking(opts, cb)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if err := sensor.Task(task, to); err != nil {
-		return err
+	if err := is.taskSensor(sensor, task, to); err != nil {
+		is.discardTasking(opts.OID, taskingID, contextRef)
+		return "", err
 	}
-	return nil
+	// Only taskings actually sent are part of the Session.
+	if err := is.recordSessionTasking(opts, is.getCbHash(cb), taskingID); err != nil {
+		is.cs.desc.LogCritical(fmt.Sprintf("error recording tasking in session %s: %v", opts.SessionID, err))
+	}
+	return taskingID, nil
 }
 
 // LC.Logger Interface Compatibility
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Versioned prefixes of the sealed context formats.
+	sealedContextSigned    = "s1"
+	sealedContextEncrypted = "e1"
+
+	// Purposes used to derive keys from a SecretKey so
+	// that the raw secret is never used directly.
+	contextSigningKeyPurpose    = "lc-service/interactive-context/sign"
+	contextEncryptionKeyPurpose = "lc-service/interactive-context/encrypt"
+
+	// Length of the truncated HMAC appended to signed contexts.
+	contextMACLength = 16
+)
+
+var (
+	errContextMalformed   = errors.New("malformed interactive context")
+	errContextUnsupported = errors.New("unsupported interactive context format")
+	errContextForged      = errors.New("interactive context failed authentication")
+)
+
+// Seals and opens the interactive contexts sent along with
+// sensor taskings. Contexts are always authenticated and are
+// optionally encrypted. Several secrets can be used to open a
+// context, the first one is used to seal new ones.
+type contextSealer struct {
+	isEncrypt bool
+	secrets   []string
+}
+
+func newContextSealer(secretKey string, previousSecretKeys []string, isEncrypt bool) *contextSealer {
+	s := &contextSealer{
+		isEncrypt: isEncrypt,
+		secrets:   []string{secretKey},
+	}
+	for _, k := range previousSecretKeys {
+		if k == "" || k == secretKey {
+			continue
+		}
+		s.secrets = append(s.secrets, k)
+	}
+	return s
+}
+
+func deriveKey(secret string, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (s *contextSealer) seal(payload []byte) (string, error) {
+	if s.isEncrypt {
+		return s.encrypt(s.secrets[0], payload)
+	}
+	return s.sign(s.secrets[0], payload), nil
+}
+
+// Opens a sealed context, returning the original payload.
+// Both formats are always accepted so that toggling encryption
+// does not invalidate in-flight taskings.
+func (s *contextSealer) open(token string) ([]byte, error) {
+	components := strings.SplitN(token, ".", 2)
+	if len(components) != 2 {
+		return nil, errContextMalformed
+	}
+	var open func(secret string, body string) ([]byte, error)
+	switch components[0] {
+	case sealedContextSigned:
+		open = s.verify
+	case sealedContextEncrypted:
+		open = s.decrypt
+	default:
+		return nil, errContextUnsupported
+	}
+
+	var err error
+	for _, secret := range s.secrets {
+		var payload []byte
+		if payload, err = open(secret, components[1]); err == nil {
+			return payload, nil
+		}
+		if err == errContextMalformed {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (s *contextSealer) computeMAC(secret string, data string) []byte {
+	mac := hmac.New(sha256.New, deriveKey(secret, contextSigningKeyPurpose))
+	mac.Write([]byte(data))
+	return mac.Sum(nil)[:contextMACLength]
+}
+
+func (s *contextSealer) sign(secret string, payload []byte) string {
+	signed := fmt.Sprintf("%s.%s", sealedContextSigned, base64.RawURLEncoding.EncodeToString(payload))
+	return fmt.Sprintf("%s.%s", signed, base64.RawURLEncoding.EncodeToString(s.computeMAC(secret, signed)))
+}
+
+func (s *contextSealer) verify(secret string, body string) ([]byte, error) {
+	components := strings.SplitN(body, ".", 2)
+	if len(components) != 2 {
+		return nil, errContextMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(components[0])
+	if err != nil {
+		return nil, errContextMalformed
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(components[1])
+	if err != nil {
+		return nil, errContextMalformed
+	}
+	expected := s.computeMAC(secret, fmt.Sprintf("%s.%s", sealedContextSigned, components[0]))
+	if !hmac.Equal(mac, expected) {
+		return nil, errContextForged
+	}
+	return payload, nil
+}
+
+func (s *contextSealer) newAEAD(secret string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(secret, contextEncryptionKeyPurpose))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *contextSealer) encrypt(secret string, payload []byte) (string, error) {
+	aead, err := s.newAEAD(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, payload, []byte(sealedContextEncrypted))
+	return fmt.Sprintf("%s.%s", sealedContextEncrypted, base64.RawURLEncoding.EncodeToString(sealed)), nil
+}
+
+func (s *contextSealer) decrypt(secret string, body string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, errContextMalformed
+	}
+	aead, err := s.newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errContextMalformed
+	}
+	payload, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(sealedContextEncrypted))
+	if err != nil {
+		return nil, errContextForged
+	}
+	return payload, nil
+}
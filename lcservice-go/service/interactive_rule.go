@@ -0,0 +1,199 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Default template of the interactive rule.
+	DefaultInteractiveRuleTemplate = `
+namespace: managed
+detect:
+  op: and
+  rules:
+    - op: starts with
+      path: routing/investigation_id
+      value: {{.InvestigationPrefix}}
+    - op: is
+      not: true
+      path: routing/event_type
+      value: CLOUD_NOTIFICATION
+respond:
+  - action: report
+    name: {{.ReportName}}`
+
+	defaultInteractiveRuleVersion   = 1
+	defaultInteractiveRuleNamespace = "managed"
+)
+
+// Values available to the interactive rule template.
+type InteractiveRuleParams struct {
+	// Name of the service.
+	ServiceName string
+	// Prefix of the investigation IDs of interactive taskings.
+	InvestigationPrefix string
+	// Name the rule must report responses as.
+	ReportName string
+	// Version of the rule.
+	Version int
+}
+
+// Name of a version of the interactive rule.
+func (is *InteractiveService) interactiveRuleName(version int) string {
+	return fmt.Sprintf("%s-v%d", is.detectionName, version)
+}
+
+// Render and validate the interactive rule.
+func (is *InteractiveService) buildInteractiveRule(serviceName string) (lc.CoreDRRule, error) {
+	rule := lc.CoreDRRule{}
+	ruleTemplate := is.opts.RuleTemplate
+	if ruleTemplate == "" {
+		ruleTemplate = DefaultInteractiveRuleTemplate
+	}
+	version := is.opts.RuleVersion
+	if version == 0 {
+		version = defaultInteractiveRuleVersion
+	}
+	if version < 0 {
+		return rule, fmt.Errorf("invalid interactive rule version: %d", version)
+	}
+	tmpl, err := template.New("interactive_rule").Option("missingkey=error").Parse(ruleTemplate)
+	if err != nil {
+		return rule, fmt.Errorf("invalid interactive rule template: %v", err)
+	}
+	rendered := bytes.Buffer{}
+	if err := tmpl.Execute(&rendered, InteractiveRuleParams{
+		ServiceName:         serviceName,
+		InvestigationPrefix: is.detectionName,
+		ReportName:          fmt.Sprintf("__%s", is.detectionName),
+		Version:             version,
+	}); err != nil {
+		return rule, fmt.Errorf("error rendering interactive rule template: %v", err)
+	}
+	if err := yaml.Unmarshal(rendered.Bytes(), &rule); err != nil {
+		return rule, fmt.Errorf("error parsing interactive rule (%v): %s", err, rendered.String())
+	}
+	// The rule is sent as JSON which does not support
+	// the map types produced by the YAML parser.
+	rule.Detect = normalizeYAML(rule.Detect).(Dict)
+	rule.Response = normalizeYAML(rule.Response).([]interface{})
+	if err := is.validateInteractiveRule(rule); err != nil {
+		return rule, err
+	}
+	rule.Name = is.interactiveRuleName(version)
+	if rule.Namespace == "" {
+		rule.Namespace = defaultInteractiveRuleNamespace
+	}
+	return rule, nil
+}
+
+func (is *InteractiveService) validateInteractiveRule(rule lc.CoreDRRule) error {
+	if rule.Name != "" {
+		return fmt.Errorf("interactive rule name is generated and should not be set: %s", rule.Name)
+	}
+	if len(rule.Detect) == 0 {
+		return fmt.Errorf("interactive rule has no detect component")
+	}
+	reportName := fmt.Sprintf("__%s", is.detectionName)
+	for _, r := range rule.Response {
+		action, ok := r.(Dict)
+		if !ok {
+			continue
+		}
+		if action["action"] == "report" && action["name"] == reportName {
+			return nil
+		}
+	}
+	return fmt.Errorf("interactive rule does not report responses as %s", reportName)
+}
+
+// Install the current version of the interactive rule and remove
+// the previous ones, including the unversioned legacy rule.
+func (is *InteractiveService) applyInteractiveRule(r Request) error {
+	return is.syncInteractiveRule(r, map[string]lc.CoreDRRule{
+		is.interactiveRule.Name: is.interactiveRule,
+	})
+}
+
+// Remove all the versions of the interactive rule.
+func (is *InteractiveService) removeInteractiveRule(r Request) error {
+	return is.syncInteractiveRule(r, map[string]lc.CoreDRRule{})
+}
+
+func (is *InteractiveService) syncInteractiveRule(r Request, rules map[string]lc.CoreDRRule) error {
+	client, err := is.getOrgClient(r)
+	if err != nil {
+		return err
+	}
+	m := newRuleManager(client, r.OID, is.cs.desc.StateStore, is.isInteractiveRuleName)
+	// The service does not work without its rule,
+	// so conflicting changes are overwritten.
+	result, err := m.Sync(rules, RuleSyncOptions{
+		IsForce: true,
+	})
+	for _, c := range result.Conflicts() {
+		is.cs.Warn(fmt.Sprintf("overwrote conflicting interactive rule %s/%s in %s: %s", c.Namespace, c.Name, r.OID, c.Reason))
+	}
+	if err != nil {
+		is.cs.Error(fmt.Sprintf("error syncing interactive rule: %v", err))
+		return err
+	}
+	return nil
+}
+
+func (is *InteractiveService) isInteractiveRuleName(name string) bool {
+	if name == is.detectionName {
+		return true
+	}
+	prefix := fmt.Sprintf("%s-v", is.detectionName)
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	return err == nil
+}
+
+// Convert the maps produced by the YAML parser to Dicts.
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		d := Dict{}
+		for k, e := range t {
+			d[fmt.Sprintf("%v", k)] = normalizeYAML(e)
+		}
+		return d
+	case lc.Dict:
+		d := Dict{}
+		for k, e := range t {
+			d[k] = normalizeYAML(e)
+		}
+		return d
+	case Dict:
+		d := Dict{}
+		for k, e := range t {
+			d[k] = normalizeYAML(e)
+		}
+		return d
+	case lc.List:
+		l := []interface{}{}
+		for _, e := range t {
+			l = append(l, normalizeYAML(e))
+		}
+		return l
+	case []interface{}:
+		l := []interface{}{}
+		for _, e := range t {
+			l = append(l, normalizeYAML(e))
+		}
+		return l
+	}
+	return v
+}
@@ -1,9 +1,16 @@
 package service
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestInteractive(t *testing.T) {
@@ -60,6 +67,13 @@ func TestInteractive(t *testing.T) {
 				"detect_subscriptions": []string{"d1", "d2", "__svc-testService-ex"},
 				"callbacks":            []string{"detection", "health", "org_install", "org_per_1h", "org_uninstall"},
 				"commands":             Dict{},
+				"build":                s.BuildInfo(),
+				"features":             []string{"interactive"},
+				"interactive": Dict{
+					"rejected_contexts": 0,
+					"expired_contexts":  0,
+					"late_responses":    0,
+				},
 			},
 		},
 	}) {
@@ -68,14 +82,14 @@ func TestInteractive(t *testing.T) {
 
 	// Make a request to callback.
 	cbHash := s.getCbHash(testCB)
-	iContext, err := json.Marshal(interactiveContext{
+	iContext, err := s.sealInteractiveContext(interactiveContext{
 		CallbackID: cbHash,
 		Context: Dict{
 			"some": "ctx",
 		},
 	})
 	if err != nil {
-		t.Errorf("json.Marshal: %v", err)
+		t.Errorf("sealInteractiveContext: %v", err)
 	}
 	testData = makeRequest(lcRequest{
 		Version:  1,
@@ -105,3 +119,457 @@ func TestInteractive(t *testing.T) {
 		t.Errorf("unexpected: %+v", resp)
 	}
 }
+
+func makeInteractiveDetection(s *InteractiveService, sealedCtx string) Dict {
+	return makeRequest(lcRequest{
+		Version: 1,
+		Type:    "detection",
+		Data: Dict{
+			"detect": Dict{
+				"a": "yes",
+			},
+			"routing": Dict{
+				"investigation_id": fmt.Sprintf("%s/%s", s.detectionName, sealedCtx),
+			},
+		},
+	})
+}
+
+func TestInteractiveContextAuthentication(t *testing.T) {
+	a := assert.New(t)
+	testCB := func(r InteractiveRequest) Response {
+		return Response{IsSuccess: true, Data: r.Context}
+	}
+	newService := func(secretKey string, opts InteractiveServiceOptions) *InteractiveService {
+		s, err := NewInteractiveService(Descriptor{
+			Name:        "testService",
+			SecretKey:   secretKey,
+			Log:         func(m string) { fmt.Println(m) },
+			LogCritical: func(m string) { fmt.Println(m) },
+		}, []InteractiveCallback{testCB}, opts)
+		a.NoError(err)
+		return s
+	}
+
+	s := newService(testSecretKey, InteractiveServiceOptions{})
+	ic := interactiveContext{
+		CallbackID: s.getCbHash(testCB),
+		Context:    Dict{"some": "ctx"},
+	}
+	sealed, err := s.sealInteractiveContext(ic)
+	a.NoError(err)
+	resp := s.ProcessRequest(makeInteractiveDetection(s, sealed))
+	a.True(resp.IsSuccess)
+	a.Equal(Dict{"some": "ctx"}, resp.Data)
+
+	// A plain JSON context is no longer accepted.
+	plain, err := json.Marshal(ic)
+	a.NoError(err)
+	resp = s.ProcessRequest(makeInteractiveDetection(s, string(plain)))
+	a.False(resp.IsSuccess)
+	a.NotEmpty(resp.Error)
+
+	// Neither is a context with a tampered payload
+	// or one signed with an unknown key.
+	forged, err := json.Marshal(interactiveContext{
+		CallbackID: s.getCbHash(testCB),
+		Context:    Dict{"some": "forged"},
+	})
+	a.NoError(err)
+	tampered := strings.Split(sealed, ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString(forged)
+	resp = s.ProcessRequest(makeInteractiveDetection(s, strings.Join(tampered, ".")))
+	a.False(resp.IsSuccess)
+	resp = s.ProcessRequest(makeInteractiveDetection(s, s.sealer.sign("otherkey", forged)))
+	a.False(resp.IsSuccess)
+	a.Equal(uint64(3), s.rejectedContexts)
+
+	// Encrypted contexts are opaque and accepted.
+	es := newService(testSecretKey, InteractiveServiceOptions{IsEncryptContext: true})
+	encrypted, err := es.sealInteractiveContext(ic)
+	a.NoError(err)
+	a.NotContains(encrypted, "ctx")
+	resp = es.ProcessRequest(makeInteractiveDetection(es, encrypted))
+	a.True(resp.IsSuccess)
+	a.Equal(Dict{"some": "ctx"}, resp.Data)
+
+	// After a key rotation, contexts sealed with the
+	// previous key are only accepted if it is declared.
+	rotated := newService("newkey", InteractiveServiceOptions{})
+	resp = rotated.ProcessRequest(makeInteractiveDetection(rotated, sealed))
+	a.False(resp.IsSuccess)
+	rotated = newService("newkey", InteractiveServiceOptions{PreviousSecretKeys: []string{testSecretKey}})
+	resp = rotated.ProcessRequest(makeInteractiveDetection(rotated, sealed))
+	a.True(resp.IsSuccess)
+	resp = rotated.ProcessRequest(makeInteractiveDetection(rotated, encrypted))
+	a.True(resp.IsSuccess)
+}
+
+func TestInteractiveContextStore(t *testing.T) {
+	a := assert.New(t)
+	testCB := func(r InteractiveRequest) Response {
+		return Response{IsSuccess: true, Data: Dict{"ctx": r.Context, "expired": r.IsContextExpired}}
+	}
+	store := NewMemoryStore()
+	s, err := NewInteractiveService(Descriptor{
+		Name:        "testService",
+		SecretKey:   testSecretKey,
+		Log:         func(m string) { fmt.Println(m) },
+		LogCritical: func(m string) { fmt.Println(m) },
+	}, []InteractiveCallback{testCB}, InteractiveServiceOptions{
+		ContextStore: store,
+	})
+	a.NoError(err)
+
+	largeValue := strings.Repeat("x", 4096)
+	to, err := s.GetTaskingOptionsForTrackedTasking(TrackedTaskingOptions{
+		Context: Dict{"large": largeValue},
+	}, testCB)
+	a.NoError(err)
+	a.NotContains(to.InvestigationContext, largeValue)
+	a.Less(len(to.InvestigationContext), 256)
+
+	resp := s.ProcessRequest(makeInteractiveDetection(s, to.InvestigationContext))
+	a.True(resp.IsSuccess)
+	a.Equal(Dict{"large": largeValue}, resp.Data["ctx"])
+	a.Equal(false, resp.Data["expired"])
+
+	// Once the context is gone, the callback is told it expired.
+	keys, err := store.List(contextStorePrefix)
+	a.NoError(err)
+	a.Len(keys, 1)
+	a.NoError(store.Delete(keys[0]))
+	resp = s.ProcessRequest(makeInteractiveDetection(s, to.InvestigationContext))
+	a.True(resp.IsSuccess)
+	a.Nil(resp.Data["ctx"])
+	a.Equal(true, resp.Data["expired"])
+	a.Equal(uint64(1), s.expiredContexts)
+
+	// The context of a tasking which could not be sent is removed.
+	s.taskSensor = func(sensor *lc.Sensor, task string, opts lc.TaskingOptions) error {
+		return fmt.Errorf("offline")
+	}
+	_, err = s.StartTrackedTasking(&lc.Sensor{OID: "oid1", SID: "sid1"}, "os_version", TrackedTaskingOptions{
+		Context: Dict{"large": largeValue},
+		Timeout: time.Hour,
+	}, testCB)
+	a.Error(err)
+	keys, err = store.List(contextStorePrefix)
+	a.NoError(err)
+	a.Empty(keys)
+	outstanding, err := s.ListOutstandingTaskings("oid1")
+	a.NoError(err)
+	a.Empty(outstanding)
+}
+
+func TestInteractiveTaskingTimeout(t *testing.T) {
+	a := assert.New(t)
+	testCB := func(r InteractiveRequest) Response {
+		return Response{IsSuccess: true, Data: Dict{"tasking": r.TaskingID}}
+	}
+	timedOut := []InteractiveRequest{}
+	timeoutCB := func(r InteractiveRequest) Response {
+		timedOut = append(timedOut, r)
+		resp := Response{IsSuccess: true}
+		if r.Job != nil {
+			resp.Jobs = append(resp.Jobs, r.Job)
+		}
+		return resp
+	}
+	s, err := NewInteractiveService(Descriptor{
+		Name:        "testService",
+		SecretKey:   testSecretKey,
+		Log:         func(m string) { fmt.Println(m) },
+		LogCritical: func(m string) { fmt.Println(m) },
+	}, []InteractiveCallback{testCB, timeoutCB}, InteractiveServiceOptions{
+		DefaultTaskingTimeout: time.Hour,
+	})
+	a.NoError(err)
+
+	// Taskings with a deadline need to know the org, the
+	// default deadline only applies to the ones with an org.
+	_, err = s.GetTaskingOptionsForTrackedTasking(TrackedTaskingOptions{Timeout: time.Minute}, testCB)
+	a.Error(err)
+	_, taskingID, _, err := s.prepareTrackedTasking(TrackedTaskingOptions{}, testCB)
+	a.NoError(err)
+	a.Empty(taskingID)
+	to, err := s.GetTaskingOptionsForTrackedTasking(TrackedTaskingOptions{Context: Dict{"k": "v"}}, testCB)
+	a.NoError(err)
+	resp := s.ProcessRequest(makeInteractiveDetection(s, to.InvestigationContext))
+	a.True(resp.IsSuccess)
+	a.Equal("", resp.Data["tasking"])
+
+	newTasking := func() (string, string) {
+		to, taskingID, _, err := s.prepareTrackedTasking(TrackedTaskingOptions{
+			OID:       "oid1",
+			SID:       "sid1",
+			Context:   Dict{"k": "v"},
+			OnTimeout: timeoutCB,
+		}, testCB)
+		a.NoError(err)
+		a.NotEmpty(taskingID)
+		return to.InvestigationContext, taskingID
+	}
+	respond := func(sealedCtx string) Response {
+		req := makeInteractiveDetection(s, sealedCtx)
+		req["oid"] = "oid1"
+		return s.ProcessRequest(req)
+	}
+
+	// A response within the deadline is delivered.
+	sealed1, id1 := newTasking()
+	sealed2, id2 := newTasking()
+	sealed3, id3 := newTasking()
+	outstanding, err := s.ListOutstandingTaskings("oid1")
+	a.NoError(err)
+	a.Len(outstanding, 3)
+	resp = respond(sealed1)
+	a.Equal(id1, resp.Data["tasking"])
+
+	// Canceled taskings drop their responses.
+	a.NoError(s.CancelTasking("oid1", id2))
+	resp = respond(sealed2)
+	a.True(resp.IsSuccess)
+	a.Nil(resp.Data)
+
+	// Expired taskings trigger their timeout callback once
+	// and responses received afterwards are dropped.
+	tasking, _, err := s.loadTasking("oid1", id3)
+	a.NoError(err)
+	tasking.Deadline = time.Now().Add(-time.Minute).Unix()
+	a.NoError(s.saveTasking(tasking))
+	n, err := s.SweepExpiredTaskings("oid1", nil)
+	a.NoError(err)
+	a.Equal(1, n)
+	n, err = s.SweepExpiredTaskings("", nil)
+	a.NoError(err)
+	a.Equal(0, n)
+	a.Len(timedOut, 1)
+	a.Equal(id3, timedOut[0].TaskingID)
+	a.True(timedOut[0].IsTimedOut)
+	a.Equal(Dict{"k": "v"}, timedOut[0].Context)
+	resp = respond(sealed3)
+	a.Nil(resp.Data)
+	a.Equal(uint64(2), s.lateResponses)
+
+	outstanding, err = s.ListOutstandingTaskings("oid1")
+	a.NoError(err)
+	a.Len(outstanding, 0)
+
+	// The org_per_1h sweep reports the Jobs of the timeout callbacks,
+	// even without an OnOrgPer1H of the service.
+	_, id4, _, err := s.prepareTrackedTasking(TrackedTaskingOptions{
+		OID:       "oid1",
+		SID:       "sid1",
+		JobID:     "job1",
+		OnTimeout: timeoutCB,
+	}, testCB)
+	a.NoError(err)
+	tasking, _, err = s.loadTasking("oid1", id4)
+	a.NoError(err)
+	tasking.Deadline = time.Now().Add(-time.Minute).Unix()
+	a.NoError(s.saveTasking(tasking))
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "oid1", Type: "org_per_1h", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	a.Len(resp.Jobs, 1)
+	a.Equal("job1", resp.Jobs[0].GetID())
+	a.Len(timedOut, 2)
+}
+
+func TestInteractiveSession(t *testing.T) {
+	a := assert.New(t)
+	testCB := func(r InteractiveRequest) Response {
+		if r.Session == nil {
+			return Response{IsSuccess: true, Data: Dict{"session": r.SessionID}}
+		}
+		n, _ := r.Session.Get("n")
+		r.Session.Set("n", n.(float64)+1)
+		if err := r.Session.Save(); err != nil {
+			return NewErrorResponse(err)
+		}
+		return Response{IsSuccess: true, Data: Dict{"session": r.SessionID, "history": len(r.Session.History)}}
+	}
+	s, err := NewInteractiveService(Descriptor{
+		Name:        "testService",
+		SecretKey:   testSecretKey,
+		Log:         func(m string) { fmt.Println(m) },
+		LogCritical: func(m string) { fmt.Println(m) },
+	}, []InteractiveCallback{testCB})
+	a.NoError(err)
+
+	session, err := s.GetSessionForRequest(Request{
+		OID:   "oid1",
+		Event: RequestEvent{Data: Dict{"ssid": "chat-session"}},
+	})
+	a.NoError(err)
+	a.Equal("chat-session", session.ID)
+	session.Set("n", 0)
+	a.NoError(session.Save())
+
+	to, err := s.GetTaskingOptionsForTrackedTasking(TrackedTaskingOptions{
+		OID:       "oid1",
+		SID:       "sid1",
+		SessionID: session.ID,
+	}, testCB)
+	a.NoError(err)
+	req := makeInteractiveDetection(s, to.InvestigationContext)
+	req["oid"] = "oid1"
+	resp := s.ProcessRequest(req)
+	a.True(resp.IsSuccess)
+	a.Equal("chat-session", resp.Data["session"])
+	a.Equal(2, resp.Data["history"])
+
+	session, isFound, err := s.GetSession("oid1", "chat-session")
+	a.NoError(err)
+	a.True(isFound)
+	a.Equal(float64(1), session.State["n"])
+	a.Equal(SessionEventTypes.Tasking, session.History[0].Type)
+	a.Equal("sid1", session.History[0].SID)
+	a.Equal(SessionEventTypes.Response, session.History[1].Type)
+
+	// Only the taskings sent are recorded.
+	s.taskSensor = func(sensor *lc.Sensor, task string, opts lc.TaskingOptions) error {
+		if sensor.SID == "offline" {
+			return fmt.Errorf("offline")
+		}
+		return nil
+	}
+	_, err = s.StartTrackedTasking(&lc.Sensor{OID: "oid1", SID: "offline"}, "os_version", TrackedTaskingOptions{SessionID: session.ID}, testCB)
+	a.Error(err)
+	_, err = s.StartTrackedTasking(&lc.Sensor{OID: "oid1", SID: "sid2"}, "os_version", TrackedTaskingOptions{SessionID: session.ID}, testCB)
+	a.NoError(err)
+	session, _, err = s.GetSession("oid1", "chat-session")
+	a.NoError(err)
+	a.Len(session.History, 3)
+	a.Equal("sid2", session.History[2].SID)
+	a.Equal("os_version", session.History[2].Task)
+
+	// Responses to closed sessions are delivered without a Session.
+	a.NoError(session.Close())
+	resp = s.ProcessRequest(req)
+	a.True(resp.IsSuccess)
+	a.Equal("chat-session", resp.Data["session"])
+	a.Nil(resp.Data["history"])
+	_, isFound, err = s.GetSession("oid1", "chat-session")
+	a.NoError(err)
+	a.False(isFound)
+}
+
+func TestInteractiveSessionConcurrentCreation(t *testing.T) {
+	a := assert.New(t)
+	s, err := NewInteractiveService(Descriptor{
+		Name:      "testService",
+		SecretKey: testSecretKey,
+	}, []InteractiveCallback{})
+	a.NoError(err)
+
+	// Sessions created concurrently are never reset.
+	n := 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.GetOrCreateSession("oid1", "shared")
+			a.NoError(err)
+			_, err = s.recordSessionEvent("oid1", "shared", SessionEvent{Type: SessionEventTypes.Tasking})
+			a.NoError(err)
+		}()
+	}
+	wg.Wait()
+	session, isFound, err := s.GetSession("oid1", "shared")
+	a.NoError(err)
+	a.True(isFound)
+	a.Len(session.History, n)
+}
+
+func TestInteractiveRuleTemplate(t *testing.T) {
+	a := assert.New(t)
+	desc := Descriptor{
+		Name:        "testService",
+		SecretKey:   testSecretKey,
+		Log:         func(m string) { fmt.Println(m) },
+		LogCritical: func(m string) { fmt.Println(m) },
+	}
+
+	s, err := NewInteractiveService(desc, nil)
+	a.NoError(err)
+	a.Equal("svc-testService-ex-v1", s.interactiveRule.Name)
+	a.Equal("managed", s.interactiveRule.Namespace)
+	b, err := json.Marshal(s.interactiveRule)
+	a.NoError(err)
+	a.Contains(string(b), `"value":"svc-testService-ex"`)
+	a.Contains(string(b), `"name":"__svc-testService-ex"`)
+
+	// Templates must keep reporting responses to the service.
+	_, err = NewInteractiveService(desc, nil, InteractiveServiceOptions{
+		RuleTemplate: `
+detect:
+  op: exists
+  path: routing/investigation_id
+respond:
+  - action: report
+    name: something-else`,
+	})
+	a.Error(err)
+	_, err = NewInteractiveService(desc, nil, InteractiveServiceOptions{
+		RuleTemplate: `detect: {{.Unknown}}`,
+	})
+	a.Error(err)
+
+	s, err = NewInteractiveService(desc, nil, InteractiveServiceOptions{
+		RuleVersion: 3,
+		RuleTemplate: `
+namespace: general
+detect:
+  op: and
+  rules:
+    - op: starts with
+      path: routing/investigation_id
+      value: {{.InvestigationPrefix}}
+    - op: is windows
+respond:
+  - action: report
+    name: {{.ReportName}}
+    suppression:
+      max_count: 1
+      period: 1m
+      is_global: false
+      keys:
+        - '{{"{{"}} .routing.investigation_id {{"}}"}}'`,
+	})
+	a.NoError(err)
+	a.Equal("svc-testService-ex-v3", s.interactiveRule.Name)
+	a.Equal("general", s.interactiveRule.Namespace)
+
+	// Previous versions are removed when upgrading.
+	fake := &fakeOrgConfigClient{
+		rules: map[string]map[string]lc.Dict{
+			"managed": {
+				"svc-testService-ex":    {},
+				"svc-testService-ex-v1": {},
+				"other-rule":            {},
+			},
+			"general": {
+				"svc-testService-ex-v2":     {},
+				"svc-testService-ex-vnext":  {},
+				"svc-testService-example-1": {},
+			},
+		},
+	}
+	s.getOrgClient = func(r Request) (orgConfigClient, error) {
+		return fake, nil
+	}
+	a.NoError(s.applyInteractiveRule(Request{OID: "oid1"}))
+	a.Equal([]string{"dr-rule/general/svc-testService-ex-v3"}, fake.added)
+	a.Equal([]string{
+		"dr-rule/managed/svc-testService-ex",
+		"dr-rule/managed/svc-testService-ex-v1",
+		"dr-rule/general/svc-testService-ex-v2",
+	}, fake.deleted)
+
+	fake.deleted = nil
+	a.NoError(s.removeInteractiveRule(Request{OID: "oid1"}))
+	a.Equal([]string{"dr-rule/general/svc-testService-ex-v3"}, fake.deleted)
+	a.Equal(3, len(fake.rules["general"])+len(fake.rules["managed"]))
+}
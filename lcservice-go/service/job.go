@@ -96,6 +96,37 @@ func (j *Job) Narrate(message string, isImportant bool, attachments ...JobAttach
 	j.entries = append(j.entries, e)
 }
 
+// Apply a redaction function to all the text of the Job.
+func (j *Job) redact(f func(string) string) {
+	j.cause = f(j.cause)
+	for i := range j.entries {
+		e := &j.entries[i]
+		e.msg = f(e.msg)
+		for _, at := range e.attachments {
+			switch a := at.(type) {
+			case *hexDumpAttachment:
+				a.caption = f(a.caption)
+				if data, err := base64.StdEncoding.DecodeString(a.data); err == nil {
+					a.data = base64.StdEncoding.EncodeToString([]byte(f(string(data))))
+				}
+			case *yamlAttachment:
+				a.caption = f(a.caption)
+				a.data = f(a.data)
+			case *jsonAttachment:
+				a.caption = f(a.caption)
+				a.data = f(a.data)
+			case *tableAttachment:
+				a.caption = f(a.caption)
+				for _, row := range a.rows {
+					for k := range row {
+						row[k] = f(row[k])
+					}
+				}
+			}
+		}
+	}
+}
+
 func (j Job) ToJSON() map[string]interface{} {
 	d := map[string]interface{}{
 		"id":   j.id,
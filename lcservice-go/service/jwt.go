@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims of the JWT LimaCharlie sends with a request. The JWT
+// is decoded locally, its signature is not verified since the
+// request itself is authenticated with the SecretKey.
+type JWTClaims struct {
+	// ID and identity (like an email) of the user
+	// on whose behalf the request is made, if any.
+	UserID   string
+	Identity string
+	// Orgs the JWT is valid for.
+	OIDs []string
+	// Permissions granted, like "sensor.task".
+	Permissions []string
+	IssuedAt    time.Time
+	ExpiresAt   time.Time
+}
+
+type rawJWTClaims struct {
+	UserID      string      `json:"uid"`
+	Identity    string      `json:"ident"`
+	OID         interface{} `json:"oid"`
+	Permissions []string    `json:"perm"`
+	IssuedAt    int64       `json:"iat"`
+	ExpiresAt   int64       `json:"exp"`
+}
+
+// Decode the claims of a JWT.
+func ParseJWTClaims(token string) (JWTClaims, error) {
+	claims := JWTClaims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("malformed jwt")
+	}
+	// Tolerate padded encodings.
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+	raw := rawJWTClaims{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return claims, fmt.Errorf("malformed jwt claims: %v", err)
+	}
+	claims.UserID = raw.UserID
+	claims.Identity = raw.Identity
+	claims.Permissions = raw.Permissions
+	switch oid := raw.OID.(type) {
+	case string:
+		claims.OIDs = []string{oid}
+	case []interface{}:
+		for _, o := range oid {
+			s, ok := o.(string)
+			if !ok {
+				return claims, fmt.Errorf("malformed jwt oid")
+			}
+			claims.OIDs = append(claims.OIDs, s)
+		}
+	case nil:
+	default:
+		return claims, fmt.Errorf("malformed jwt oid")
+	}
+	if raw.IssuedAt != 0 {
+		claims.IssuedAt = time.Unix(raw.IssuedAt, 0)
+	}
+	if raw.ExpiresAt != 0 {
+		claims.ExpiresAt = time.Unix(raw.ExpiresAt, 0)
+	}
+	return claims, nil
+}
+
+func (c JWTClaims) IsExpired() bool {
+	return !c.ExpiresAt.IsZero() && !time.Now().Before(c.ExpiresAt)
+}
+
+// Whether the JWT is valid for the org, JWTs
+// not restricted to orgs are valid for all.
+func (c JWTClaims) IsValidForOrg(oid string) bool {
+	if len(c.OIDs) == 0 {
+		return true
+	}
+	for _, o := range c.OIDs {
+		if o == oid {
+			return true
+		}
+	}
+	return false
+}
+
+func (c JWTClaims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the claims of a request, rejecting expired
+// JWTs and JWTs meant for another org.
+func checkJWTClaims(claims JWTClaims, oid string) error {
+	if claims.IsExpired() {
+		return fmt.Errorf("jwt expired")
+	}
+	if oid != "" && !claims.IsValidForOrg(oid) {
+		return fmt.Errorf("jwt not valid for org %s", oid)
+	}
+	return nil
+}
+
+// Permissions required by default by the commands added by
+// the framework which change the org or expose its history.
+var DefaultCommandPermissions = map[CommandName][]string{
+	"set_config":    {"org.conf.set"},
+	"set_secret":    {"secret.set"},
+	"rotate_secret": {"secret.set"},
+	"delete_secret": {"secret.del"},
+	"get_audit_log": {"audit.get"},
+}
+
+// Permissions required by a command added by the framework, from
+// the Descriptor if overridden there.
+func (d Descriptor) commandPermissions(name CommandName) []string {
+	if perms, ok := d.CommandPermissions[name]; ok {
+		return perms
+	}
+	return DefaultCommandPermissions[name]
+}
+
+// Check the Request has the permissions required.
+func checkPermissions(r Request, permissions []string) error {
+	if len(permissions) == 0 {
+		return nil
+	}
+	if r.Claims == nil {
+		return fmt.Errorf("missing jwt, permissions required: %v", permissions)
+	}
+	missing := []string{}
+	for _, p := range permissions {
+		if !r.Claims.HasPermission(p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("missing permissions: %v", missing)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestJWT(claims Dict) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	b, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+	return header + "." + base64.RawURLEncoding.EncodeToString(b) + ".c2lnbmF0dXJl"
+}
+
+func TestJWTClaims(t *testing.T) {
+	a := assert.New(t)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims, err := ParseJWTClaims(makeTestJWT(Dict{
+		"uid":   "u1",
+		"ident": "user@example.com",
+		"oid":   []string{"o1", "o2"},
+		"perm":  []string{"sensor.get", "sensor.task"},
+		"exp":   exp,
+	}))
+	a.NoError(err)
+	a.Equal("u1", claims.UserID)
+	a.Equal("user@example.com", claims.Identity)
+	a.Equal([]string{"o1", "o2"}, claims.OIDs)
+	a.Equal(exp, claims.ExpiresAt.Unix())
+	a.False(claims.IsExpired())
+	a.True(claims.IsValidForOrg("o2"))
+	a.False(claims.IsValidForOrg("o3"))
+	a.True(claims.HasPermission("sensor.task"))
+	a.False(claims.HasPermission("org.del"))
+
+	claims, err = ParseJWTClaims(makeTestJWT(Dict{"oid": "o1"}))
+	a.NoError(err)
+	a.Equal([]string{"o1"}, claims.OIDs)
+	a.True(claims.ExpiresAt.IsZero())
+
+	_, err = ParseJWTClaims("not-a-jwt")
+	a.Error(err)
+	_, err = ParseJWTClaims("a.!!!.c")
+	a.Error(err)
+	_, err = ParseJWTClaims(makeTestJWT(Dict{"oid": 42}))
+	a.Error(err)
+}
+
+func TestCommandPermissions(t *testing.T) {
+	a := assert.New(t)
+	testOID1 := "8cbe27f4-bfa1-4afb-ba19-138cd51389cd"
+	testOID2 := "d3d17f12-eecf-4d3c-9a5d-ac2f13e5d0b2"
+
+	var seen *JWTClaims
+	s, err := NewService(Descriptor{
+		SecretKey: testSecretKey,
+		Commands: CommandsDescriptor{
+			Descriptors: []CommandDescriptor{
+				{
+					Name:                "isolate",
+					Description:         "isolate a sensor",
+					Args:                CommandParams{},
+					RequiredPermissions: []string{"sensor.task", "sensor.get"},
+					Handler: func(r Request) Response {
+						seen = r.Claims
+						return MakeSuccessResponse()
+					},
+				},
+				{
+					Name:        "status",
+					Description: "get the status",
+					Args:        CommandParams{},
+					Handler: func(r Request) Response {
+						seen = r.Claims
+						return MakeSuccessResponse()
+					},
+				},
+			},
+		},
+	})
+	a.NoError(err)
+
+	makeNamedCommand := func(name string, oid string, jwt string) Dict {
+		return makeRequest(lcRequest{
+			Version: 1,
+			OID:     oid,
+			JWT:     jwt,
+			Type:    "command",
+			Data: Dict{
+				"command_name": name,
+				"rid":          "123",
+				"cid":          "456",
+			},
+		})
+	}
+	makeCommand := func(oid string, jwt string) Dict {
+		return makeNamedCommand("isolate", oid, jwt)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// Permissions are required.
+	resp := s.ProcessCommand(makeCommand(testOID1, ""))
+	a.False(resp.IsSuccess)
+	a.Contains(resp.Error, "missing jwt")
+	resp = s.ProcessCommand(makeCommand(testOID1, makeTestJWT(Dict{"oid": testOID1, "exp": exp, "perm": []string{"sensor.get"}})))
+	a.False(resp.IsSuccess)
+	a.Equal("missing permissions: [sensor.task]", resp.Error)
+	a.Nil(seen)
+
+	// Expired and foreign JWTs are rejected.
+	perms := []string{"sensor.get", "sensor.task"}
+	resp = s.ProcessCommand(makeCommand(testOID1, makeTestJWT(Dict{"oid": testOID1, "exp": time.Now().Add(-time.Minute).Unix(), "perm": perms})))
+	a.False(resp.IsSuccess)
+	a.Equal("jwt expired", resp.Error)
+	resp = s.ProcessCommand(makeCommand(testOID1, makeTestJWT(Dict{"oid": testOID2, "exp": exp, "perm": perms})))
+	a.False(resp.IsSuccess)
+	a.Contains(resp.Error, "not valid for org")
+
+	// Tokens which cannot be decoded only lack claims.
+	resp = s.ProcessCommand(makeCommand(testOID1, "opaque-token"))
+	a.False(resp.IsSuccess)
+	a.Contains(resp.Error, "missing jwt")
+	resp = s.ProcessCommand(makeNamedCommand("status", testOID1, "opaque-token"))
+	a.True(resp.IsSuccess)
+	a.Nil(seen)
+
+	resp = s.ProcessCommand(makeCommand(testOID1, makeTestJWT(Dict{"oid": testOID1, "uid": "u1", "exp": exp, "perm": perms})))
+	a.True(resp.IsSuccess)
+	a.NotNil(seen)
+	a.Equal("u1", seen.UserID)
+
+	// The permissions are advertised.
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	a.ElementsMatch(perms, resp.Data["mtd"].(Dict)["commands"].(map[string]CommandDescriptor)["isolate"].RequiredPermissions)
+}
+
+// Lift the permissions of the commands added by the
+// framework, for the tests sending commands without a JWT.
+func noCommandPermissions() map[CommandName][]string {
+	perms := map[CommandName][]string{}
+	for name := range DefaultCommandPermissions {
+		perms[name] = nil
+	}
+	return perms
+}
+
+func TestFrameworkCommandPermissions(t *testing.T) {
+	a := assert.New(t)
+
+	desc := func(perms map[CommandName][]string) Descriptor {
+		return Descriptor{
+			SecretKey:          testSecretKey,
+			SecretsMasterKey:   "master",
+			ConfigSchema:       RequestParams{"mode": {Type: RequestParamTypes.String, Description: "mode"}},
+			Audit:              &AuditConfig{},
+			CommandPermissions: perms,
+		}
+	}
+	s, err := NewService(desc(nil))
+	a.NoError(err)
+	for name, perms := range DefaultCommandPermissions {
+		resp := s.ProcessCommand(makeConfigCommand("o1", name, Dict{"name": "n", "value": "v"}))
+		a.False(resp.IsSuccess, name)
+		a.Equal(fmt.Sprintf("missing jwt, permissions required: %v", perms), resp.Error, name)
+	}
+	// Commands only reading the configuration are left open.
+	a.True(s.ProcessCommand(makeConfigCommand("o1", "get_config", nil)).IsSuccess)
+
+	// The defaults can be overridden or removed.
+	s, err = NewService(desc(map[CommandName][]string{
+		"set_secret":    {"service.admin"},
+		"get_audit_log": {},
+	}))
+	a.NoError(err)
+	resp := s.ProcessCommand(makeConfigCommand("o1", "set_secret", Dict{"name": "n", "value": "v"}))
+	a.Equal("missing jwt, permissions required: [service.admin]", resp.Error)
+	a.True(s.ProcessCommand(makeConfigCommand("o1", "get_audit_log", nil)).IsSuccess)
+	resp = s.ProcessCommand(makeConfigCommand("o1", "delete_secret", Dict{"name": "n"}))
+	a.Equal("missing jwt, permissions required: [secret.del]", resp.Error)
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Limits of the number of calls processed at the same time.
+// Requests over the limits are shed with a retriable Response,
+// the health requests are always served.
+type ConcurrencyLimits struct {
+	// Maximum number of calls in progress, 0 for no limit.
+	MaxCalls int
+	// Maximum number of calls in progress per request type,
+	// like "sensor_per_1h" or "command", 0 for no limit.
+	MaxCallsPerType map[string]int
+}
+
+func (l ConcurrencyLimits) isEnabled() bool {
+	return l.MaxCalls != 0 || len(l.MaxCallsPerType) != 0
+}
+
+func (l ConcurrencyLimits) isValid() error {
+	if l.MaxCalls < 0 {
+		return fmt.Errorf("max calls must not be negative")
+	}
+	for t, n := range l.MaxCallsPerType {
+		if n < 0 {
+			return fmt.Errorf("max calls of '%s' must not be negative", t)
+		}
+	}
+	return nil
+}
+
+type loadShedder struct {
+	limits ConcurrencyLimits
+
+	sync.Mutex
+	nCalls       int
+	nCallsByType map[string]int
+	nShed        uint64
+	nShedByType  map[string]uint64
+}
+
+func newLoadShedder(limits ConcurrencyLimits) *loadShedder {
+	return &loadShedder{
+		limits:       limits,
+		nCallsByType: map[string]int{},
+		nShedByType:  map[string]uint64{},
+	}
+}
+
+// Try to start a call of the given type, returning
+// false if it must be shed.
+func (l *loadShedder) acquire(reqType string) bool {
+	l.Lock()
+	defer l.Unlock()
+	maxOfType := l.limits.MaxCallsPerType[reqType]
+	if (l.limits.MaxCalls != 0 && l.nCalls >= l.limits.MaxCalls) ||
+		(maxOfType != 0 && l.nCallsByType[reqType] >= maxOfType) {
+		l.nShed++
+		l.nShedByType[reqType]++
+		return false
+	}
+	l.nCalls++
+	l.nCallsByType[reqType]++
+	return true
+}
+
+func (l *loadShedder) release(reqType string) {
+	l.Lock()
+	defer l.Unlock()
+	l.nCalls--
+	if l.nCallsByType[reqType]--; l.nCallsByType[reqType] == 0 {
+		delete(l.nCallsByType, reqType)
+	}
+}
+
+func (l *loadShedder) getHealthMetadata() interface{} {
+	l.Lock()
+	defer l.Unlock()
+	inProgress := Dict{}
+	for t, n := range l.nCallsByType {
+		inProgress[t] = n
+	}
+	shed := Dict{}
+	for t, n := range l.nShedByType {
+		shed[t] = n
+	}
+	return Dict{
+		"in_progress":         l.nCalls,
+		"in_progress_by_type": inProgress,
+		"shed":                l.nShed,
+		"shed_by_type":        shed,
+	}
+}
+
+func newOverloadedResponse(reqType string) Response {
+	resp := NewRetriableResponse(fmt.Errorf("service overloaded, '%s' request shed", reqType))
+	resp.IsOverloaded = true
+	return resp
+}
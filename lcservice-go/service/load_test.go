@@ -0,0 +1,80 @@
+package service
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadShedding(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := NewService(Descriptor{
+		SecretKey:   testSecretKey,
+		Concurrency: ConcurrencyLimits{MaxCalls: -1},
+	})
+	a.Error(err)
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	blocking := func(r Request) Response {
+		started <- struct{}{}
+		<-release
+		return MakeSuccessResponse()
+	}
+	s, err := NewService(Descriptor{
+		SecretKey: testSecretKey,
+		Concurrency: ConcurrencyLimits{
+			MaxCalls:        3,
+			MaxCallsPerType: map[string]int{"sensor_per_1h": 1},
+		},
+		Callbacks: DescriptorCallbacks{
+			OnSensorPer1H: blocking,
+			OnSensorPer3H: blocking,
+		},
+	})
+	a.NoError(err)
+
+	makeSensorRequest := func(reqType string) Dict {
+		return makeRequest(lcRequest{Version: 1, OID: "o1", Type: reqType, Data: Dict{"sid": "s1"}})
+	}
+	wg := sync.WaitGroup{}
+	start := func(reqType string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.True(s.ProcessRequest(makeSensorRequest(reqType)).IsSuccess)
+		}()
+		<-started
+	}
+
+	// Per type limit.
+	start("sensor_per_1h")
+	resp := s.ProcessRequest(makeSensorRequest("sensor_per_1h"))
+	a.False(resp.IsSuccess)
+	a.True(resp.IsRetriable)
+	a.True(resp.IsOverloaded)
+
+	// Global limit.
+	start("sensor_per_3h")
+	start("sensor_per_3h")
+	resp = s.ProcessRequest(makeSensorRequest("sensor_per_3h"))
+	a.True(resp.IsOverloaded)
+
+	// Health is always served and reports the load.
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	a.Equal(Dict{
+		"in_progress":         3,
+		"in_progress_by_type": Dict{"sensor_per_1h": 1, "sensor_per_3h": 2},
+		"shed":                uint64(2),
+		"shed_by_type":        Dict{"sensor_per_1h": uint64(1), "sensor_per_3h": uint64(1)},
+	}, resp.Data["mtd"].(Dict)["load"])
+
+	close(release)
+	wg.Wait()
+	resp = s.ProcessRequest(makeSensorRequest("sensor_per_1h"))
+	a.False(resp.IsOverloaded)
+	a.Equal(0, s.shedder.getHealthMetadata().(Dict)["in_progress"])
+}
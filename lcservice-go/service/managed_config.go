@@ -0,0 +1,300 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Hive holding lookups.
+	lookupHiveName = "lookup"
+)
+
+// Org configuration declared by a service. The framework installs it
+// when an org installs the service, reconciles it every hour and
+// removes it when the org uninstalls the service.
+type ManagedConfig struct {
+	// D&R rules, keyed by name.
+	DRRules map[string]lc.CoreDRRule
+	// False positive rules, keyed by name.
+	FPRules map[string]lc.OrgSyncFPRule
+	// Outputs, keyed by name.
+	Outputs map[string]lc.OutputConfig
+	// Lookups, keyed by name, containing the lookup data.
+	Lookups map[string]Dict
+
+	// Optional generator of org-specific configuration,
+	// merged on top of the configuration above.
+	PerOrg func(oid string) (ManagedConfig, error)
+}
+
+// Subset of the SDK used to manage org configuration.
+type orgConfigClient interface {
+	SyncPush(conf lc.OrgConfig, options lc.SyncOptions) ([]lc.OrgSyncOperation, error)
+	DRRules(filters ...lc.DRRuleFilter) (map[string]lc.Dict, error)
+	DRRuleAdd(name string, detection interface{}, response interface{}, opt ...lc.NewDRRuleOptions) error
+	DRRuleDelete(name string, filters ...lc.DRRuleFilter) error
+	FPRuleDelete(name lc.FPRuleName) error
+	OutputDel(name string) (lc.GenericJSON, error)
+	LookupDelete(name string) error
+}
+
+type sdkOrgConfigClient struct {
+	*lc.Organization
+}
+
+func newOrgConfigClient(r Request) (orgConfigClient, error) {
+	if r.Org == nil {
+		return nil, fmt.Errorf("no org to manage configuration of")
+	}
+	return sdkOrgConfigClient{r.Org}, nil
+}
+
+func (o sdkOrgConfigClient) LookupDelete(name string) error {
+	_, err := lc.NewHiveClient(o.Organization).Remove(lc.HiveArgs{
+		HiveName:     lookupHiveName,
+		PartitionKey: o.GetOID(),
+		Key:          name,
+	})
+	return err
+}
+
+type managedConfigManager struct {
+	cs   *CoreService
+	conf ManagedConfig
+
+	// Builds the client used to manage an org.
+	getClient func(r Request) (orgConfigClient, error)
+
+	// Drift detected during the last reconcile of each org.
+	driftMutex    sync.Mutex
+	drift         map[string][]string
+	lastReconcile int64
+}
+
+func newManagedConfigManager(cs *CoreService, conf ManagedConfig) *managedConfigManager {
+	return &managedConfigManager{
+		cs:        cs,
+		conf:      conf,
+		getClient: cs.orgConfigClient,
+		drift:     map[string][]string{},
+	}
+}
+
+func (m *managedConfigManager) install() {
+	m.cs.interceptCallback("org_install", m.onOrgInstall)
+	m.cs.interceptCallback("org_per_1h", m.onOrgPer1H)
+	m.cs.interceptCallback("org_uninstall", m.onOrgUninstall)
+	m.cs.addHealthMetadata("managed_config", m.getHealthMetadata)
+}
+
+// Generate the configuration for a specific org.
+func (m *managedConfigManager) getConfig(oid string) (ManagedConfig, error) {
+	conf := ManagedConfig{
+		DRRules: map[string]lc.CoreDRRule{},
+		FPRules: map[string]lc.OrgSyncFPRule{},
+		Outputs: map[string]lc.OutputConfig{},
+		Lookups: map[string]Dict{},
+	}
+	layers := []ManagedConfig{m.conf}
+	if m.conf.PerOrg != nil {
+		perOrg, err := m.conf.PerOrg(oid)
+		if err != nil {
+			return conf, err
+		}
+		layers = append(layers, perOrg)
+	}
+	for _, l := range layers {
+		for k, v := range l.DRRules {
+			conf.DRRules[k] = v
+		}
+		for k, v := range l.FPRules {
+			conf.FPRules[k] = v
+		}
+		for k, v := range l.Outputs {
+			v.Name = k
+			conf.Outputs[k] = v
+		}
+		for k, v := range l.Lookups {
+			conf.Lookups[k] = v
+		}
+	}
+	return conf, nil
+}
+
+func (m *managedConfigManager) toOrgConfig(conf ManagedConfig) (lc.OrgConfig, lc.SyncOptions) {
+	orgConf := lc.OrgConfig{
+		Version: lc.OrgConfigLatestVersion,
+		DRRules: conf.DRRules,
+		FPRules: conf.FPRules,
+		Outputs: conf.Outputs,
+	}
+	opts := lc.SyncOptions{
+		SyncDRRules: len(conf.DRRules) != 0,
+		SyncFPRules: len(conf.FPRules) != 0,
+		SyncOutputs: len(conf.Outputs) != 0,
+	}
+	if len(conf.Lookups) != 0 {
+		lookups := map[lc.HiveKey]lc.SyncHiveData{}
+		for name, data := range conf.Lookups {
+			lookups[name] = lc.SyncHiveData{
+				Data: Dict{
+					"lookup_data": data,
+				},
+				UsrMtd: lc.UsrMtd{
+					Enabled: true,
+				},
+			}
+		}
+		orgConf.Hives = map[lc.HiveName]map[lc.HiveKey]lc.SyncHiveData{
+			lookupHiveName: lookups,
+		}
+		opts.SyncHives = map[string]bool{
+			lookupHiveName: true,
+		}
+	}
+	return orgConf, opts
+}
+
+// Push the configuration to an org, without removing anything
+// not declared. Returns the elements that had drifted.
+func (m *managedConfigManager) apply(r Request) ([]string, error) {
+	client, err := m.getClient(r)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := m.getConfig(r.OID)
+	if err != nil {
+		return nil, err
+	}
+	orgConf, opts := m.toOrgConfig(conf)
+
+	// A dry run first tells us what drifted.
+	opts.IsDryRun = true
+	ops, err := client.SyncPush(orgConf, opts)
+	if err != nil {
+		return nil, err
+	}
+	drift := []string{}
+	for _, op := range ops {
+		if op.IsAdded || op.IsRemoved {
+			drift = append(drift, fmt.Sprintf("%s/%s", op.ElementType, op.ElementName))
+		}
+	}
+	sort.Strings(drift)
+	if len(drift) == 0 {
+		return drift, nil
+	}
+
+	opts.IsDryRun = false
+	if _, err := client.SyncPush(orgConf, opts); err != nil {
+		return drift, err
+	}
+	return drift, nil
+}
+
+// Remove all the declared configuration from an org.
+func (m *managedConfigManager) remove(r Request) error {
+	client, err := m.getClient(r)
+	if err != nil {
+		return err
+	}
+	conf, err := m.getConfig(r.OID)
+	if err != nil {
+		return err
+	}
+	errs := []string{}
+	for name, rule := range conf.DRRules {
+		namespace := rule.Namespace
+		if namespace == "" {
+			namespace = "general"
+		}
+		if err := client.DRRuleDelete(name, lc.WithNamespace(namespace)); err != nil {
+			errs = append(errs, fmt.Sprintf("dr-rule/%s: %v", name, err))
+		}
+	}
+	for name := range conf.FPRules {
+		if err := client.FPRuleDelete(name); err != nil {
+			errs = append(errs, fmt.Sprintf("fp-rule/%s: %v", name, err))
+		}
+	}
+	for name := range conf.Outputs {
+		if _, err := client.OutputDel(name); err != nil {
+			errs = append(errs, fmt.Sprintf("output/%s: %v", name, err))
+		}
+	}
+	for name := range conf.Lookups {
+		if err := client.LookupDelete(name); err != nil {
+			errs = append(errs, fmt.Sprintf("lookup/%s: %v", name, err))
+		}
+	}
+	m.setDrift(r.OID, nil)
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("failed to remove configuration: %v", errs)
+	}
+	return nil
+}
+
+func (m *managedConfigManager) setDrift(oid string, drift []string) {
+	m.driftMutex.Lock()
+	defer m.driftMutex.Unlock()
+	if len(drift) == 0 {
+		delete(m.drift, oid)
+		return
+	}
+	m.drift[oid] = drift
+}
+
+func (m *managedConfigManager) onOrgInstall(r Request, next ServiceCallback) Response {
+	if _, err := m.apply(r); err != nil {
+		m.cs.Error(fmt.Sprintf("onOrgInstall.applyManagedConfig: %v", err))
+		return NewRetriableResponse(err)
+	}
+	return callNext(next, r)
+}
+
+func (m *managedConfigManager) onOrgPer1H(r Request, next ServiceCallback) Response {
+	drift, err := m.apply(r)
+	if err != nil {
+		m.cs.Error(fmt.Sprintf("onOrgPer1H.applyManagedConfig: %v", err))
+	} else {
+		m.driftMutex.Lock()
+		m.lastReconcile = time.Now().Unix()
+		m.driftMutex.Unlock()
+		if len(drift) != 0 {
+			m.cs.Warn(fmt.Sprintf("managed config drifted in %s: %v", r.OID, drift))
+		}
+		m.setDrift(r.OID, drift)
+	}
+	return callNext(next, r)
+}
+
+func (m *managedConfigManager) onOrgUninstall(r Request, next ServiceCallback) Response {
+	if err := m.remove(r); err != nil {
+		m.cs.Error(fmt.Sprintf("onOrgUninstall.removeManagedConfig: %v", err))
+	}
+	return callNext(next, r)
+}
+
+func (m *managedConfigManager) getHealthMetadata() interface{} {
+	m.driftMutex.Lock()
+	defer m.driftMutex.Unlock()
+	drift := Dict{}
+	for oid, d := range m.drift {
+		drift[oid] = d
+	}
+	return Dict{
+		"dr_rules":       len(m.conf.DRRules),
+		"fp_rules":       len(m.conf.FPRules),
+		"outputs":        len(m.conf.Outputs),
+		"lookups":        len(m.conf.Lookups),
+		"is_per_org":     m.conf.PerOrg != nil,
+		"last_reconcile": m.lastReconcile,
+		"drift":          drift,
+	}
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOrgConfigClient struct {
+	pushes  []lc.SyncOptions
+	configs []lc.OrgConfig
+	drift   []lc.OrgSyncOperation
+	added   []string
+	deleted []string
+	err     error
+
+	// Existing D&R rules by namespace.
+	rules map[string]map[string]lc.Dict
+}
+
+func (f *fakeOrgConfigClient) SyncPush(conf lc.OrgConfig, options lc.SyncOptions) ([]lc.OrgSyncOperation, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.pushes = append(f.pushes, options)
+	f.configs = append(f.configs, conf)
+	if options.IsDryRun {
+		return f.drift, nil
+	}
+	f.drift = nil
+	return nil, nil
+}
+
+func (f *fakeOrgConfigClient) DRRules(filters ...lc.DRRuleFilter) (map[string]lc.Dict, error) {
+	args := map[string]string{}
+	for _, filter := range filters {
+		filter(args)
+	}
+	rules := map[string]lc.Dict{}
+	for name, rule := range f.rules[args["namespace"]] {
+		rules[name] = rule
+	}
+	return rules, nil
+}
+
+func (f *fakeOrgConfigClient) DRRuleAdd(name string, detection interface{}, response interface{}, opt ...lc.NewDRRuleOptions) error {
+	if f.err != nil {
+		return f.err
+	}
+	opts := lc.NewDRRuleOptions{IsEnabled: true}
+	if len(opt) != 0 {
+		opts = opt[0]
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = "general"
+	}
+	// Rules go through JSON like they would with the API.
+	data, err := json.Marshal(lc.Dict{
+		"detect":     detection,
+		"respond":    response,
+		"is_enabled": opts.IsEnabled,
+	})
+	if err != nil {
+		return err
+	}
+	rule := lc.Dict{}
+	if err := json.Unmarshal(data, &rule); err != nil {
+		return err
+	}
+	if f.rules == nil {
+		f.rules = map[string]map[string]lc.Dict{}
+	}
+	if f.rules[opts.Namespace] == nil {
+		f.rules[opts.Namespace] = map[string]lc.Dict{}
+	}
+	f.rules[opts.Namespace][name] = rule
+	f.added = append(f.added, fmt.Sprintf("dr-rule/%s/%s", opts.Namespace, name))
+	return nil
+}
+
+func (f *fakeOrgConfigClient) DRRuleDelete(name string, filters ...lc.DRRuleFilter) error {
+	args := map[string]string{}
+	for _, filter := range filters {
+		filter(args)
+	}
+	delete(f.rules[args["namespace"]], name)
+	f.deleted = append(f.deleted, fmt.Sprintf("dr-rule/%s/%s", args["namespace"], name))
+	return nil
+}
+
+func (f *fakeOrgConfigClient) FPRuleDelete(name lc.FPRuleName) error {
+	f.deleted = append(f.deleted, fmt.Sprintf("fp-rule/%s", name))
+	return nil
+}
+
+func (f *fakeOrgConfigClient) OutputDel(name string) (lc.GenericJSON, error) {
+	f.deleted = append(f.deleted, fmt.Sprintf("output/%s", name))
+	return nil, nil
+}
+
+func (f *fakeOrgConfigClient) LookupDelete(name string) error {
+	f.deleted = append(f.deleted, fmt.Sprintf("lookup/%s", name))
+	return nil
+}
+
+func TestManagedConfig(t *testing.T) {
+	a := assert.New(t)
+	nCalls := 0
+	s, err := NewService(Descriptor{
+		SecretKey:   testSecretKey,
+		Log:         func(m string) { fmt.Println(m) },
+		LogCritical: func(m string) { fmt.Println(m) },
+		Callbacks: DescriptorCallbacks{
+			OnOrgInstall: func(r Request) Response {
+				nCalls++
+				return MakeSuccessResponse()
+			},
+		},
+		ManagedConfig: &ManagedConfig{
+			DRRules: map[string]lc.CoreDRRule{
+				"r1": {
+					Namespace: "managed",
+					Detect:    Dict{"op": "is", "path": "event/X", "value": 1},
+					Response:  lc.List{Dict{"action": "report", "name": "r1"}},
+				},
+			},
+			FPRules: map[string]lc.OrgSyncFPRule{
+				"fp1": {Detection: Dict{"op": "is", "path": "cat", "value": "r1"}},
+			},
+			Lookups: map[string]Dict{
+				"l1": {"evil.com": Dict{}},
+			},
+			PerOrg: func(oid string) (ManagedConfig, error) {
+				return ManagedConfig{
+					Outputs: map[string]lc.OutputConfig{
+						"o1": {Module: "s3", Type: "detect", Bucket: oid},
+					},
+				}, nil
+			},
+		},
+	})
+	a.NoError(err)
+	fake := &fakeOrgConfigClient{}
+	s.managedConfig.getClient = func(r Request) (orgConfigClient, error) {
+		return fake, nil
+	}
+
+	// Install applies the configuration and calls the original callback.
+	fake.drift = []lc.OrgSyncOperation{{ElementType: lc.OrgSyncOperationElementType.DRRule, ElementName: "r1", IsAdded: true}}
+	resp := s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o", Type: "org_install", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	a.Equal(1, nCalls)
+	a.Equal(2, len(fake.pushes))
+	a.True(fake.pushes[0].IsDryRun)
+	a.False(fake.pushes[1].IsDryRun)
+	a.True(fake.pushes[1].SyncDRRules)
+	a.True(fake.pushes[1].SyncFPRules)
+	a.True(fake.pushes[1].SyncOutputs)
+	a.True(fake.pushes[1].SyncHives[lookupHiveName])
+	a.Equal("o", fake.configs[1].Outputs["o1"].Bucket)
+	a.Equal("o1", fake.configs[1].Outputs["o1"].Name)
+	a.Contains(fake.configs[1].Hives[lookupHiveName], "l1")
+
+	// A reconcile without drift only does a dry run.
+	fake.pushes = nil
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o", Type: "org_per_1h", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(fake.pushes))
+	a.Equal(Dict{}, s.managedConfig.getHealthMetadata().(Dict)["drift"])
+
+	// Drift is fixed and reported in health.
+	fake.pushes = nil
+	fake.drift = []lc.OrgSyncOperation{{ElementType: lc.OrgSyncOperationElementType.Output, ElementName: "o1", IsAdded: true}}
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o", Type: "org_per_1h", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	a.Equal(2, len(fake.pushes))
+	a.Equal(Dict{"o": []string{"output/o1"}}, s.managedConfig.getHealthMetadata().(Dict)["drift"])
+
+	// Failing to apply on install is retriable.
+	fake.err = fmt.Errorf("boom")
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o", Type: "org_install", Data: Dict{}}))
+	a.False(resp.IsSuccess)
+	a.True(resp.IsRetriable)
+	a.Equal(1, nCalls)
+	fake.err = nil
+
+	// Uninstall removes everything, even without an original callback.
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o", Type: "org_uninstall", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	sort.Strings(fake.deleted)
+	a.Equal([]string{"dr-rule/managed/r1", "fp-rule/fp1", "lookup/l1", "output/o1"}, fake.deleted)
+	a.Equal(Dict{}, s.managedConfig.getHealthMetadata().(Dict)["drift"])
+}
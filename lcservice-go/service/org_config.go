@@ -0,0 +1,477 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Prefix of the keys of per-org configurations.
+	configStorePrefix = "config/"
+)
+
+// A secret value of a configuration as stored,
+// encrypted like the secrets of the SecretStore.
+type encryptedConfigValue struct {
+	Encrypted string `json:"encrypted"`
+}
+
+// Configuration of an org, following the Descriptor's ConfigSchema.
+// Values not set by the org have their default from the schema.
+type Config struct {
+	values Dict
+	schema RequestParams
+}
+
+func (c Config) Get(key string) (interface{}, error) {
+	if _, ok := c.schema[key]; !ok {
+		return nil, fmt.Errorf("key '%s' is not in the config schema", key)
+	}
+	v, ok := c.values[key]
+	if !ok || v == nil {
+		return nil, fmt.Errorf("key '%s' not set", key)
+	}
+	return v, nil
+}
+
+func (c Config) GetString(key string) (string, error) {
+	v, err := c.Get(key)
+	if err != nil {
+		return "", err
+	}
+	value, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("key '%s' is not a string", key)
+	}
+	return value, nil
+}
+
+func (c Config) GetInt(key string) (int, error) {
+	v, err := c.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("key '%s' is not an integer", key)
+	}
+	return value, nil
+}
+
+func (c Config) GetBool(key string) (bool, error) {
+	v, err := c.Get(key)
+	if err != nil {
+		return false, err
+	}
+	value, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("key '%s' is not a boolean", key)
+	}
+	return value, nil
+}
+
+func (c Config) GetUUID(key string) (uuid.UUID, error) {
+	strValue, err := c.GetString(key)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	uuidValue, err := uuid.Parse(strValue)
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("could not parse uuid from key '%s'", key)
+	}
+	return uuidValue, nil
+}
+
+// All the values of the configuration, including defaults.
+func (c Config) Values() Dict {
+	values := Dict{}
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+// Convert a value to the type of its parameter definition.
+func normalizeParamValue(key string, def RequestParamDef, value interface{}) (interface{}, error) {
+	switch def.Type {
+	case RequestParamTypes.String:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("key '%s' is not a string", key)
+		}
+		return s, nil
+	case RequestParamTypes.Enum:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("key '%s' is not a string", key)
+		}
+		for _, v := range def.Values {
+			if v == s {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("value '%s' is not a valid enum value for key '%s'", s, key)
+	case RequestParamTypes.Int:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case int64:
+			return int(v), nil
+		case float64:
+			if v != float64(int(v)) {
+				return nil, fmt.Errorf("key '%s' is not an integer", key)
+			}
+			return int(v), nil
+		case string:
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("key '%s' is not an integer", key)
+			}
+			return i, nil
+		}
+		return nil, fmt.Errorf("key '%s' is not an integer", key)
+	case RequestParamTypes.Bool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("key '%s' is not a boolean", key)
+			}
+			return b, nil
+		}
+		return nil, fmt.Errorf("key '%s' is not a boolean", key)
+	case RequestParamTypes.UUID, RequestParamTypes.SID:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("key '%s' is not a string", key)
+		}
+		if _, err := uuid.Parse(s); err != nil {
+			return nil, fmt.Errorf("could not parse uuid from key '%s'", key)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("key '%s' has unsupported type '%s'", key, def.Type)
+}
+
+func configSchemaIsValid(schema RequestParams, isEncryptionAvailable bool) error {
+	if err := requestParamsIsValid(schema); err != nil {
+		return err
+	}
+	for key, def := range schema {
+		if def.IsSecret && !isEncryptionAvailable {
+			return fmt.Errorf("key '%s' is secret, a SecretsMasterKey is required", key)
+		}
+		// The schema is published in health.
+		if def.IsSecret && def.Default != nil {
+			return fmt.Errorf("key '%s' is secret and cannot have a default", key)
+		}
+	}
+	for key, def := range schema {
+		if def.Default == nil {
+			continue
+		}
+		if _, err := normalizeParamValue(key, def, def.Default); err != nil {
+			return fmt.Errorf("invalid default: %v", err)
+		}
+	}
+	return nil
+}
+
+type orgConfigManager struct {
+	cs     *CoreService
+	schema RequestParams
+}
+
+func newOrgConfigManager(cs *CoreService) *orgConfigManager {
+	return &orgConfigManager{
+		cs:     cs,
+		schema: cs.desc.ConfigSchema,
+	}
+}
+
+func (m *orgConfigManager) install() error {
+	args := CommandParams{}
+	for k, def := range m.schema {
+		// All values are optional when setting, only the
+		// resulting configuration must be complete.
+		def.IsRequired = false
+		args[k] = def
+	}
+	for _, cmd := range []CommandDescriptor{
+		{
+			Name:        "get_config",
+			Description: "Get the configuration of the service for this org.",
+			Args:        CommandParams{},
+			Handler:     m.cmdGetConfig,
+		},
+		{
+			Name:                "set_config",
+			Description:         "Set values of the configuration of the service for this org.",
+			Args:                args,
+			Handler:             m.cmdSetConfig,
+			RequiredPermissions: m.cs.desc.commandPermissions("set_config"),
+		},
+		{
+			Name:        "validate_config",
+			Description: "Validate values of the configuration of the service without setting them.",
+			Args:        args,
+			Handler:     m.cmdValidateConfig,
+		},
+	} {
+		if err := m.cs.desc.addCommand(cmd); err != nil {
+			return err
+		}
+	}
+	m.cs.interceptCallback("org_install", m.onOrgInstall)
+	m.cs.interceptCallback("org_uninstall", m.onOrgUninstall)
+	m.cs.addHealthMetadata("config_schema", func() interface{} {
+		return m.schema
+	})
+	return nil
+}
+
+func configKey(oid string) string {
+	return fmt.Sprintf("%s%s", configStorePrefix, oid)
+}
+
+// Name under which the secret values are encrypted, never
+// matching a secret of the SecretStore which has no "/".
+func configSecretName(key string) string {
+	return fmt.Sprintf("%s%s", configStorePrefix, key)
+}
+
+func (m *orgConfigManager) encryptValue(oid string, key string, value interface{}) (encryptedConfigValue, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return encryptedConfigValue{}, err
+	}
+	encrypted, err := m.cs.secrets.encrypt(oid, configSecretName(key), string(plain))
+	if err != nil {
+		return encryptedConfigValue{}, err
+	}
+	return encryptedConfigValue{Encrypted: encrypted}, nil
+}
+
+// Decrypt a secret value as stored, values stored in
+// plaintext by older versions are returned as is.
+func (m *orgConfigManager) decryptValue(oid string, key string, value interface{}) (interface{}, error) {
+	stored, ok := value.(map[string]interface{})
+	if !ok {
+		return value, nil
+	}
+	encrypted, ok := stored["encrypted"].(string)
+	if !ok {
+		return nil, fmt.Errorf("malformed secret value of key '%s'", key)
+	}
+	plain, err := m.cs.secrets.decrypt(oid, configSecretName(key), encrypted)
+	if err != nil {
+		return nil, err
+	}
+	var decrypted interface{}
+	if err := json.Unmarshal([]byte(plain), &decrypted); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// Redact the secret values from the logs and Jobs of the service.
+func (m *orgConfigManager) addRedacted(oid string, key string, value interface{}) {
+	if s, ok := value.(string); ok && m.schema[key].IsSecret {
+		m.cs.redactor.add(oid, configSecretName(key), s)
+	}
+}
+
+// The values of a configuration to return to the
+// org, without the secret values.
+func (m *orgConfigManager) redactedValues(c Config) Dict {
+	values := c.Values()
+	for k := range values {
+		if m.schema[k].IsSecret {
+			values[k] = redactedValue
+		}
+	}
+	return values
+}
+
+// Get the values set by an org, without defaults.
+func (m *orgConfigManager) loadValues(oid string) (Dict, error) {
+	values := Dict{}
+	data, isFound, err := m.cs.desc.StateStore.Get(configKey(oid))
+	if err != nil || !isFound {
+		return values, err
+	}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	// Numbers come back as float64 from JSON.
+	for k, v := range values {
+		def, ok := m.schema[k]
+		if !ok {
+			// Dropped from the schema.
+			delete(values, k)
+			continue
+		}
+		if def.IsSecret {
+			if v, err = m.decryptValue(oid, k, v); err != nil {
+				return nil, err
+			}
+		}
+		if values[k], err = normalizeParamValue(k, def, v); err != nil {
+			return nil, err
+		}
+		m.addRedacted(oid, k, values[k])
+	}
+	return values, nil
+}
+
+func (m *orgConfigManager) saveValues(oid string, values Dict) error {
+	stored := Dict{}
+	for k, v := range values {
+		if !m.schema[k].IsSecret {
+			stored[k] = v
+			continue
+		}
+		encrypted, err := m.encryptValue(oid, k, v)
+		if err != nil {
+			return err
+		}
+		stored[k] = encrypted
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return m.cs.desc.StateStore.Set(configKey(oid), data, 0)
+}
+
+// Get the configuration of an org, with defaults.
+func (m *orgConfigManager) get(oid string) (Config, error) {
+	values, err := m.loadValues(oid)
+	if err != nil {
+		return Config{}, err
+	}
+	return m.withDefaults(values), nil
+}
+
+func (m *orgConfigManager) withDefaults(values Dict) Config {
+	c := Config{
+		values: Dict{},
+		schema: m.schema,
+	}
+	for k, def := range m.schema {
+		if def.Default == nil {
+			continue
+		}
+		if v, err := normalizeParamValue(k, def, def.Default); err == nil {
+			c.values[k] = v
+		}
+	}
+	for k, v := range values {
+		c.values[k] = v
+	}
+	return c
+}
+
+// Merge new values into the current values of an org, returning
+// the values to store and the resulting configuration.
+func (m *orgConfigManager) merge(oid string, update Dict) (Dict, Config, error) {
+	values, err := m.loadValues(oid)
+	if err != nil {
+		return nil, Config{}, err
+	}
+	errs := []string{}
+	for k, v := range update {
+		def, ok := m.schema[k]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("key '%s' is not in the config schema", k))
+			continue
+		}
+		normalized, err := normalizeParamValue(k, def, v)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		values[k] = normalized
+		m.addRedacted(oid, k, normalized)
+	}
+	c := m.withDefaults(values)
+	for k, def := range m.schema {
+		if _, ok := c.values[k]; def.IsRequired && !ok {
+			errs = append(errs, fmt.Sprintf("key '%s' is required", k))
+		}
+	}
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return nil, c, fmt.Errorf("invalid config: %v", errs)
+	}
+	return values, c, nil
+}
+
+// Extract the values of the schema from the data of a request.
+func (m *orgConfigManager) valuesFromRequest(r Request) Dict {
+	update := Dict{}
+	for k := range m.schema {
+		if v, ok := r.Event.Data[k]; ok {
+			update[k] = v
+		}
+	}
+	return update
+}
+
+func (m *orgConfigManager) cmdGetConfig(r Request) Response {
+	return MakeSuccessResponse(Dict{
+		"config": m.redactedValues(r.Config),
+	})
+}
+
+func (m *orgConfigManager) cmdSetConfig(r Request) Response {
+	values, c, err := m.merge(r.OID, m.valuesFromRequest(r))
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+	if err := m.saveValues(r.OID, values); err != nil {
+		return NewRetriableResponse(err)
+	}
+	return MakeSuccessResponse(Dict{
+		"config": m.redactedValues(c),
+	})
+}
+
+func (m *orgConfigManager) cmdValidateConfig(r Request) Response {
+	if _, _, err := m.merge(r.OID, m.valuesFromRequest(r)); err != nil {
+		return NewErrorResponse(err)
+	}
+	return MakeSuccessResponse()
+}
+
+// Options provided when installing the service are set
+// as the initial configuration of the org.
+func (m *orgConfigManager) onOrgInstall(r Request, next ServiceCallback) Response {
+	update := m.valuesFromRequest(r)
+	if len(update) != 0 {
+		values, c, err := m.merge(r.OID, update)
+		if err != nil {
+			return NewErrorResponse(err)
+		}
+		if err := m.saveValues(r.OID, values); err != nil {
+			return NewRetriableResponse(err)
+		}
+		r.Config = c
+	}
+	return callNext(next, r)
+}
+
+func (m *orgConfigManager) onOrgUninstall(r Request, next ServiceCallback) Response {
+	resp := callNext(next, r)
+	if err := m.cs.desc.StateStore.Delete(configKey(r.OID)); err != nil {
+		m.cs.Error(fmt.Sprintf("onOrgUninstall.deleteConfig: %v", err))
+	}
+	m.cs.redactor.removeOrg(r.OID)
+	return resp
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeConfigCommand(oid string, name string, args Dict) Dict {
+	data := Dict{
+		"command_name": name,
+		"rid":          "123",
+		"cid":          "456",
+	}
+	for k, v := range args {
+		data[k] = v
+	}
+	return makeRequest(lcRequest{
+		Version: 1,
+		OID:     oid,
+		Type:    "command",
+		Data:    data,
+	})
+}
+
+func TestOrgConfig(t *testing.T) {
+	a := assert.New(t)
+	schema := RequestParams{
+		"threshold": {
+			Type:        RequestParamTypes.Int,
+			Description: "alert threshold",
+			Default:     10,
+		},
+		"mode": {
+			Type:        RequestParamTypes.Enum,
+			Description: "mode",
+			Values:      []string{"audit", "block"},
+			Default:     "audit",
+		},
+		"api_key": {
+			Type:        RequestParamTypes.String,
+			Description: "third-party api key",
+			IsRequired:  true,
+			IsSecret:    true,
+		},
+		"is_verbose": {
+			Type:        RequestParamTypes.Bool,
+			Description: "verbose",
+		},
+	}
+
+	// Defaults must match their type.
+	_, err := NewService(Descriptor{
+		SecretKey: testSecretKey,
+		ConfigSchema: RequestParams{
+			"bad": {Type: RequestParamTypes.Int, Description: "bad", Default: "ten"},
+		},
+	})
+	a.Error(err)
+
+	// Secret values have no default since the schema is public.
+	_, err = NewService(Descriptor{
+		SecretKey:        testSecretKey,
+		SecretsMasterKey: "master",
+		ConfigSchema: RequestParams{
+			"token": {Type: RequestParamTypes.String, Description: "token", IsSecret: true, Default: "s3cr3t"},
+		},
+	})
+	a.Error(err)
+
+	// Secret values require encryption.
+	_, err = NewService(Descriptor{
+		SecretKey:    testSecretKey,
+		ConfigSchema: schema,
+	})
+	a.Error(err)
+
+	seen := []Config{}
+	s, err := NewService(Descriptor{
+		SecretKey:          testSecretKey,
+		SecretsMasterKey:   "master",
+		Log:                func(m string) { fmt.Println(m) },
+		LogCritical:        func(m string) { fmt.Println(m) },
+		ConfigSchema:       schema,
+		CommandPermissions: noCommandPermissions(),
+		Callbacks: DescriptorCallbacks{
+			OnOrgInstall: func(r Request) Response {
+				seen = append(seen, r.Config)
+				return MakeSuccessResponse()
+			},
+		},
+	})
+	a.NoError(err)
+
+	// Install-time options are validated and set.
+	resp := s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "org_install", Data: Dict{"threshold": "oops"}}))
+	a.False(resp.IsSuccess)
+	a.Empty(seen)
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "org_install", Data: Dict{"api_key": "k1-s3cr3t", "threshold": 5}}))
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(seen))
+	v, err := seen[0].GetInt("threshold")
+	a.NoError(err)
+	a.Equal(5, v)
+
+	resp = s.ProcessCommand(makeConfigCommand("o1", "get_config", nil))
+	a.True(resp.IsSuccess)
+	a.Equal(Dict{"api_key": redactedValue, "threshold": 5, "mode": "audit"}, resp.Data["config"])
+
+	// Secret values are only available to the service.
+	apiKey, err := seen[0].GetString("api_key")
+	a.NoError(err)
+	a.Equal("k1-s3cr3t", apiKey)
+	stored, _, err := s.desc.StateStore.Get(configKey("o1"))
+	a.NoError(err)
+	a.NotContains(string(stored), "k1-s3cr3t")
+
+	// Invalid values are rejected without being set.
+	resp = s.ProcessCommand(makeConfigCommand("o1", "validate_config", Dict{"mode": "other"}))
+	a.False(resp.IsSuccess)
+	a.Contains(resp.Error, "not a valid enum value")
+	resp = s.ProcessCommand(makeConfigCommand("o1", "set_config", Dict{"mode": "block", "threshold": 1.5}))
+	a.False(resp.IsSuccess)
+	resp = s.ProcessCommand(makeConfigCommand("o1", "validate_config", Dict{"mode": "block"}))
+	a.True(resp.IsSuccess)
+
+	resp = s.ProcessCommand(makeConfigCommand("o1", "set_config", Dict{"mode": "block", "is_verbose": "true"}))
+	a.True(resp.IsSuccess)
+	a.Equal(Dict{"api_key": redactedValue, "threshold": 5, "mode": "block", "is_verbose": true}, resp.Data["config"])
+
+	// Orgs are isolated and required values are enforced.
+	resp = s.ProcessCommand(makeConfigCommand("o2", "set_config", Dict{"mode": "block"}))
+	a.False(resp.IsSuccess)
+	a.Contains(resp.Error, "'api_key' is required")
+
+	// The config is typed in every Request.
+	cfg, err := s.config.get("o1")
+	a.NoError(err)
+	mode, err := cfg.GetString("mode")
+	a.NoError(err)
+	a.Equal("block", mode)
+	isVerbose, err := cfg.GetBool("is_verbose")
+	a.NoError(err)
+	a.True(isVerbose)
+	_, err = cfg.GetInt("mode")
+	a.Error(err)
+	_, err = cfg.Get("unknown")
+	a.Error(err)
+	apiKey, err = cfg.GetString("api_key")
+	a.NoError(err)
+	a.Equal("k1-s3cr3t", apiKey)
+
+	// Values stored in plaintext by older versions are still read.
+	a.NoError(s.desc.StateStore.Set(configKey("o3"), []byte(`{"api_key":"legacy-key"}`), 0))
+	cfg, err = s.config.get("o3")
+	a.NoError(err)
+	apiKey, err = cfg.GetString("api_key")
+	a.NoError(err)
+	a.Equal("legacy-key", apiKey)
+
+	// The schema is advertised.
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	a.Equal(schema, resp.Data["mtd"].(Dict)["config_schema"])
+	a.Equal(6, len(resp.Data["mtd"].(Dict)["commands"].(map[string]CommandDescriptor)))
+
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "org_uninstall", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	cfg, err = s.config.get("o1")
+	a.NoError(err)
+	_, err = cfg.Get("api_key")
+	a.Error(err)
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of the keys of installed org records.
+	orgRegistryPrefix = "orgs/"
+
+	// Prefix of the per-org namespaces of service state.
+	orgStatePrefix = "orgstate/"
+)
+
+// An org which installed the service.
+type InstalledOrg struct {
+	OID         string `json:"oid"`
+	InstalledAt int64  `json:"installed_at"`
+	// Last time a callback was received for the org.
+	LastSeen int64 `json:"last_seen"`
+}
+
+// Registry of the orgs which installed the service, maintained from
+// the org_install, org_uninstall and org_per_* callbacks.
+type OrgRegistry struct {
+	cs    *CoreService
+	store KVStore
+
+	// Serializes the updates of records.
+	mRecords sync.Mutex
+}
+
+func newOrgRegistry(cs *CoreService) *OrgRegistry {
+	return &OrgRegistry{
+		cs:    cs,
+		store: cs.desc.StateStore,
+	}
+}
+
+func (o *OrgRegistry) install() {
+	o.cs.interceptCallback("org_install", o.onOrgInstall)
+	o.cs.interceptCallback("org_uninstall", o.onOrgUninstall)
+	// Only the callbacks of the service, not to
+	// subscribe it to callbacks it did not ask for.
+	for _, cbName := range []string{"org_per_1h", "org_per_3h", "org_per_12h", "org_per_24h", "org_per_7d", "org_per_30d"} {
+		if _, ok := o.cs.cbMap[cbName]; ok {
+			o.cs.interceptCallback(cbName, o.onOrgPer)
+		}
+	}
+	o.cs.addHealthMetadata("orgs", o.getHealthMetadata)
+}
+
+func orgRecordKey(oid string) string {
+	return fmt.Sprintf("%s%s", orgRegistryPrefix, oid)
+}
+
+// Get an installed org and whether it was found.
+func (o *OrgRegistry) Get(oid string) (InstalledOrg, bool, error) {
+	org := InstalledOrg{}
+	data, isFound, err := o.store.Get(orgRecordKey(oid))
+	if err != nil || !isFound {
+		return org, false, err
+	}
+	if err := json.Unmarshal(data, &org); err != nil {
+		return org, false, err
+	}
+	return org, true, nil
+}
+
+// List the installed orgs, sorted by OID.
+func (o *OrgRegistry) List() ([]InstalledOrg, error) {
+	keys, err := o.store.List(orgRegistryPrefix)
+	if err != nil {
+		return nil, err
+	}
+	orgs := []InstalledOrg{}
+	for _, k := range keys {
+		org, isFound, err := o.Get(strings.TrimPrefix(k, orgRegistryPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if isFound {
+			orgs = append(orgs, org)
+		}
+	}
+	return orgs, nil
+}
+
+// Get the namespace of an org in the StateStore, where the
+// service can keep its per-org state. The namespace is
+// cleared when the org uninstalls the service.
+func (o *OrgRegistry) Store(oid string) KVStore {
+	return NewPrefixedStore(o.store, fmt.Sprintf("%s%s/", orgStatePrefix, oid))
+}
+
+// Call f for every installed org, with at most maxConcurrent
+// calls in parallel. Returns the errors by OID.
+func (o *OrgRegistry) ForEach(maxConcurrent int, f func(org InstalledOrg) error) (map[string]error, error) {
+	orgs, err := o.List()
+	if err != nil {
+		return nil, err
+	}
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	results := parallelExec(len(orgs), func(ctx context.Context, i int) (interface{}, error) {
+		return nil, f(orgs[i])
+	}, ParallelOptions{MaxConcurrent: maxConcurrent})
+	errs := map[string]error{}
+	for i, res := range results {
+		if res.Err != nil {
+			errs[orgs[i].OID] = res.Err
+		}
+	}
+	return errs, nil
+}
+
+// Record an org as installed, or refresh it.
+func (o *OrgRegistry) register(oid string) error {
+	if oid == "" {
+		return fmt.Errorf("missing oid")
+	}
+	o.mRecords.Lock()
+	defer o.mRecords.Unlock()
+	org, isFound, err := o.Get(oid)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	if !isFound {
+		org = InstalledOrg{
+			OID:         oid,
+			InstalledAt: now,
+		}
+	}
+	org.LastSeen = now
+	data, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	return o.store.Set(orgRecordKey(oid), data, 0)
+}
+
+// Forget an org and clear its state.
+func (o *OrgRegistry) unregister(oid string) error {
+	o.mRecords.Lock()
+	defer o.mRecords.Unlock()
+	if err := o.store.Delete(orgRecordKey(oid)); err != nil {
+		return err
+	}
+	orgStore := o.Store(oid)
+	keys, err := orgStore.List("")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := orgStore.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OrgRegistry) onOrgInstall(r Request, next ServiceCallback) Response {
+	if err := o.register(r.OID); err != nil {
+		o.cs.Error(fmt.Sprintf("onOrgInstall.registerOrg: %v", err))
+		return NewRetriableResponse(err)
+	}
+	return callNext(next, r)
+}
+
+func (o *OrgRegistry) onOrgPer(r Request, next ServiceCallback) Response {
+	if err := o.register(r.OID); err != nil {
+		o.cs.Error(fmt.Sprintf("onOrgPer.registerOrg: %v", err))
+	}
+	return callNext(next, r)
+}
+
+func (o *OrgRegistry) onOrgUninstall(r Request, next ServiceCallback) Response {
+	resp := callNext(next, r)
+	// The service's callback may still need the org's state.
+	if err := o.unregister(r.OID); err != nil {
+		o.cs.Error(fmt.Sprintf("onOrgUninstall.unregisterOrg: %v", err))
+	}
+	return resp
+}
+
+func (o *OrgRegistry) getHealthMetadata() interface{} {
+	keys, err := o.store.List(orgRegistryPrefix)
+	if err != nil {
+		return Dict{"error": err.Error()}
+	}
+	return Dict{
+		"installed": len(keys),
+	}
+}
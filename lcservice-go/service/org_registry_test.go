@@ -0,0 +1,117 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrgRegistry(t *testing.T) {
+	a := assert.New(t)
+	uninstalled := []string{}
+	var s *CoreService
+	s, err := NewService(Descriptor{
+		SecretKey:            testSecretKey,
+		Log:                  func(m string) { fmt.Println(m) },
+		LogCritical:          func(m string) { fmt.Println(m) },
+		IsTrackInstalledOrgs: true,
+		Callbacks: DescriptorCallbacks{
+			OnOrgPer24H: func(r Request) Response { return MakeSuccessResponse() },
+			OnOrgUninstall: func(r Request) Response {
+				// The org's state is still available.
+				_, isFound, _ := s.Orgs().Store(r.OID).Get("k")
+				a.True(isFound)
+				uninstalled = append(uninstalled, r.OID)
+				return MakeSuccessResponse()
+			},
+		},
+	})
+	a.NoError(err)
+	orgs := s.Orgs()
+	a.NotNil(orgs)
+
+	for _, cb := range []struct {
+		oid    string
+		cbName string
+	}{
+		{"o1", "org_install"},
+		{"o2", "org_install"},
+		// Orgs installed before the registry are picked up.
+		{"o3", "org_per_24h"},
+	} {
+		resp := s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: cb.oid, Type: cb.cbName, Data: Dict{}}))
+		a.True(resp.IsSuccess)
+	}
+	installed, err := orgs.List()
+	a.NoError(err)
+	a.Equal(3, len(installed))
+	a.Equal("o1", installed[0].OID)
+	a.NotZero(installed[0].InstalledAt)
+
+	// Per-org state is namespaced.
+	a.NoError(orgs.Store("o1").Set("k", []byte("v1"), 0))
+	a.NoError(orgs.Store("o2").Set("k", []byte("v2"), 0))
+	v, isFound, err := orgs.Store("o1").Get("k")
+	a.NoError(err)
+	a.True(isFound)
+	a.Equal([]byte("v1"), v)
+	keys, err := orgs.Store("o2").List("")
+	a.NoError(err)
+	a.Equal([]string{"k"}, keys)
+
+	// Work is fanned out with bounded concurrency.
+	var inFlight, maxInFlight int32
+	seen := sync.Map{}
+	errs, err := orgs.ForEach(2, func(org InstalledOrg) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		seen.Store(org.OID, true)
+		if org.OID == "o2" {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+	a.NoError(err)
+	a.Equal(1, len(errs))
+	a.Error(errs["o2"])
+	a.True(maxInFlight <= 2)
+	for _, oid := range []string{"o1", "o2", "o3"} {
+		_, ok := seen.Load(oid)
+		a.True(ok)
+	}
+
+	// Uninstalling forgets the org and its state.
+	resp := s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "org_uninstall", Data: Dict{}}))
+	a.True(resp.IsSuccess)
+	a.Equal([]string{"o1"}, uninstalled)
+	_, isFound, err = orgs.Get("o1")
+	a.NoError(err)
+	a.False(isFound)
+	_, isFound, err = orgs.Store("o1").Get("k")
+	a.NoError(err)
+	a.False(isFound)
+	_, isFound, err = orgs.Store("o2").Get("k")
+	a.NoError(err)
+	a.True(isFound)
+	a.Equal(Dict{"installed": 2}, orgs.getHealthMetadata())
+
+	// Services are not subscribed to callbacks they did not declare.
+	s, err = NewService(Descriptor{
+		SecretKey:            testSecretKey,
+		IsTrackInstalledOrgs: true,
+	})
+	a.NoError(err)
+	a.NotContains(s.cbMap, "org_per_24h")
+	a.Contains(s.cbMap, "org_install")
+}
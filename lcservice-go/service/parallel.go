@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Options of ParallelExec and ParallelExecMap.
+type ParallelOptions struct {
+	// Maximum number of calls running at the same time,
+	// 0 runs them all at once.
+	MaxConcurrent int
+	// Maximum time to wait for all the calls, 0 waits
+	// until they all return.
+	Timeout time.Duration
+	// Optional context bounding the calls, like the one from
+	// `Request.Context()` to stop at the deadline of a Request.
+	Context context.Context
+	// Optional Job the progress is narrated to.
+	Job *Job
+}
+
+// Result of a call of ParallelExec or ParallelExecMap.
+type ParallelResult struct {
+	Value interface{}
+	Err   error
+}
+
+type indexedResult struct {
+	i int
+	ParallelResult
+}
+
+// Apply a function to every object in parallel, returning the
+// results in the same order as the objects. Calls not started or
+// not returned when the timeout or context expires get its error,
+// and a panicking call gets an error without affecting the others.
+func (cs *CoreService) ParallelExec(objects []interface{}, f func(ctx context.Context, o interface{}) (interface{}, error), opts ParallelOptions) []ParallelResult {
+	return parallelExec(len(objects), func(ctx context.Context, i int) (interface{}, error) {
+		return f(ctx, objects[i])
+	}, opts)
+}
+
+// Same as ParallelExec, with the results keyed like the objects.
+func (cs *CoreService) ParallelExecMap(objects map[string]interface{}, f func(ctx context.Context, key string, o interface{}) (interface{}, error), opts ParallelOptions) map[string]ParallelResult {
+	keys := []string{}
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	results := parallelExec(len(keys), func(ctx context.Context, i int) (interface{}, error) {
+		return f(ctx, keys[i], objects[keys[i]])
+	}, opts)
+	keyed := map[string]ParallelResult{}
+	for i, k := range keys {
+		keyed[k] = results[i]
+	}
+	return keyed
+}
+
+func parallelExec(n int, f func(ctx context.Context, i int) (interface{}, error), opts ParallelOptions) []ParallelResult {
+	results := make([]ParallelResult, n)
+	if n == 0 {
+		return results
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var cancel context.CancelFunc
+	if opts.Timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	maxConcurrent := opts.MaxConcurrent
+	if maxConcurrent <= 0 || maxConcurrent > n {
+		maxConcurrent = n
+	}
+	if opts.Job != nil {
+		opts.Job.Narrate(fmt.Sprintf("processing %d items, %d at a time", n, maxConcurrent), false)
+	}
+
+	// Buffered so calls returning after we gave up never block.
+	finished := make(chan indexedResult, n)
+	sem := make(chan struct{}, maxConcurrent)
+	go func() {
+		for i := 0; i < n; i++ {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			go func(i int) {
+				defer func() { <-sem }()
+				finished <- runIsolated(ctx, i, f)
+			}(i)
+		}
+	}()
+
+	isDone := make([]bool, n)
+	nDone := 0
+	nFailed := 0
+	for nDone < n {
+		select {
+		case res := <-finished:
+			results[res.i] = res.ParallelResult
+			isDone[res.i] = true
+			nDone++
+			if res.Err != nil {
+				nFailed++
+			}
+			// Narrate every 10% of progress.
+			if opts.Job != nil && nDone != n && (nDone*10)/n != ((nDone-1)*10)/n {
+				opts.Job.Narrate(fmt.Sprintf("%d/%d items processed, %d failed", nDone, n, nFailed), false)
+			}
+		case <-ctx.Done():
+			for i := range results {
+				if !isDone[i] {
+					results[i].Err = ctx.Err()
+					nFailed++
+				}
+			}
+			if opts.Job != nil {
+				opts.Job.Narrate(fmt.Sprintf("stopped after %d/%d items processed: %v", nDone, n, ctx.Err()), true)
+			}
+			return results
+		}
+	}
+	if opts.Job != nil {
+		opts.Job.Narrate(fmt.Sprintf("%d items processed, %d failed", n, nFailed), nFailed != 0)
+	}
+	return results
+}
+
+func runIsolated(ctx context.Context, i int, f func(ctx context.Context, i int) (interface{}, error)) (res indexedResult) {
+	res.i = i
+	defer func() {
+		if rec := recover(); rec != nil {
+			res.Value = nil
+			res.Err = fmt.Errorf("panic: %v", rec)
+		}
+	}()
+	res.Value, res.Err = f(ctx, i)
+	return res
+}
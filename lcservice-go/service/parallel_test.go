@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelExec(t *testing.T) {
+	a := assert.New(t)
+	s, err := NewService(Descriptor{SecretKey: testSecretKey})
+	a.NoError(err)
+
+	objects := []interface{}{}
+	for i := 0; i < 20; i++ {
+		objects = append(objects, i)
+	}
+	var nRunning, maxRunning int32
+	j := NewJob()
+	results := s.ParallelExec(objects, func(ctx context.Context, o interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&nRunning, 1)
+		defer atomic.AddInt32(&nRunning, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		i := o.(int)
+		if i == 3 {
+			return nil, fmt.Errorf("failed %d", i)
+		}
+		if i == 4 {
+			panic("oops")
+		}
+		return i * 2, nil
+	}, ParallelOptions{MaxConcurrent: 3, Job: j})
+	a.Equal(20, len(results))
+	a.True(maxRunning <= 3)
+	for i, res := range results {
+		switch i {
+		case 3:
+			a.EqualError(res.Err, "failed 3")
+		case 4:
+			a.EqualError(res.Err, "panic: oops")
+		default:
+			a.NoError(res.Err)
+			a.Equal(i*2, res.Value)
+		}
+	}
+	a.Equal("20 items processed, 2 failed", j.entries[len(j.entries)-1].msg)
+	a.True(j.entries[len(j.entries)-1].isImportant)
+
+	// Calls not done within the timeout get an error.
+	keyed := s.ParallelExecMap(map[string]interface{}{"fast": 0, "slow": time.Second}, func(ctx context.Context, key string, o interface{}) (interface{}, error) {
+		if d, ok := o.(time.Duration); ok {
+			time.Sleep(d)
+		}
+		return key, nil
+	}, ParallelOptions{Timeout: 50 * time.Millisecond})
+	a.Equal(2, len(keyed))
+	a.NoError(keyed["fast"].Err)
+	a.Equal("fast", keyed["fast"].Value)
+	a.Equal(context.DeadlineExceeded, keyed["slow"].Err)
+
+	// Nothing is started past the deadline of a request.
+	ctx, cancel := Request{Deadline: time.Now().Add(-time.Second)}.Context()
+	defer cancel()
+	var nCalls int32
+	results = s.ParallelExec(objects, func(ctx context.Context, o interface{}) (interface{}, error) {
+		atomic.AddInt32(&nCalls, 1)
+		return nil, nil
+	}, ParallelOptions{Context: ctx})
+	a.Equal(int32(0), atomic.LoadInt32(&nCalls))
+	for _, res := range results {
+		a.Equal(context.DeadlineExceeded, res.Err)
+	}
+
+	a.Empty(s.ParallelExec(nil, nil, ParallelOptions{}))
+}
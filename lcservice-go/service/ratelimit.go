@@ -0,0 +1,261 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// A token bucket limit, refilled at Rate tokens per
+// second up to Burst tokens, each call taking one.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) isValid() error {
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	return nil
+}
+
+// Per-org rate limits of the requests. Requests over the
+// limits get a retriable error with a `retry_after` in seconds,
+// answered with a 429 by the servers. Limits of commands are
+// set in their CommandDescriptor.
+type RateLimits struct {
+	// Limits per request type, like "sensor_per_1h" or "command".
+	PerType map[string]RateLimit
+}
+
+func (l RateLimits) isValid() error {
+	for t, limit := range l.PerType {
+		if err := limit.isValid(); err != nil {
+			return fmt.Errorf("'%s': %v", t, err)
+		}
+	}
+	return nil
+}
+
+// Usage of the service by an org, per request type
+// or "command/<name>" for commands, for the rate limited ones.
+type RateUsage struct {
+	Allowed uint64 `json:"allowed"`
+	Limited uint64 `json:"limited"`
+}
+
+const (
+	// How often the buckets back to their burst are dropped,
+	// a new bucket being the same as a full one.
+	rateBucketSweepInterval = time.Minute
+)
+
+type tokenBucket struct {
+	limit     RateLimit
+	tokens    float64
+	updatedAt time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*b.limit.Rate)
+	b.updatedAt = now
+}
+
+func (b *tokenBucket) isFull() bool {
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+type rateLimiter struct {
+	cs      *CoreService
+	perType map[string]RateLimit
+	now     func() time.Time
+
+	sync.Mutex
+	buckets   map[string]map[string]*tokenBucket
+	usage     map[string]map[string]*RateUsage
+	lastSweep time.Time
+}
+
+func newRateLimiter(cs *CoreService) *rateLimiter {
+	rl := &rateLimiter{
+		cs:      cs,
+		perType: cs.desc.RateLimits.PerType,
+		now:     time.Now,
+		buckets: map[string]map[string]*tokenBucket{},
+		usage:   map[string]map[string]*RateUsage{},
+	}
+	rl.lastSweep = rl.now()
+	return rl
+}
+
+func isRateLimited(d Descriptor) bool {
+	if len(d.RateLimits.PerType) != 0 {
+		return true
+	}
+	for _, cmd := range d.Commands.Descriptors {
+		if cmd.RateLimit != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (rl *rateLimiter) install() error {
+	if err := rl.cs.desc.addCommand(CommandDescriptor{
+		Name:        "get_usage",
+		Description: "Get the usage of the service by this org.",
+		Args:        CommandParams{},
+		Handler:     rl.cmdGetUsage,
+	}); err != nil {
+		return err
+	}
+	rl.cs.addHealthMetadata("rate_limits", rl.getHealthMetadata)
+	return nil
+}
+
+// Enable the rate limits if they are not already, for the
+// limited commands registered after the service is created.
+func (cs *CoreService) enableRateLimits() error {
+	if cs.rateLimiter != nil {
+		return nil
+	}
+	rl := newRateLimiter(cs)
+	if err := rl.install(); err != nil {
+		return err
+	}
+	cs.rateLimiter = rl
+	return nil
+}
+
+// Key of the limit applying to a request, and the limit. Limits
+// of commands are read from their descriptor, so that commands
+// registered later are limited too.
+func (rl *rateLimiter) limitOf(reqType string, data Dict) (string, RateLimit, bool) {
+	if reqType == "command" {
+		name, _ := data["command_name"].(string)
+		key := fmt.Sprintf("command/%s", name)
+		for _, cmd := range rl.cs.desc.Commands.Descriptors {
+			if cmd.Name == name && cmd.RateLimit != nil {
+				return key, *cmd.RateLimit, true
+			}
+		}
+		limit, ok := rl.perType[reqType]
+		return key, limit, ok
+	}
+	limit, ok := rl.perType[reqType]
+	return reqType, limit, ok
+}
+
+// Take a token for a request of an org, returning false and
+// how long to wait before retrying if none is available.
+// Requests without a limit are not tracked.
+func (rl *rateLimiter) take(oid string, reqType string, data Dict) (bool, time.Duration) {
+	key, limit, isLimited := rl.limitOf(reqType, data)
+	if !isLimited {
+		return true, 0
+	}
+	now := rl.now()
+
+	rl.Lock()
+	defer rl.Unlock()
+	if now.Sub(rl.lastSweep) >= rateBucketSweepInterval {
+		rl.sweep(now)
+	}
+	usage, ok := rl.usage[oid]
+	if !ok {
+		usage = map[string]*RateUsage{}
+		rl.usage[oid] = usage
+	}
+	u, ok := usage[key]
+	if !ok {
+		u = &RateUsage{}
+		usage[key] = u
+	}
+
+	buckets, ok := rl.buckets[oid]
+	if !ok {
+		buckets = map[string]*tokenBucket{}
+		rl.buckets[oid] = buckets
+	}
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Burst), updatedAt: now}
+		buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		u.Limited++
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	u.Allowed++
+	return true, 0
+}
+
+// Drop the buckets of the orgs idle long enough to be back
+// to their burst. Must be called with the lock held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	rl.lastSweep = now
+	for oid, buckets := range rl.buckets {
+		for key, b := range buckets {
+			b.refill(now)
+			if b.isFull() {
+				delete(buckets, key)
+			}
+		}
+		if len(buckets) == 0 {
+			delete(rl.buckets, oid)
+		}
+	}
+}
+
+func (rl *rateLimiter) getUsage(oid string) map[string]RateUsage {
+	rl.Lock()
+	defer rl.Unlock()
+	usage := map[string]RateUsage{}
+	for k, u := range rl.usage[oid] {
+		usage[k] = *u
+	}
+	return usage
+}
+
+func (rl *rateLimiter) cmdGetUsage(r Request) Response {
+	return MakeSuccessResponse(Dict{
+		"usage": rl.getUsage(r.OID),
+	})
+}
+
+// Totals per org, the details are available per org
+// with the get_usage command.
+func (rl *rateLimiter) getHealthMetadata() interface{} {
+	rl.Lock()
+	defer rl.Unlock()
+	totals := map[string]RateUsage{}
+	for oid, usage := range rl.usage {
+		total := RateUsage{}
+		for _, u := range usage {
+			total.Allowed += u.Allowed
+			total.Limited += u.Limited
+		}
+		totals[oid] = total
+	}
+	return Dict{
+		"orgs": totals,
+	}
+}
+
+func newRateLimitedResponse(reqType string, retryAfter time.Duration) Response {
+	resp := NewRetriableResponse(fmt.Errorf("rate limit exceeded for '%s'", reqType))
+	resp.Data = Dict{
+		"retry_after": math.Ceil(retryAfter.Seconds()*1000) / 1000,
+	}
+	resp.IsRateLimited = true
+	resp.RetryAfter = retryAfter
+	return resp
+}
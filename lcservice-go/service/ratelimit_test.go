@@ -0,0 +1,131 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimits(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := NewService(Descriptor{
+		SecretKey:  testSecretKey,
+		RateLimits: RateLimits{PerType: map[string]RateLimit{"sensor_per_1h": {Rate: 1}}},
+	})
+	a.Error(err)
+
+	s, err := NewService(Descriptor{
+		SecretKey: testSecretKey,
+		RateLimits: RateLimits{
+			PerType: map[string]RateLimit{
+				"sensor_per_1h": {Rate: 0.5, Burst: 2},
+				"org_per_1h":    {Rate: 1, Burst: 1},
+			},
+		},
+		Callbacks: DescriptorCallbacks{
+			OnSensorPer1H: func(r Request) Response { return MakeSuccessResponse() },
+		},
+		Commands: CommandsDescriptor{
+			Descriptors: []CommandDescriptor{
+				{
+					Name:        "expensive",
+					Description: "expensive command",
+					Args:        CommandParams{},
+					Handler:     func(r Request) Response { return MakeSuccessResponse() },
+					RateLimit:   &RateLimit{Rate: 1, Burst: 1},
+				},
+			},
+		},
+	})
+	a.NoError(err)
+	now := time.Now()
+	s.rateLimiter.now = func() time.Time { return now }
+
+	makeSensorRequest := func(oid string) Dict {
+		return makeRequest(lcRequest{Version: 1, OID: oid, Type: "sensor_per_1h", Data: Dict{"sid": "s1"}})
+	}
+
+	// The burst is allowed, then the rate applies.
+	a.True(s.ProcessRequest(makeSensorRequest("o1")).IsSuccess)
+	a.True(s.ProcessRequest(makeSensorRequest("o1")).IsSuccess)
+	resp := s.ProcessRequest(makeSensorRequest("o1"))
+	a.False(resp.IsSuccess)
+	a.True(resp.IsRetriable)
+	a.True(resp.IsRateLimited)
+	a.Equal(2*time.Second, resp.RetryAfter)
+	a.Equal(2.0, resp.Data["retry_after"])
+
+	// Orgs are limited independently.
+	a.True(s.ProcessRequest(makeSensorRequest("o2")).IsSuccess)
+
+	now = now.Add(time.Second)
+	resp = s.ProcessRequest(makeSensorRequest("o1"))
+	a.False(resp.IsSuccess)
+	a.Equal(1.0, resp.Data["retry_after"])
+	now = now.Add(time.Second)
+	a.True(s.ProcessRequest(makeSensorRequest("o1")).IsSuccess)
+
+	// Commands have their own limits.
+	a.True(s.ProcessCommand(makeConfigCommand("o1", "expensive", nil)).IsSuccess)
+	resp = s.ProcessCommand(makeConfigCommand("o1", "expensive", nil))
+	a.False(resp.IsSuccess)
+	a.True(resp.IsRetriable)
+
+	// Requests the service does not handle take no tokens.
+	for i := 0; i < 2; i++ {
+		resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "org_per_1h", Data: Dict{}}))
+		a.Equal("not implemented", resp.Error)
+	}
+
+	// Only the limited requests are tracked.
+	resp = s.ProcessCommand(makeConfigCommand("o1", "get_usage", nil))
+	a.True(resp.IsSuccess)
+	a.Equal(map[string]RateUsage{
+		"sensor_per_1h":     {Allowed: 3, Limited: 2},
+		"command/expensive": {Allowed: 1, Limited: 1},
+	}, resp.Data["usage"])
+
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	a.Equal(Dict{"orgs": map[string]RateUsage{
+		"o1": {Allowed: 4, Limited: 3},
+		"o2": {Allowed: 1},
+	}}, resp.Data["mtd"].(Dict)["rate_limits"])
+
+	// The buckets of idle orgs are dropped.
+	a.Len(s.rateLimiter.buckets, 2)
+	now = now.Add(rateBucketSweepInterval)
+	a.True(s.ProcessRequest(makeSensorRequest("o3")).IsSuccess)
+	a.Len(s.rateLimiter.buckets, 1)
+	a.Contains(s.rateLimiter.buckets, "o3")
+}
+
+func TestRateLimitsOfRegisteredCommands(t *testing.T) {
+	a := assert.New(t)
+
+	s, err := NewInteractiveService(Descriptor{SecretKey: testSecretKey}, nil)
+	a.NoError(err)
+	a.Nil(s.cs.rateLimiter)
+	a.NoError(s.RegisterCommand(CommandDescriptor{
+		Name:        "expensive",
+		Description: "expensive command",
+		Args:        CommandParams{},
+		Handler:     func(r Request) Response { return MakeSuccessResponse() },
+		RateLimit:   &RateLimit{Rate: 1, Burst: 1},
+	}))
+	a.NotNil(s.cs.rateLimiter)
+	now := time.Now()
+	s.cs.rateLimiter.now = func() time.Time { return now }
+
+	a.True(s.ProcessCommand(makeConfigCommand("o1", "expensive", nil)).IsSuccess)
+	resp := s.ProcessCommand(makeConfigCommand("o1", "expensive", nil))
+	a.False(resp.IsSuccess)
+	a.True(resp.IsRateLimited)
+
+	resp = s.ProcessCommand(makeConfigCommand("o1", "get_usage", nil))
+	a.True(resp.IsSuccess)
+	a.Equal(map[string]RateUsage{
+		"command/expensive": {Allowed: 1, Limited: 1},
+	}, resp.Data["usage"])
+}
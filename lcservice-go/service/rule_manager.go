@@ -0,0 +1,429 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Prefix of the keys of the records of applied rules.
+	ruleStorePrefix = "rules/"
+
+	defaultRuleNamespace = "general"
+)
+
+type RuleSyncAction = string
+
+var RuleSyncActions = struct {
+	Added     RuleSyncAction
+	Updated   RuleSyncAction
+	Removed   RuleSyncAction
+	Unchanged RuleSyncAction
+	Skipped   RuleSyncAction
+}{
+	Added:     "added",
+	Updated:   "updated",
+	Removed:   "removed",
+	Unchanged: "unchanged",
+	Skipped:   "skipped",
+}
+
+type RuleSyncOptions struct {
+	// Only report the operations, without changing anything.
+	IsDryRun bool
+
+	// Overwrite or remove conflicting rules instead of skipping
+	// them. Conflicts are reported either way.
+	IsForce bool
+}
+
+// An operation on a rule, performed or planned.
+type RuleSyncOperation struct {
+	Name      string         `json:"name"`
+	Namespace string         `json:"namespace"`
+	Action    RuleSyncAction `json:"action"`
+
+	// The rule was changed by another party since we applied it,
+	// or it exists without having been applied by us.
+	IsConflict bool   `json:"is_conflict,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+type RuleSyncResult struct {
+	IsDryRun   bool                `json:"is_dry_run"`
+	Operations []RuleSyncOperation `json:"operations"`
+}
+
+func (r RuleSyncResult) Conflicts() []RuleSyncOperation {
+	conflicts := []RuleSyncOperation{}
+	for _, op := range r.Operations {
+		if op.IsConflict {
+			conflicts = append(conflicts, op)
+		}
+	}
+	return conflicts
+}
+
+// Whether the sync changed, or would change, anything.
+func (r RuleSyncResult) IsChanged() bool {
+	for _, op := range r.Operations {
+		if op.Action != RuleSyncActions.Unchanged && op.Action != RuleSyncActions.Skipped {
+			return true
+		}
+	}
+	return false
+}
+
+// Record of a rule applied by a RuleManager.
+type appliedRule struct {
+	Namespace string `json:"namespace"`
+	Hash      string `json:"hash"`
+}
+
+// A RuleManager upserts the D&R rules of a service in an org without
+// touching the rules it does not own. It owns the rules it applied
+// before and the rules matching its ownership function. The rules it
+// applied are recorded in a store so that changes made by another
+// party are detected as conflicts.
+type RuleManager struct {
+	client  orgConfigClient
+	oid     string
+	store   KVStore
+	isOwned func(name string) bool
+}
+
+// Match the rules whose name starts with a prefix.
+func OwnedByPrefix(prefix string) func(name string) bool {
+	return func(name string) bool {
+		return strings.HasPrefix(name, prefix)
+	}
+}
+
+// Create a RuleManager for an org. The isOwned function may be nil
+// in which case only the rules recorded in the store are owned.
+// Its changes are not audited, unlike those of the RuleManager
+// of Request.AuditedOrg.
+func NewRuleManager(org *lc.Organization, store KVStore, isOwned func(name string) bool) *RuleManager {
+	return newRuleManager(sdkOrgConfigClient{org}, org.GetOID(), store, isOwned)
+}
+
+func newRuleManager(client orgConfigClient, oid string, store KVStore, isOwned func(name string) bool) *RuleManager {
+	if isOwned == nil {
+		isOwned = func(name string) bool { return false }
+	}
+	return &RuleManager{
+		client:  client,
+		oid:     oid,
+		store:   store,
+		isOwned: isOwned,
+	}
+}
+
+func (m *RuleManager) recordKey(name string) string {
+	return fmt.Sprintf("%s%s/%s", ruleStorePrefix, m.oid, name)
+}
+
+func (m *RuleManager) getRecord(name string) (appliedRule, bool, error) {
+	rec := appliedRule{}
+	data, isFound, err := m.store.Get(m.recordKey(name))
+	if err != nil || !isFound {
+		return rec, false, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, false, err
+	}
+	return rec, true, nil
+}
+
+func (m *RuleManager) listRecords() (map[string]appliedRule, error) {
+	prefix := fmt.Sprintf("%s%s/", ruleStorePrefix, m.oid)
+	keys, err := m.store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	records := map[string]appliedRule{}
+	for _, k := range keys {
+		name := strings.TrimPrefix(k, prefix)
+		rec, isFound, err := m.getRecord(name)
+		if err != nil {
+			return nil, err
+		}
+		if isFound {
+			records[name] = rec
+		}
+	}
+	return records, nil
+}
+
+func (m *RuleManager) setRecord(name string, rec appliedRule) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return m.store.Set(m.recordKey(name), data, 0)
+}
+
+func ruleNamespace(rule lc.CoreDRRule) string {
+	if rule.Namespace == "" {
+		return defaultRuleNamespace
+	}
+	return rule.Namespace
+}
+
+// Hash of the content of a rule, ignoring its name and namespace.
+func ruleHash(rule lc.CoreDRRule) (string, error) {
+	isEnabled := true
+	if rule.IsEnabled != nil {
+		isEnabled = *rule.IsEnabled
+	}
+	data, err := json.Marshal(Dict{
+		"detect":     normalizeYAML(rule.Detect),
+		"respond":    normalizeYAML(rule.Response),
+		"is_enabled": isEnabled,
+	})
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
+type existingRule struct {
+	rule lc.CoreDRRule
+	hash string
+}
+
+// A rule of the org, names being unique per namespace only.
+type ruleRef struct {
+	Namespace string
+	Name      string
+}
+
+// Get the existing rules of the given namespaces.
+func (m *RuleManager) getExistingRules(namespaces map[string]struct{}) (map[ruleRef]existingRule, error) {
+	existing := map[ruleRef]existingRule{}
+	nsList := []string{}
+	for ns := range namespaces {
+		nsList = append(nsList, ns)
+	}
+	sort.Strings(nsList)
+	for _, ns := range nsList {
+		rules, err := m.client.DRRules(lc.WithNamespace(ns))
+		if err != nil {
+			return nil, fmt.Errorf("error listing rules in %s: %v", ns, err)
+		}
+		for name, r := range rules {
+			rule := lc.CoreDRRule{}
+			if err := r.UnMarshalToStruct(&rule); err != nil {
+				return nil, fmt.Errorf("error parsing rule %s: %v", name, err)
+			}
+			rule.Name = name
+			rule.Namespace = ns
+			hash, err := ruleHash(rule)
+			if err != nil {
+				return nil, err
+			}
+			existing[ruleRef{Namespace: ns, Name: name}] = existingRule{rule: rule, hash: hash}
+		}
+	}
+	return existing, nil
+}
+
+// Make the rules owned in the org match the desired rules, keyed by
+// name. Owned rules not desired anymore are removed.
+func (m *RuleManager) Sync(rules map[string]lc.CoreDRRule, opts RuleSyncOptions) (RuleSyncResult, error) {
+	result := RuleSyncResult{
+		IsDryRun:   opts.IsDryRun,
+		Operations: []RuleSyncOperation{},
+	}
+	records, err := m.listRecords()
+	if err != nil {
+		return result, err
+	}
+
+	namespaces := map[string]struct{}{
+		defaultRuleNamespace: {},
+		"managed":            {},
+	}
+	for _, rule := range rules {
+		namespaces[ruleNamespace(rule)] = struct{}{}
+	}
+	for _, rec := range records {
+		namespaces[rec.Namespace] = struct{}{}
+	}
+	existing, err := m.getExistingRules(namespaces)
+	if err != nil {
+		return result, err
+	}
+
+	names := []string{}
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		op, err := m.upsert(name, rules[name], existing, records, opts)
+		if err != nil {
+			return result, err
+		}
+		result.Operations = append(result.Operations, op)
+	}
+
+	// Remove the owned rules not desired anymore, in any
+	// namespace other than the one they are desired in.
+	refs := []ruleRef{}
+	for ref := range existing {
+		if rule, ok := rules[ref.Name]; ok {
+			if ref.Namespace == ruleNamespace(rule) {
+				continue
+			}
+			if rec, ok := records[ref.Name]; ok && rec.Namespace == ref.Namespace {
+				// Moved by the upsert.
+				continue
+			}
+		}
+		refs = append(refs, ref)
+	}
+	for name, rec := range records {
+		ref := ruleRef{Namespace: rec.Namespace, Name: name}
+		if _, ok := rules[name]; !ok {
+			if _, ok := existing[ref]; !ok {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Name != refs[j].Name {
+			return refs[i].Name < refs[j].Name
+		}
+		return refs[i].Namespace < refs[j].Namespace
+	})
+	for _, ref := range refs {
+		op, isOwned, err := m.remove(ref, existing, records, opts)
+		if err != nil {
+			return result, err
+		}
+		if isOwned {
+			result.Operations = append(result.Operations, op)
+		}
+	}
+	return result, nil
+}
+
+func (m *RuleManager) upsert(name string, rule lc.CoreDRRule, existing map[ruleRef]existingRule, records map[string]appliedRule, opts RuleSyncOptions) (RuleSyncOperation, error) {
+	ns := ruleNamespace(rule)
+	op := RuleSyncOperation{
+		Name:      name,
+		Namespace: ns,
+		Action:    RuleSyncActions.Added,
+	}
+	hash, err := ruleHash(rule)
+	if err != nil {
+		return op, err
+	}
+	rec, isRecorded := records[name]
+	isRecordedHere := isRecorded && rec.Namespace == ns
+	current, isExisting := existing[ruleRef{Namespace: ns, Name: name}]
+	// The rule applied before in another namespace, moved.
+	previous, isMoved := existingRule{}, false
+	if isRecorded && !isRecordedHere {
+		previous, isMoved = existing[ruleRef{Namespace: rec.Namespace, Name: name}]
+	}
+	if isExisting && current.hash == hash && !isMoved {
+		op.Action = RuleSyncActions.Unchanged
+		if !isRecordedHere || rec.Hash != hash {
+			// Adopt rules already matching what we want.
+			if !opts.IsDryRun {
+				return op, m.setRecord(name, appliedRule{Namespace: ns, Hash: hash})
+			}
+		}
+		return op, nil
+	}
+	if isExisting || isMoved {
+		op.Action = RuleSyncActions.Updated
+	}
+	if isExisting && current.hash != hash {
+		if isRecordedHere && rec.Hash != current.hash {
+			op.IsConflict = true
+			op.Reason = "rule was modified since it was applied"
+		} else if !isRecordedHere && !m.isOwned(name) {
+			op.IsConflict = true
+			op.Reason = "rule exists and is not owned by the service"
+		}
+	}
+	if isMoved && previous.hash != rec.Hash {
+		op.IsConflict = true
+		op.Reason = "rule was modified since it was applied"
+	}
+	if op.IsConflict && !opts.IsForce {
+		op.Action = RuleSyncActions.Skipped
+		return op, nil
+	}
+	if opts.IsDryRun {
+		return op, nil
+	}
+	if isMoved {
+		if err := m.client.DRRuleDelete(name, lc.WithNamespace(rec.Namespace)); err != nil {
+			return op, fmt.Errorf("error removing rule %s: %v", name, err)
+		}
+	}
+	isEnabled := true
+	if rule.IsEnabled != nil {
+		isEnabled = *rule.IsEnabled
+	}
+	if err := m.client.DRRuleAdd(name, normalizeYAML(rule.Detect), normalizeYAML(rule.Response), lc.NewDRRuleOptions{
+		IsReplace: true,
+		Namespace: ns,
+		IsEnabled: isEnabled,
+	}); err != nil {
+		return op, fmt.Errorf("error adding rule %s: %v", name, err)
+	}
+	return op, m.setRecord(name, appliedRule{Namespace: ns, Hash: hash})
+}
+
+func (m *RuleManager) remove(ref ruleRef, existing map[ruleRef]existingRule, records map[string]appliedRule, opts RuleSyncOptions) (RuleSyncOperation, bool, error) {
+	name := ref.Name
+	rec, isRecorded := records[name]
+	isRecordedHere := isRecorded && rec.Namespace == ref.Namespace
+	current, isExisting := existing[ref]
+	op := RuleSyncOperation{
+		Name:      name,
+		Namespace: ref.Namespace,
+		Action:    RuleSyncActions.Removed,
+	}
+	if !isRecordedHere && !m.isOwned(name) {
+		return op, false, nil
+	}
+	if !isExisting {
+		// Already gone, only forget about it.
+		if !opts.IsDryRun {
+			return op, true, m.store.Delete(m.recordKey(name))
+		}
+		return op, true, nil
+	}
+	if isRecordedHere && rec.Hash != current.hash {
+		op.IsConflict = true
+		op.Reason = "rule was modified since it was applied"
+		if !opts.IsForce {
+			op.Action = RuleSyncActions.Skipped
+			return op, true, nil
+		}
+	}
+	if opts.IsDryRun {
+		return op, true, nil
+	}
+	if err := m.client.DRRuleDelete(name, lc.WithNamespace(ref.Namespace)); err != nil {
+		return op, true, fmt.Errorf("error removing rule %s: %v", name, err)
+	}
+	if !isRecordedHere {
+		// A copy of a rule recorded in another namespace.
+		return op, true, nil
+	}
+	return op, true, m.store.Delete(m.recordKey(name))
+}
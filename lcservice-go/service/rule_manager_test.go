@@ -0,0 +1,135 @@
+package service
+
+import (
+	"testing"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestRule(namespace string, value string) lc.CoreDRRule {
+	return lc.CoreDRRule{
+		Namespace: namespace,
+		Detect:    lc.Dict{"op": "is", "path": "event/X", "value": value},
+		Response:  lc.List{Dict{"action": "report", "name": "x"}},
+	}
+}
+
+func TestRuleManager(t *testing.T) {
+	a := assert.New(t)
+	fake := &fakeOrgConfigClient{
+		rules: map[string]map[string]lc.Dict{
+			"general": {
+				"someone-else": {"detect": Dict{"op": "exists"}, "respond": []interface{}{}, "is_enabled": true},
+			},
+		},
+	}
+	store := NewMemoryStore()
+	m := newRuleManager(fake, "oid1", store, OwnedByPrefix("svc-"))
+
+	desired := map[string]lc.CoreDRRule{
+		"svc-a":        makeTestRule("managed", "a"),
+		"svc-b":        makeTestRule("", "b"),
+		"someone-else": makeTestRule("", "mine"),
+	}
+
+	// A dry run changes nothing.
+	result, err := m.Sync(desired, RuleSyncOptions{IsDryRun: true})
+	a.NoError(err)
+	a.True(result.IsChanged())
+	a.Empty(fake.added)
+	a.Equal([]RuleSyncOperation{
+		{Name: "someone-else", Namespace: "general", Action: RuleSyncActions.Skipped, IsConflict: true, Reason: "rule exists and is not owned by the service"},
+		{Name: "svc-a", Namespace: "managed", Action: RuleSyncActions.Added},
+		{Name: "svc-b", Namespace: "general", Action: RuleSyncActions.Added},
+	}, result.Operations)
+
+	// Rules not owned are never touched.
+	result, err = m.Sync(desired, RuleSyncOptions{})
+	a.NoError(err)
+	a.Equal([]string{"dr-rule/managed/svc-a", "dr-rule/general/svc-b"}, fake.added)
+	a.Equal(1, len(result.Conflicts()))
+	a.Equal(Dict{"op": "exists"}, Dict(fake.rules["general"]["someone-else"]["detect"].(map[string]interface{})))
+
+	// Syncing again is a no-op.
+	delete(desired, "someone-else")
+	fake.added = nil
+	result, err = m.Sync(desired, RuleSyncOptions{})
+	a.NoError(err)
+	a.False(result.IsChanged())
+	a.Empty(fake.added)
+
+	// Changes made by another party are conflicts.
+	fake.rules["general"]["svc-b"]["detect"] = Dict{"op": "exists", "path": "event/Y"}
+	desired["svc-a"] = makeTestRule("managed", "a2")
+	result, err = m.Sync(desired, RuleSyncOptions{})
+	a.NoError(err)
+	a.Equal([]RuleSyncOperation{
+		{Name: "svc-a", Namespace: "managed", Action: RuleSyncActions.Updated},
+		{Name: "svc-b", Namespace: "general", Action: RuleSyncActions.Skipped, IsConflict: true, Reason: "rule was modified since it was applied"},
+	}, result.Operations)
+	a.Equal([]string{"dr-rule/managed/svc-a"}, fake.added)
+
+	// Unless forced.
+	fake.added = nil
+	result, err = m.Sync(desired, RuleSyncOptions{IsForce: true})
+	a.NoError(err)
+	a.Equal(1, len(result.Conflicts()))
+	a.Equal([]string{"dr-rule/general/svc-b"}, fake.added)
+
+	// Moving a rule to another namespace replaces it.
+	fake.added = nil
+	desired["svc-b"] = makeTestRule("managed", "b")
+	result, err = m.Sync(desired, RuleSyncOptions{})
+	a.NoError(err)
+	a.Empty(result.Conflicts())
+	a.Equal([]string{"dr-rule/general/svc-b"}, fake.deleted)
+	a.Equal([]string{"dr-rule/managed/svc-b"}, fake.added)
+
+	// Owned rules not desired anymore are removed, including
+	// rules matching the prefix that were not applied by us.
+	fake.deleted = nil
+	fake.rules["general"]["svc-stale"] = lc.Dict{"detect": Dict{"op": "exists"}, "respond": []interface{}{}}
+	result, err = m.Sync(map[string]lc.CoreDRRule{}, RuleSyncOptions{})
+	a.NoError(err)
+	a.Equal([]RuleSyncOperation{
+		{Name: "svc-a", Namespace: "managed", Action: RuleSyncActions.Removed},
+		{Name: "svc-b", Namespace: "managed", Action: RuleSyncActions.Removed},
+		{Name: "svc-stale", Namespace: "general", Action: RuleSyncActions.Removed},
+	}, result.Operations)
+	a.Equal([]string{"someone-else"}, keysOf(fake.rules["general"]))
+	a.Empty(fake.rules["managed"])
+	records, err := store.List("rules/")
+	a.NoError(err)
+	a.Empty(records)
+
+	// Rules of the same name in other namespaces are other rules.
+	fake.added = nil
+	fake.deleted = nil
+	desired = map[string]lc.CoreDRRule{
+		"someone-else": makeTestRule("managed", "mine"),
+	}
+	result, err = m.Sync(desired, RuleSyncOptions{})
+	a.NoError(err)
+	a.Equal([]RuleSyncOperation{
+		{Name: "someone-else", Namespace: "managed", Action: RuleSyncActions.Added},
+	}, result.Operations)
+	result, err = m.Sync(desired, RuleSyncOptions{})
+	a.NoError(err)
+	a.False(result.IsChanged())
+	result, err = m.Sync(map[string]lc.CoreDRRule{}, RuleSyncOptions{})
+	a.NoError(err)
+	a.Equal([]RuleSyncOperation{
+		{Name: "someone-else", Namespace: "managed", Action: RuleSyncActions.Removed},
+	}, result.Operations)
+	a.Equal([]string{"dr-rule/managed/someone-else"}, fake.deleted)
+	a.Equal([]string{"someone-else"}, keysOf(fake.rules["general"]))
+}
+
+func keysOf(m map[string]lc.Dict) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,496 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of the keys of per-org secrets.
+	secretStorePrefix = "secrets/"
+
+	// Purpose used to derive the encryption key from the master key.
+	secretEncryptionKeyPurpose = "lc-service/secrets/encrypt"
+
+	// Text replacing secret values in logs and Jobs.
+	redactedValue = "[REDACTED]"
+
+	// Values shorter than this are not redacted to
+	// avoid mangling unrelated text.
+	minRedactedLength = 4
+
+	// Maximum number of secret values redacted, the
+	// values read or set the longest ago being dropped.
+	maxRedactedValues = 10000
+)
+
+// A secret as stored, encrypted.
+type storedSecret struct {
+	Version   int    `json:"version"`
+	Value     string `json:"value"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// Metadata of a secret, never including its value.
+type SecretInfo struct {
+	Name      string `json:"name"`
+	Version   int    `json:"version"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// Per-org secrets encrypted at rest with a master key separate
+// from the SecretKey. Values read or written are redacted from
+// the service's logs and from the Jobs it reports.
+type SecretStore struct {
+	cs       *CoreService
+	store    KVStore
+	keys     []string
+	redactor *secretRedactor
+
+	// Serializes the updates of secrets.
+	mSecrets sync.Mutex
+}
+
+func newSecretStore(cs *CoreService, redactor *secretRedactor) *SecretStore {
+	store := cs.desc.SecretsStore
+	if store == nil {
+		store = cs.desc.StateStore
+	}
+	keys := []string{cs.desc.SecretsMasterKey}
+	for _, k := range cs.desc.PreviousSecretsMasterKeys {
+		if k != "" && k != cs.desc.SecretsMasterKey {
+			keys = append(keys, k)
+		}
+	}
+	return &SecretStore{
+		cs:       cs,
+		store:    store,
+		keys:     keys,
+		redactor: redactor,
+	}
+}
+
+func (s *SecretStore) install() error {
+	nameArg := RequestParamDef{
+		Type:        RequestParamTypes.String,
+		Description: "name of the secret",
+		IsRequired:  true,
+		Index:       0,
+	}
+	valueArg := RequestParamDef{
+		Type:        RequestParamTypes.String,
+		Description: "value of the secret",
+		IsRequired:  true,
+		IsSecret:    true,
+		Index:       1,
+	}
+	for _, cmd := range []CommandDescriptor{
+		{
+			Name:                "set_secret",
+			Description:         "Set a secret of the service for this org.",
+			Args:                CommandParams{"name": nameArg, "value": valueArg},
+			Handler:             s.cmdSetSecret,
+			RequiredPermissions: s.cs.desc.commandPermissions("set_secret"),
+		},
+		{
+			Name:                "rotate_secret",
+			Description:         "Replace the value of an existing secret of the service for this org.",
+			Args:                CommandParams{"name": nameArg, "value": valueArg},
+			Handler:             s.cmdRotateSecret,
+			RequiredPermissions: s.cs.desc.commandPermissions("rotate_secret"),
+		},
+		{
+			Name:                "delete_secret",
+			Description:         "Delete a secret of the service for this org.",
+			Args:                CommandParams{"name": nameArg},
+			Handler:             s.cmdDeleteSecret,
+			RequiredPermissions: s.cs.desc.commandPermissions("delete_secret"),
+		},
+	} {
+		if err := s.cs.desc.addCommand(cmd); err != nil {
+			return err
+		}
+	}
+	s.cs.interceptCallback("org_uninstall", s.onOrgUninstall)
+	return nil
+}
+
+func secretKey(oid string, name string) string {
+	return fmt.Sprintf("%s%s/%s", secretStorePrefix, oid, name)
+}
+
+func (s *SecretStore) newAEAD(masterKey string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(masterKey, secretEncryptionKeyPurpose))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *SecretStore) encrypt(oid string, name string, value string) (string, error) {
+	aead, err := s.newAEAD(s.keys[0])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	// Bind the ciphertext to its org and name so it
+	// cannot be swapped with another secret.
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(secretKey(oid, name)))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *SecretStore) decrypt(oid string, name string, value string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("malformed secret '%s'", name)
+	}
+	for _, k := range s.keys {
+		aead, err := s.newAEAD(k)
+		if err != nil {
+			return "", err
+		}
+		if len(sealed) < aead.NonceSize() {
+			return "", fmt.Errorf("malformed secret '%s'", name)
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(secretKey(oid, name)))
+		if err == nil {
+			return string(plain), nil
+		}
+	}
+	return "", fmt.Errorf("secret '%s' could not be decrypted", name)
+}
+
+func (s *SecretStore) load(oid string, name string) (storedSecret, bool, error) {
+	secret := storedSecret{}
+	data, isFound, err := s.store.Get(secretKey(oid, name))
+	if err != nil || !isFound {
+		return secret, false, err
+	}
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return secret, false, err
+	}
+	return secret, true, nil
+}
+
+// Get the value of a secret and whether it was found.
+func (s *SecretStore) Get(oid string, name string) (string, bool, error) {
+	secret, isFound, err := s.load(oid, name)
+	if err != nil || !isFound {
+		return "", false, err
+	}
+	value, err := s.decrypt(oid, name, secret.Value)
+	if err != nil {
+		return "", false, err
+	}
+	s.redactor.add(oid, name, value)
+	return value, true, nil
+}
+
+// Set the value of a secret, creating it if needed.
+func (s *SecretStore) Set(oid string, name string, value string) (SecretInfo, error) {
+	return s.set(oid, name, value, false)
+}
+
+// Replace the value of an existing secret.
+func (s *SecretStore) Rotate(oid string, name string, value string) (SecretInfo, error) {
+	return s.set(oid, name, value, true)
+}
+
+func (s *SecretStore) set(oid string, name string, value string, isMustExist bool) (SecretInfo, error) {
+	info := SecretInfo{Name: name}
+	if oid == "" {
+		return info, fmt.Errorf("missing oid")
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return info, fmt.Errorf("invalid secret name '%s'", name)
+	}
+	if value == "" {
+		return info, fmt.Errorf("secret value is empty")
+	}
+	s.redactor.add(oid, name, value)
+
+	s.mSecrets.Lock()
+	defer s.mSecrets.Unlock()
+	secret, isFound, err := s.load(oid, name)
+	if err != nil {
+		return info, err
+	}
+	if isMustExist && !isFound {
+		return info, fmt.Errorf("secret '%s' not found", name)
+	}
+	encrypted, err := s.encrypt(oid, name, value)
+	if err != nil {
+		return info, err
+	}
+	secret.Version++
+	secret.Value = encrypted
+	secret.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return info, err
+	}
+	if err := s.store.Set(secretKey(oid, name), data, 0); err != nil {
+		return info, err
+	}
+	info.Version = secret.Version
+	info.UpdatedAt = secret.UpdatedAt
+	return info, nil
+}
+
+// Delete a secret, deleting a missing secret is not an error.
+func (s *SecretStore) Delete(oid string, name string) error {
+	if err := s.store.Delete(secretKey(oid, name)); err != nil {
+		return err
+	}
+	s.redactor.remove(oid, name)
+	return nil
+}
+
+// List the secrets of an org, sorted by name.
+func (s *SecretStore) List(oid string) ([]SecretInfo, error) {
+	prefix := fmt.Sprintf("%s%s/", secretStorePrefix, oid)
+	keys, err := s.store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	infos := []SecretInfo{}
+	for _, k := range keys {
+		name := strings.TrimPrefix(k, prefix)
+		secret, isFound, err := s.load(oid, name)
+		if err != nil {
+			return nil, err
+		}
+		if !isFound {
+			continue
+		}
+		infos = append(infos, SecretInfo{
+			Name:      name,
+			Version:   secret.Version,
+			UpdatedAt: secret.UpdatedAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *SecretStore) cmdSetSecret(r Request) Response {
+	return s.handleSetCommand(r, false)
+}
+
+func (s *SecretStore) cmdRotateSecret(r Request) Response {
+	return s.handleSetCommand(r, true)
+}
+
+func (s *SecretStore) handleSetCommand(r Request, isRotate bool) Response {
+	name, err := r.GetString("name")
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+	value, err := r.GetString("value")
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+	info, err := s.set(r.OID, name, value, isRotate)
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+	return MakeSuccessResponse(Dict{
+		"name":    info.Name,
+		"version": info.Version,
+	})
+}
+
+func (s *SecretStore) cmdDeleteSecret(r Request) Response {
+	name, err := r.GetString("name")
+	if err != nil {
+		return NewErrorResponse(err)
+	}
+	if err := s.Delete(r.OID, name); err != nil {
+		return NewRetriableResponse(err)
+	}
+	return MakeSuccessResponse()
+}
+
+func (s *SecretStore) onOrgUninstall(r Request, next ServiceCallback) Response {
+	resp := callNext(next, r)
+	s.redactor.removeOrg(r.OID)
+	infos, err := s.List(r.OID)
+	if err != nil {
+		s.cs.Error(fmt.Sprintf("onOrgUninstall.listSecrets: %v", err))
+		return resp
+	}
+	for _, info := range infos {
+		if err := s.Delete(r.OID, info.Name); err != nil {
+			s.cs.Error(fmt.Sprintf("onOrgUninstall.deleteSecret: %v", err))
+		}
+	}
+	return resp
+}
+
+// A secret value known to the redactor, by org and name.
+type redactedRef struct {
+	oid  string
+	name string
+}
+
+type redactedEntry struct {
+	value string
+	seq   uint64
+}
+
+// When a value was added, the values being dropped oldest first.
+type redactorOrder struct {
+	ref redactedRef
+	seq uint64
+}
+
+// Replaces the known secret values in text. Only the current value
+// of each secret is kept, values are removed with their secret or
+// org, and the oldest are dropped beyond maxRedactedValues.
+type secretRedactor struct {
+	sync.RWMutex
+	values    map[redactedRef]redactedEntry
+	order     []redactorOrder
+	seq       uint64
+	isChanged bool
+	replacer  *strings.Replacer
+}
+
+func newSecretRedactor() *secretRedactor {
+	return &secretRedactor{
+		values: map[redactedRef]redactedEntry{},
+	}
+}
+
+// Set the value of a secret of an org, replacing its previous value.
+func (r *secretRedactor) add(oid string, name string, value string) {
+	if len(value) < minRedactedLength {
+		return
+	}
+	ref := redactedRef{oid, name}
+	r.Lock()
+	defer r.Unlock()
+	if e, ok := r.values[ref]; ok && e.value == value {
+		return
+	}
+	r.seq++
+	r.values[ref] = redactedEntry{value: value, seq: r.seq}
+	r.order = append(r.order, redactorOrder{ref, r.seq})
+	for len(r.values) > maxRedactedValues {
+		oldest := r.order[0]
+		r.order = r.order[1:]
+		if e, ok := r.values[oldest.ref]; ok && e.seq == oldest.seq {
+			delete(r.values, oldest.ref)
+		}
+	}
+	if len(r.order) > 2*maxRedactedValues {
+		r.compact()
+	}
+	r.isChanged = true
+}
+
+// Drop the order of the values since replaced or
+// removed. Must be called with the lock held.
+func (r *secretRedactor) compact() {
+	order := []redactorOrder{}
+	for _, o := range r.order {
+		if e, ok := r.values[o.ref]; ok && e.seq == o.seq {
+			order = append(order, o)
+		}
+	}
+	r.order = order
+}
+
+// Stop redacting the value of a secret of an org.
+func (r *secretRedactor) remove(oid string, name string) {
+	r.Lock()
+	defer r.Unlock()
+	ref := redactedRef{oid, name}
+	if _, ok := r.values[ref]; !ok {
+		return
+	}
+	delete(r.values, ref)
+	r.isChanged = true
+}
+
+// Stop redacting the values of the secrets of an org.
+func (r *secretRedactor) removeOrg(oid string) {
+	r.Lock()
+	defer r.Unlock()
+	for ref := range r.values {
+		if ref.oid == oid {
+			delete(r.values, ref)
+			r.isChanged = true
+		}
+	}
+	r.compact()
+}
+
+// Get the replacer of the current values, rebuilt
+// only once after any number of changes.
+func (r *secretRedactor) getReplacer() *strings.Replacer {
+	r.RLock()
+	if !r.isChanged {
+		defer r.RUnlock()
+		return r.replacer
+	}
+	r.RUnlock()
+
+	r.Lock()
+	defer r.Unlock()
+	if !r.isChanged {
+		return r.replacer
+	}
+	r.isChanged = false
+	// Replace the longest values first in case
+	// a value contains another one.
+	isSeen := map[string]bool{}
+	values := []string{}
+	for _, e := range r.values {
+		if !isSeen[e.value] {
+			isSeen[e.value] = true
+			values = append(values, e.value)
+		}
+	}
+	if len(values) == 0 {
+		r.replacer = nil
+		return nil
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := []string{}
+	for _, v := range values {
+		pairs = append(pairs, v, redactedValue)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+	return r.replacer
+}
+
+func (r *secretRedactor) redact(s string) string {
+	replacer := r.getReplacer()
+	if replacer == nil {
+		return s
+	}
+	return replacer.Replace(s)
+}
+
+func (r *secretRedactor) redactResponse(resp Response) Response {
+	resp.Error = r.redact(resp.Error)
+	for _, j := range resp.Jobs {
+		if j != nil {
+			j.redact(r.redact)
+		}
+	}
+	return resp
+}
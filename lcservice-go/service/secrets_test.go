@@ -0,0 +1,176 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecrets(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "lcservice")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.json")
+
+	logs := []string{}
+	var s *CoreService
+	newService := func(masterKey string, previousKeys ...string) *CoreService {
+		store, err := NewFileStore(path)
+		a.NoError(err)
+		s, err := NewService(Descriptor{
+			SecretKey:                 testSecretKey,
+			IsDebug:                   true,
+			Log:                       func(m string) { logs = append(logs, m) },
+			LogCritical:               func(m string) { logs = append(logs, m) },
+			SecretsMasterKey:          masterKey,
+			PreviousSecretsMasterKeys: previousKeys,
+			SecretsStore:              store,
+			CommandPermissions:        noCommandPermissions(),
+			Commands: CommandsDescriptor{
+				Descriptors: []CommandDescriptor{
+					{
+						Name:        "leak",
+						Description: "leaks a secret",
+						Args:        CommandParams{},
+						Handler: func(r Request) Response {
+							token, _, err := s.Secrets().Get(r.OID, "token")
+							if err != nil {
+								return NewErrorResponse(err)
+							}
+							j := NewJob()
+							j.Narrate("using token "+token, false, NewTableAttachment("t", []string{"token"}, [][]string{{token}}))
+							return Response{IsSuccess: true, Jobs: []*Job{j}}
+						},
+					},
+				},
+			},
+		})
+		a.NoError(err)
+		return s
+	}
+	s = newService("master1")
+
+	resp := s.ProcessCommand(makeConfigCommand("o1", "rotate_secret", Dict{"name": "token", "value": "s3cr3t-value"}))
+	a.False(resp.IsSuccess)
+	resp = s.ProcessCommand(makeConfigCommand("o1", "set_secret", Dict{"name": "token", "value": "s3cr3t-value"}))
+	a.True(resp.IsSuccess)
+	a.Equal(Dict{"name": "token", "version": 1}, resp.Data)
+
+	// Values are encrypted at rest.
+	data, err := ioutil.ReadFile(path)
+	a.NoError(err)
+	a.NotContains(string(data), "s3cr3t-value")
+
+	// Values are redacted from logs and Jobs.
+	resp = s.ProcessCommand(makeConfigCommand("o1", "leak", nil))
+	a.True(resp.IsSuccess)
+	b, err := json.Marshal(resp.Jobs)
+	a.NoError(err)
+	a.NotContains(string(b), "s3cr3t-value")
+	a.Contains(string(b), redactedValue)
+	s.Error("oops s3cr3t-value")
+	for _, l := range logs {
+		a.NotContains(l, "s3cr3t-value")
+	}
+	a.True(strings.HasSuffix(logs[len(logs)-1], redactedValue))
+
+	// Secrets survive a restart and a rotation of the master key.
+	s = newService("master2", "master1")
+	v, isFound, err := s.Secrets().Get("o1", "token")
+	a.NoError(err)
+	a.True(isFound)
+	a.Equal("s3cr3t-value", v)
+	_, isFound, err = s.Secrets().Get("o2", "token")
+	a.NoError(err)
+	a.False(isFound)
+
+	resp = s.ProcessCommand(makeConfigCommand("o1", "rotate_secret", Dict{"name": "token", "value": "n3w-value"}))
+	a.True(resp.IsSuccess)
+	a.Equal(2, resp.Data["version"])
+	for _, l := range logs {
+		a.NotContains(l, "n3w-value")
+	}
+
+	// The previous master key is no longer needed after rotating.
+	s = newService("master2")
+	v, _, err = s.Secrets().Get("o1", "token")
+	a.NoError(err)
+	a.Equal("n3w-value", v)
+	s = newService("master3")
+	_, _, err = s.Secrets().Get("o1", "token")
+	a.Error(err)
+
+	infos, err := s.Secrets().List("o1")
+	a.NoError(err)
+	a.Equal(1, len(infos))
+	a.Equal("token", infos[0].Name)
+	resp = s.ProcessCommand(makeConfigCommand("o1", "delete_secret", Dict{"name": "token"}))
+	a.True(resp.IsSuccess)
+	infos, err = s.Secrets().List("o1")
+	a.NoError(err)
+	a.Empty(infos)
+}
+
+func TestSecretRedactor(t *testing.T) {
+	a := assert.New(t)
+	r := newSecretRedactor()
+	a.Equal("a s3cr3t-1", r.redact("a s3cr3t-1"))
+
+	r.add("o1", "token", "s3cr3t-1")
+	r.add("o2", "token", "s3cr3t-2")
+	r.add("o2", "key", "k3y-value")
+	a.Equal("a [REDACTED] [REDACTED]", r.redact("a s3cr3t-1 s3cr3t-2"))
+
+	// Only the current value of a secret is kept.
+	r.add("o1", "token", "s3cr3t-3")
+	a.Equal("s3cr3t-1 [REDACTED]", r.redact("s3cr3t-1 s3cr3t-3"))
+
+	r.remove("o1", "token")
+	a.Equal("s3cr3t-3 [REDACTED]", r.redact("s3cr3t-3 s3cr3t-2"))
+	r.removeOrg("o2")
+	a.Equal("s3cr3t-2 k3y-value", r.redact("s3cr3t-2 k3y-value"))
+	a.Empty(r.values)
+
+	// The oldest values are dropped beyond the maximum.
+	for i := 0; i < maxRedactedValues+10; i++ {
+		r.add("o1", fmt.Sprintf("s%d", i), fmt.Sprintf("value-%d", i))
+	}
+	a.Len(r.values, maxRedactedValues)
+	a.LessOrEqual(len(r.order), 2*maxRedactedValues)
+	a.Equal("value-9 [REDACTED]", r.redact(fmt.Sprintf("value-9 value-%d", maxRedactedValues+9)))
+}
+
+func TestSecretRedactorLifecycle(t *testing.T) {
+	a := assert.New(t)
+	s, err := NewService(Descriptor{
+		SecretKey:          testSecretKey,
+		SecretsMasterKey:   "master",
+		CommandPermissions: noCommandPermissions(),
+		Callbacks: DescriptorCallbacks{
+			OnOrgUninstall: func(r Request) Response { return MakeSuccessResponse() },
+		},
+	})
+	a.NoError(err)
+
+	set := func(oid string, cmd string, name string, value string) {
+		a.True(s.ProcessCommand(makeConfigCommand(oid, cmd, Dict{"name": name, "value": value})).IsSuccess)
+	}
+	set("o1", "set_secret", "token", "s3cr3t-1")
+	set("o1", "rotate_secret", "token", "s3cr3t-2")
+	set("o1", "set_secret", "other", "s3cr3t-3")
+	set("o2", "set_secret", "token", "s3cr3t-4")
+	a.Equal("s3cr3t-1 [REDACTED] [REDACTED] [REDACTED]", s.redactor.redact("s3cr3t-1 s3cr3t-2 s3cr3t-3 s3cr3t-4"))
+
+	a.True(s.ProcessCommand(makeConfigCommand("o1", "delete_secret", Dict{"name": "other"})).IsSuccess)
+	a.Equal("s3cr3t-3 [REDACTED]", s.redactor.redact("s3cr3t-3 s3cr3t-4"))
+
+	a.True(s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o2", Type: "org_uninstall", Data: Dict{}})).IsSuccess)
+	a.Equal("s3cr3t-4 [REDACTED]", s.redactor.redact("s3cr3t-4 s3cr3t-2"))
+}
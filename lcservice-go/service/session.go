@@ -0,0 +1,218 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Prefix of the keys of session records.
+	sessionStorePrefix = "session/"
+
+	// Default duration an inactive session is kept.
+	defaultSessionTTL = 24 * time.Hour
+
+	// Maximum number of events kept in a session's history.
+	maxSessionHistory = 100
+)
+
+type SessionEventType = string
+
+var SessionEventTypes = struct {
+	Tasking  SessionEventType
+	Response SessionEventType
+	Timeout  SessionEventType
+}{
+	Tasking:  "tasking",
+	Response: "response",
+	Timeout:  "timeout",
+}
+
+// An entry in the history of a Session.
+type SessionEvent struct {
+	Type       SessionEventType `json:"type"`
+	Timestamp  int64            `json:"ts"`
+	SID        string           `json:"sid,omitempty"`
+	TaskingID  string           `json:"tasking_id,omitempty"`
+	Task       string           `json:"task,omitempty"`
+	CallbackID string           `json:"cb,omitempty"`
+}
+
+// A Session groups the taskings and responses of a multi-step
+// interactive workflow, along with state shared between its steps.
+// Sessions expire after InteractiveServiceOptions.SessionTTL
+// without activity.
+type Session struct {
+	is *InteractiveService
+
+	ID        string         `json:"id"`
+	OID       string         `json:"oid"`
+	State     Dict           `json:"state"`
+	History   []SessionEvent `json:"history"`
+	CreatedAt int64          `json:"created_at"`
+	UpdatedAt int64          `json:"updated_at"`
+}
+
+func sessionKey(oid string, sessionID string) string {
+	return fmt.Sprintf("%s%s/%s", sessionStorePrefix, oid, sessionID)
+}
+
+// Create a new Session for an org.
+func (is *InteractiveService) NewSession(oid string) (*Session, error) {
+	return is.createSession(oid, uuid.New().String())
+}
+
+func (is *InteractiveService) createSession(oid string, sessionID string) (*Session, error) {
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	return is.createSessionLocked(oid, sessionID)
+}
+
+// Must be called with the taskingMutex held.
+func (is *InteractiveService) createSessionLocked(oid string, sessionID string) (*Session, error) {
+	now := time.Now().Unix()
+	s := &Session{
+		is:        is,
+		ID:        sessionID,
+		OID:       oid,
+		State:     Dict{},
+		History:   []SessionEvent{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := is.saveSession(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get an existing Session and whether it was found.
+func (is *InteractiveService) GetSession(oid string, sessionID string) (*Session, bool, error) {
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	return is.loadSession(oid, sessionID)
+}
+
+// Get a Session, creating it if it does not exist.
+func (is *InteractiveService) GetOrCreateSession(oid string, sessionID string) (*Session, error) {
+	// Look it up and create it at once so that concurrent
+	// callers do not reset each other's Session.
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	s, isFound, err := is.loadSession(oid, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if isFound {
+		return s, nil
+	}
+	return is.createSessionLocked(oid, sessionID)
+}
+
+// Get the Session of a Request carrying a session ID,
+// like commands issued from a chat room.
+func (is *InteractiveService) GetSessionForRequest(r Request) (*Session, error) {
+	sessionID, err := r.GetSessionID()
+	if err != nil {
+		return nil, err
+	}
+	return is.GetOrCreateSession(r.OID, sessionID)
+}
+
+func (is *InteractiveService) loadSession(oid string, sessionID string) (*Session, bool, error) {
+	data, isFound, err := is.cs.desc.StateStore.Get(sessionKey(oid, sessionID))
+	if err != nil || !isFound {
+		return nil, false, err
+	}
+	s := &Session{is: is}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, false, err
+	}
+	if s.State == nil {
+		s.State = Dict{}
+	}
+	return s, true, nil
+}
+
+func (is *InteractiveService) saveSession(s *Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return is.cs.desc.StateStore.Set(sessionKey(s.OID, s.ID), data, is.opts.SessionTTL)
+}
+
+// Append an event to the history of a session, if it exists.
+func (is *InteractiveService) recordSessionEvent(oid string, sessionID string, e SessionEvent) (*Session, error) {
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	s, isFound, err := is.loadSession(oid, sessionID)
+	if err != nil || !isFound {
+		return nil, err
+	}
+	e.Timestamp = time.Now().Unix()
+	s.History = append(s.History, e)
+	if len(s.History) > maxSessionHistory {
+		s.History = s.History[len(s.History)-maxSessionHistory:]
+	}
+	s.UpdatedAt = e.Timestamp
+	if err := is.saveSession(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close all the sessions of an org.
+func (is *InteractiveService) closeOrgSessions(oid string) error {
+	keys, err := is.cs.desc.StateStore.List(fmt.Sprintf("%s%s/", sessionStorePrefix, oid))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := is.cs.desc.StateStore.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) Get(key string) (interface{}, bool) {
+	v, ok := s.State[key]
+	return v, ok
+}
+
+func (s *Session) Set(key string, value interface{}) {
+	s.State[key] = value
+}
+
+// Persist the State of the Session. The history is
+// maintained by the framework and is not overwritten.
+func (s *Session) Save() error {
+	s.is.taskingMutex.Lock()
+	defer s.is.taskingMutex.Unlock()
+	current, isFound, err := s.is.loadSession(s.OID, s.ID)
+	if err != nil {
+		return err
+	}
+	if !isFound {
+		return fmt.Errorf("session '%s' is closed or expired", s.ID)
+	}
+	current.State = s.State
+	current.UpdatedAt = time.Now().Unix()
+	if err := s.is.saveSession(current); err != nil {
+		return err
+	}
+	s.History = current.History
+	s.UpdatedAt = current.UpdatedAt
+	return nil
+}
+
+// Close the Session, discarding its state and history.
+// Responses to its taskings are still delivered, without
+// a Session.
+func (s *Session) Close() error {
+	return s.is.cs.desc.StateStore.Delete(sessionKey(s.OID, s.ID))
+}
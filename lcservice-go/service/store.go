@@ -0,0 +1,200 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key-value storage used by the framework to keep
+// state across requests. Values may expire after a TTL.
+type KVStore interface {
+	// Get the value of a key and whether it was found.
+	Get(key string) ([]byte, bool, error)
+	// Set the value of a key, a ttl of 0 never expires.
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete a key, deleting a missing key is not an error.
+	Delete(key string) error
+	// List the keys starting with a prefix, sorted.
+	List(prefix string) ([]string, error)
+}
+
+type kvEntry struct {
+	Value     []byte `json:"v"`
+	ExpiresAt int64  `json:"e,omitempty"`
+}
+
+func (e kvEntry) isExpired(now time.Time) bool {
+	return e.ExpiresAt != 0 && now.UnixNano() >= e.ExpiresAt
+}
+
+// In-memory KVStore, optionally persisted to a local file.
+type kvStore struct {
+	sync.Mutex
+	entries map[string]kvEntry
+
+	// Path of the file the entries are persisted to,
+	// empty for a purely in-memory store.
+	path string
+}
+
+// Create a KVStore kept in memory only.
+func NewMemoryStore() KVStore {
+	return &kvStore{
+		entries: map[string]kvEntry{},
+	}
+}
+
+// Create a KVStore persisted to a local file. The file
+// is loaded if it exists and re-written on every change.
+func NewFileStore(path string) (KVStore, error) {
+	s := &kvStore{
+		entries: map[string]kvEntry{},
+		path:    path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *kvStore) Get(key string) ([]byte, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if e.isExpired(time.Now()) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return e.Value, true, nil
+}
+
+func (s *kvStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	e := kvEntry{
+		Value: value,
+	}
+	if ttl != 0 {
+		e.ExpiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	s.entries[key] = e
+	return s.persist()
+}
+
+func (s *kvStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[key]; !ok {
+		return nil
+	}
+	delete(s.entries, key)
+	return s.persist()
+}
+
+func (s *kvStore) List(prefix string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	keys := []string{}
+	for k, e := range s.entries {
+		if e.isExpired(now) {
+			delete(s.entries, k)
+			continue
+		}
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Write the entries to the backing file, if any. The
+// file is replaced atomically to survive crashes.
+// Must be called with the lock held.
+func (s *kvStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+	now := time.Now()
+	for k, e := range s.entries {
+		if e.isExpired(now) {
+			delete(s.entries, k)
+		}
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// KVStore namespacing the keys of another KVStore under a prefix.
+type prefixedStore struct {
+	store  KVStore
+	prefix string
+}
+
+// Create a KVStore whose keys are stored under a
+// prefix of the given store.
+func NewPrefixedStore(store KVStore, prefix string) KVStore {
+	return &prefixedStore{
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+func (s *prefixedStore) Get(key string) ([]byte, bool, error) {
+	return s.store.Get(s.prefix + key)
+}
+
+func (s *prefixedStore) Set(key string, value []byte, ttl time.Duration) error {
+	return s.store.Set(s.prefix+key, value, ttl)
+}
+
+func (s *prefixedStore) Delete(key string) error {
+	return s.store.Delete(s.prefix + key)
+}
+
+func (s *prefixedStore) List(prefix string) ([]string, error) {
+	keys, err := s.store.List(s.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, s.prefix)
+	}
+	return keys, nil
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "lcservice")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewFileStore(path)
+	a.NoError(err)
+	a.NoError(s.Set("a/1", []byte("one"), 0))
+	a.NoError(s.Set("a/2", []byte("two"), 0))
+	a.NoError(s.Set("b/1", []byte("three"), 0))
+	a.NoError(s.Set("a/3", []byte("expiring"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	// A new store on the same file sees the same state.
+	s, err = NewFileStore(path)
+	a.NoError(err)
+	v, isFound, err := s.Get("a/1")
+	a.NoError(err)
+	a.True(isFound)
+	a.Equal([]byte("one"), v)
+	_, isFound, err = s.Get("a/3")
+	a.NoError(err)
+	a.False(isFound)
+
+	keys, err := s.List("a/")
+	a.NoError(err)
+	a.Equal([]string{"a/1", "a/2"}, keys)
+
+	a.NoError(s.Delete("a/1"))
+	a.NoError(s.Delete("a/1"))
+	s, err = NewFileStore(path)
+	a.NoError(err)
+	keys, err = s.List("")
+	a.NoError(err)
+	a.Equal([]string{"a/2", "b/1"}, keys)
+}
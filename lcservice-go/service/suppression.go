@@ -0,0 +1,325 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Prefix of the keys of the suppression windows.
+	suppressionStorePrefix = "suppression/"
+
+	// How long windows are kept after they end for their summary
+	// to be reported, longer than the org_per_1h reporting it.
+	suppressionSummaryRetention = 2 * time.Hour
+)
+
+// Keys available to DetectionSuppression.Keys. Any other key
+// is a "/" separated path within the Detection's `detect`,
+// like "event/FILE_PATH".
+var SuppressionKeys = struct {
+	Name     string
+	SID      string
+	Hostname string
+}{
+	Name:     "name",
+	SID:      "sid",
+	Hostname: "hostname",
+}
+
+// Suppression of repeated detections before they reach
+// the OnDetection callback. Detections sharing the same
+// values for the Keys are let through MaxCount times per
+// Window, the others are counted and dropped.
+type DetectionSuppression struct {
+	// Values the detections are grouped by, see SuppressionKeys.
+	Keys []string
+	// Duration of a suppression window.
+	Window time.Duration
+	// Number of detections let through per window, defaults to 1.
+	MaxCount int
+	// Store of the suppression windows, defaults to an in-memory store.
+	Store KVStore
+	// Narrate the number of detections suppressed during a window
+	// in a Job returned with the next detection let through, or
+	// with the next org_per_1h if the detections stopped.
+	IsNarrateSummary bool
+}
+
+// Suppression applied to the detections of a service.
+type detectionSuppressor struct {
+	// Counters first for their 64-bit alignment.
+	nPassed     uint64
+	nSuppressed uint64
+	nErrors     uint64
+
+	conf  DetectionSuppression
+	store KVStore
+	now   func() time.Time
+
+	// Serializes the updates of windows.
+	mWindows sync.Mutex
+}
+
+func newDetectionSuppressor(conf DetectionSuppression) *detectionSuppressor {
+	ds := &detectionSuppressor{
+		conf:  conf,
+		store: conf.Store,
+		now:   time.Now,
+	}
+	if ds.store == nil {
+		ds.store = NewMemoryStore()
+	}
+	return ds
+}
+
+// A suppression window as stored.
+type suppressionWindow struct {
+	Name       string `json:"name"`
+	SID        string `json:"sid,omitempty"`
+	StartedAt  int64  `json:"started_at"`
+	Count      int    `json:"count"`
+	Suppressed int    `json:"suppressed"`
+}
+
+func (ds *DetectionSuppression) isValid() error {
+	if len(ds.Keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+	if ds.Window <= 0 {
+		return fmt.Errorf("window must be positive")
+	}
+	if ds.MaxCount < 0 {
+		return fmt.Errorf("max count must not be negative")
+	}
+	return nil
+}
+
+// Number of detections let through, suppressed and not
+// checked because of a store error since the service started.
+func (ds *detectionSuppressor) stats() Dict {
+	return Dict{
+		"passed":     atomic.LoadUint64(&ds.nPassed),
+		"suppressed": atomic.LoadUint64(&ds.nSuppressed),
+		"errors":     atomic.LoadUint64(&ds.nErrors),
+	}
+}
+
+func suppressionOrgPrefix(oid string) string {
+	return fmt.Sprintf("%s%s/", suppressionStorePrefix, oid)
+}
+
+func (ds *detectionSuppressor) keyOf(oid string, d Detection) string {
+	values := []string{}
+	for _, k := range ds.conf.Keys {
+		switch k {
+		case SuppressionKeys.Name:
+			values = append(values, d.Name)
+		case SuppressionKeys.SID:
+			values = append(values, d.Routing.SID)
+		case SuppressionKeys.Hostname:
+			values = append(values, d.Routing.Hostname)
+		default:
+			values = append(values, valueAtPath(d.Detect, k))
+		}
+	}
+	// Values may be anything, hash them into a safe key.
+	h := sha256.Sum256([]byte(strings.Join(values, "\x00")))
+	return suppressionOrgPrefix(oid) + hex.EncodeToString(h[:])
+}
+
+// Get the value at a "/" separated path in a Dict as a
+// string, or an empty string if it is missing.
+func valueAtPath(d Dict, path string) string {
+	var current interface{} = d
+	for _, component := range strings.Split(path, "/") {
+		m, ok := current.(Dict)
+		if !ok {
+			return ""
+		}
+		if current, ok = m[component]; !ok {
+			return ""
+		}
+	}
+	if current == nil {
+		return ""
+	}
+	if s, ok := current.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(current)
+	if err != nil {
+		return fmt.Sprintf("%v", current)
+	}
+	return string(b)
+}
+
+// Record a detection, returning whether it should be suppressed
+// and the window that just ended if detections were suppressed in it.
+func (ds *detectionSuppressor) record(oid string, d Detection, now time.Time) (bool, *suppressionWindow, error) {
+	key := ds.keyOf(oid, d)
+	maxCount := ds.conf.MaxCount
+	if maxCount == 0 {
+		maxCount = 1
+	}
+
+	ds.mWindows.Lock()
+	defer ds.mWindows.Unlock()
+	var ended *suppressionWindow
+	w, isFound, err := ds.loadWindow(key)
+	if err != nil {
+		return false, nil, err
+	}
+	if !isFound || w.isEnded(now, ds.conf.Window) {
+		if isFound && w.Suppressed != 0 {
+			previous := w
+			ended = &previous
+		}
+		w = suppressionWindow{
+			Name:      d.Name,
+			SID:       d.Routing.SID,
+			StartedAt: now.UnixNano(),
+		}
+	}
+	w.Count++
+	isSuppressed := w.Count > maxCount
+	if isSuppressed {
+		w.Suppressed++
+	}
+	if err := ds.saveWindow(key, w); err != nil {
+		return false, nil, err
+	}
+	return isSuppressed, ended, nil
+}
+
+func (w suppressionWindow) isEnded(now time.Time, window time.Duration) bool {
+	return now.Sub(time.Unix(0, w.StartedAt)) >= window
+}
+
+func (ds *detectionSuppressor) loadWindow(key string) (suppressionWindow, bool, error) {
+	w := suppressionWindow{}
+	data, isFound, err := ds.store.Get(key)
+	if err != nil || !isFound {
+		return w, false, err
+	}
+	if err := json.Unmarshal(data, &w); err != nil {
+		return w, false, err
+	}
+	return w, true, nil
+}
+
+func (ds *detectionSuppressor) saveWindow(key string, w suppressionWindow) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	// Keep the window around a while after it ends so the
+	// summary can be reported with the next detection or
+	// the next org_per_1h.
+	return ds.store.Set(key, data, ds.conf.Window+suppressionSummaryRetention)
+}
+
+// Take the windows of an org which ended with suppressed
+// detections, for their summary to be reported once.
+func (ds *detectionSuppressor) takeEnded(oid string, now time.Time) ([]suppressionWindow, error) {
+	keys, err := ds.store.List(suppressionOrgPrefix(oid))
+	if err != nil {
+		return nil, err
+	}
+	ds.mWindows.Lock()
+	defer ds.mWindows.Unlock()
+	ended := []suppressionWindow{}
+	for _, key := range keys {
+		w, isFound, err := ds.loadWindow(key)
+		if err != nil {
+			return ended, err
+		}
+		if !isFound || !w.isEnded(now, ds.conf.Window) || w.Suppressed == 0 {
+			continue
+		}
+		// An ended window is the same as no window.
+		if err := ds.store.Delete(key); err != nil {
+			return ended, err
+		}
+		ended = append(ended, w)
+	}
+	return ended, nil
+}
+
+func (ds *detectionSuppressor) summarize(w *suppressionWindow) *Job {
+	startedAt := time.Unix(0, w.StartedAt)
+	j := NewJob()
+	j.SetCause(fmt.Sprintf("suppressed detections of %s", w.Name))
+	if w.SID != "" {
+		j.AddSensor(w.SID)
+	}
+	j.Narrate(fmt.Sprintf("%d detections of %s suppressed between %s and %s", w.Suppressed, w.Name, startedAt.UTC().Format(time.RFC3339), startedAt.Add(ds.conf.Window).UTC().Format(time.RFC3339)), false)
+	j.Close()
+	return j
+}
+
+func (ds *detectionSuppressor) callback(next ServiceCallback) ServiceCallback {
+	return func(r Request) Response {
+		d, err := r.Event.AsDetection()
+		if err != nil {
+			return NewErrorResponse(err)
+		}
+		now := ds.now()
+		isSuppressed, ended, err := ds.record(r.OID, d, now)
+		if err != nil {
+			// Not being able to suppress is not a reason
+			// to lose the detection.
+			atomic.AddUint64(&ds.nErrors, 1)
+			isSuppressed = false
+		}
+		if isSuppressed {
+			atomic.AddUint64(&ds.nSuppressed, 1)
+			return MakeSuccessResponse()
+		}
+		atomic.AddUint64(&ds.nPassed, 1)
+		resp := callNext(next, r)
+		if ended != nil && ds.conf.IsNarrateSummary {
+			resp.Jobs = append(resp.Jobs, ds.summarize(ended))
+		}
+		return resp
+	}
+}
+
+// Report the windows which ended without a detection
+// starting a new one, like when a noisy sensor goes quiet.
+func (ds *detectionSuppressor) onOrgPer1H(r Request, next ServiceCallback) Response {
+	ended, err := ds.takeEnded(r.OID, ds.now())
+	if err != nil {
+		atomic.AddUint64(&ds.nErrors, 1)
+	}
+	resp := callNext(next, r)
+	for i := range ended {
+		resp.Jobs = append(resp.Jobs, ds.summarize(&ended[i]))
+	}
+	return resp
+}
+
+func (ds *detectionSuppressor) install(cs *CoreService) {
+	cs.addHealthMetadata("detection_suppression", func() interface{} {
+		return ds.stats()
+	})
+	if ds.conf.IsNarrateSummary {
+		cs.interceptCallback("org_per_1h", ds.onOrgPer1H)
+	}
+}
+
+// Suppress the detections before they reach the OnDetection
+// callback and router, only done once even if called again on a copy.
+func (d *Descriptor) applyDetectionSuppression() {
+	if d.DetectionSuppression == nil || d.suppressor != nil {
+		return
+	}
+	d.suppressor = newDetectionSuppressor(*d.DetectionSuppression)
+	d.Callbacks.OnDetection = d.suppressor.callback(d.Callbacks.OnDetection)
+}
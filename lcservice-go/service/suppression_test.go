@@ -0,0 +1,94 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectionSuppression(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := NewService(Descriptor{
+		SecretKey:            testSecretKey,
+		DetectionSuppression: &DetectionSuppression{Keys: []string{SuppressionKeys.SID}},
+	})
+	a.Error(err)
+
+	seen := []Detection{}
+	suppression := &DetectionSuppression{
+		Keys:             []string{SuppressionKeys.Name, SuppressionKeys.SID, "event/FILE_PATH"},
+		Window:           time.Minute,
+		MaxCount:         2,
+		IsNarrateSummary: true,
+	}
+	s, err := NewService(Descriptor{
+		SecretKey:            testSecretKey,
+		DetectionSuppression: suppression,
+		DetectionRouter: NewDetectionRouter().Handle("evil-exe", func(r Request, d Detection) Response {
+			seen = append(seen, d)
+			return MakeSuccessResponse()
+		}),
+	})
+	a.NoError(err)
+	now := time.Now()
+	s.desc.suppressor.now = func() time.Time { return now }
+
+	// Only MaxCount detections per key are let through.
+	for i := 0; i < 5; i++ {
+		resp := s.ProcessRequest(makeDetectionRequest("evil-exe", "s1"))
+		a.True(resp.IsSuccess)
+		a.Empty(resp.Jobs)
+	}
+	a.Equal(2, len(seen))
+	resp := s.ProcessRequest(makeDetectionRequest("evil-exe", "s2"))
+	a.True(resp.IsSuccess)
+	a.Equal(3, len(seen))
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	a.Equal(Dict{"passed": uint64(3), "suppressed": uint64(3), "errors": uint64(0)}, resp.Data["mtd"].(Dict)["detection_suppression"])
+
+	// A new window reports what was suppressed in the previous one.
+	now = now.Add(time.Minute)
+	resp = s.ProcessRequest(makeDetectionRequest("evil-exe", "s1"))
+	a.True(resp.IsSuccess)
+	a.Equal(4, len(seen))
+	a.Equal(1, len(resp.Jobs))
+	a.Equal([]string{"s1"}, resp.Jobs[0].sensors)
+	a.Contains(resp.Jobs[0].entries[0].msg, "3 detections of evil-exe suppressed")
+
+	// Nothing was suppressed for s2.
+	resp = s.ProcessRequest(makeDetectionRequest("evil-exe", "s2"))
+	a.True(resp.IsSuccess)
+	a.Empty(resp.Jobs)
+
+	// Sensors going quiet get their summary on the next
+	// org_per_1h, only once.
+	for i := 0; i < 4; i++ {
+		s.ProcessRequest(makeDetectionRequest("evil-exe", "s3"))
+	}
+	orgPer1H := makeRequest(lcRequest{Version: 1, OID: "o1", Type: "org_per_1h", Data: Dict{}})
+	resp = s.ProcessRequest(orgPer1H)
+	a.True(resp.IsSuccess)
+	a.Empty(resp.Jobs)
+	now = now.Add(time.Minute)
+	resp = s.ProcessRequest(orgPer1H)
+	a.True(resp.IsSuccess)
+	a.Equal(1, len(resp.Jobs))
+	a.Equal([]string{"s3"}, resp.Jobs[0].sensors)
+	a.Contains(resp.Jobs[0].entries[0].msg, "2 detections of evil-exe suppressed")
+	resp = s.ProcessRequest(orgPer1H)
+	a.Empty(resp.Jobs)
+	resp = s.ProcessRequest(makeDetectionRequest("evil-exe", "s3"))
+	a.Empty(resp.Jobs)
+}
+
+func TestValueAtPath(t *testing.T) {
+	a := assert.New(t)
+	d := Dict{"event": Dict{"FILE_PATH": "c:\\a.exe", "PID": 4, "MISSING": nil}}
+	a.Equal("c:\\a.exe", valueAtPath(d, "event/FILE_PATH"))
+	a.Equal("4", valueAtPath(d, "event/PID"))
+	a.Equal("", valueAtPath(d, "event/MISSING"))
+	a.Equal("", valueAtPath(d, "event/FILE_PATH/x"))
+	a.Equal("", valueAtPath(d, "other"))
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	lc "github.com/refractionPOINT/go-limacharlie/limacharlie"
+)
+
+const (
+	// Prefix of the keys of tracked tasking records.
+	taskingStorePrefix = "tasking/"
+
+	// How long records are kept past their deadline so that
+	// late responses to canceled taskings can be recognized.
+	taskingRecordRetention = 24 * time.Hour
+)
+
+type TaskingStatus = string
+
+var TaskingStatuses = struct {
+	Pending   TaskingStatus
+	Responded TaskingStatus
+	Canceled  TaskingStatus
+	TimedOut  TaskingStatus
+	Failed    TaskingStatus
+}{
+	Pending:   "pending",
+	Responded: "responded",
+	Canceled:  "canceled",
+	TimedOut:  "timed_out",
+	Failed:    "failed",
+}
+
+// A tracked tasking with a deadline.
+type OutstandingTasking struct {
+	ID                string        `json:"id"`
+	OID               string        `json:"oid"`
+	SID               string        `json:"sid,omitempty"`
+	Task              string        `json:"task,omitempty"`
+	CallbackID        string        `json:"cb"`
+	TimeoutCallbackID string        `json:"tcb,omitempty"`
+	JobID             string        `json:"job_id,omitempty"`
+	SessionID         string        `json:"session_id,omitempty"`
+	Context           Dict          `json:"ctx,omitempty"`
+	CreatedAt         int64         `json:"created_at"`
+	Deadline          int64         `json:"deadline"`
+	Status            TaskingStatus `json:"status"`
+	Responses         int           `json:"responses"`
+}
+
+func (t OutstandingTasking) IsExpired(now time.Time) bool {
+	return now.Unix() >= t.Deadline
+}
+
+func taskingKey(oid string, taskingID string) string {
+	return fmt.Sprintf("%s%s/%s", taskingStorePrefix, oid, taskingID)
+}
+
+func (is *InteractiveService) saveTasking(t OutstandingTasking) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	ttl := taskingRecordRetention
+	if untilDeadline := time.Until(time.Unix(t.Deadline, 0)); untilDeadline > 0 {
+		ttl += untilDeadline
+	}
+	return is.cs.desc.StateStore.Set(taskingKey(t.OID, t.ID), data, ttl)
+}
+
+func (is *InteractiveService) loadTasking(oid string, taskingID string) (OutstandingTasking, bool, error) {
+	t := OutstandingTasking{}
+	data, isFound, err := is.cs.desc.StateStore.Get(taskingKey(oid, taskingID))
+	if err != nil || !isFound {
+		return t, false, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, false, err
+	}
+	return t, true, nil
+}
+
+// List the taskings of all orgs if oid is empty.
+func (is *InteractiveService) listTaskings(oid string) ([]OutstandingTasking, error) {
+	prefix := taskingStorePrefix
+	if oid != "" {
+		prefix = fmt.Sprintf("%s%s/", taskingStorePrefix, oid)
+	}
+	keys, err := is.cs.desc.StateStore.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	taskings := []OutstandingTasking{}
+	for _, k := range keys {
+		components := strings.Split(strings.TrimPrefix(k, taskingStorePrefix), "/")
+		if len(components) != 2 {
+			continue
+		}
+		t, isFound, err := is.loadTasking(components[0], components[1])
+		if err != nil {
+			return nil, err
+		}
+		if !isFound {
+			continue
+		}
+		taskings = append(taskings, t)
+	}
+	return taskings, nil
+}
+
+// List the taskings of an org still waiting for a response.
+func (is *InteractiveService) ListOutstandingTaskings(oid string) ([]OutstandingTasking, error) {
+	taskings, err := is.listTaskings(oid)
+	if err != nil {
+		return nil, err
+	}
+	outstanding := []OutstandingTasking{}
+	for _, t := range taskings {
+		if t.Status == TaskingStatuses.Pending {
+			outstanding = append(outstanding, t)
+		}
+	}
+	return outstanding, nil
+}
+
+// Cancel a tracked tasking. Responses received for
+// it afterwards are handled as late responses.
+func (is *InteractiveService) CancelTasking(oid string, taskingID string) error {
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	t, isFound, err := is.loadTasking(oid, taskingID)
+	if err != nil {
+		return err
+	}
+	if !isFound {
+		return fmt.Errorf("tasking '%s' not found", taskingID)
+	}
+	if t.Status == TaskingStatuses.Canceled || t.Status == TaskingStatuses.TimedOut {
+		return nil
+	}
+	t.Status = TaskingStatuses.Canceled
+	return is.saveTasking(t)
+}
+
+// Record a response to a tracked tasking, returning whether
+// it should be delivered to the tasking's callback.
+func (is *InteractiveService) recordTaskingResponse(oid string, ic interactiveContext) (bool, error) {
+	// The deadline is part of the authenticated context so late
+	// responses are recognized even if no record is available.
+	if ic.Deadline != 0 && time.Now().Unix() >= ic.Deadline {
+		return false, nil
+	}
+
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	t, isFound, err := is.loadTasking(oid, ic.TaskingID)
+	if err != nil {
+		return false, err
+	}
+	if !isFound {
+		// Records may live on another instance when using the
+		// default in-memory store, trust the context's deadline.
+		return true, nil
+	}
+	if t.Status == TaskingStatuses.Canceled || t.Status == TaskingStatuses.TimedOut {
+		return false, nil
+	}
+	t.Status = TaskingStatuses.Responded
+	t.Responses++
+	return true, is.saveTasking(t)
+}
+
+// Trigger the timeout callbacks of the tracked taskings of an org
+// whose deadline passed without a response. If oid is empty, the
+// taskings of all orgs are swept and the org is ignored.
+// Returns the number of taskings that timed out. Called on every
+// org_per_1h, services needing timeouts to fire closer to their
+// deadline can call it more often, sweeping is idempotent.
+func (is *InteractiveService) SweepExpiredTaskings(oid string, org *lc.Organization) (int, error) {
+	responses, err := is.sweepExpiredTaskings(oid, org)
+	return len(responses), err
+}
+
+func (is *InteractiveService) sweepExpiredTaskings(oid string, org *lc.Organization) ([]Response, error) {
+	if oid == "" {
+		org = nil
+	}
+	taskings, err := is.listTaskings(oid)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	responses := []Response{}
+	for _, t := range taskings {
+		if t.Status != TaskingStatuses.Pending || !t.IsExpired(now) {
+			continue
+		}
+		isTimedOut, err := is.markTaskingTimedOut(t)
+		if err != nil {
+			return responses, err
+		}
+		if !isTimedOut {
+			continue
+		}
+		responses = append(responses, is.callTimeoutCallback(t, org))
+	}
+	return responses, nil
+}
+
+func (is *InteractiveService) markTaskingTimedOut(t OutstandingTasking) (bool, error) {
+	is.taskingMutex.Lock()
+	defer is.taskingMutex.Unlock()
+	// Reload the record in case a response raced the sweep.
+	t, isFound, err := is.loadTasking(t.OID, t.ID)
+	if err != nil || !isFound {
+		return false, err
+	}
+	if t.Status != TaskingStatuses.Pending {
+		return false, nil
+	}
+	t.Status = TaskingStatuses.TimedOut
+	return true, is.saveTasking(t)
+}
+
+func (is *InteractiveService) callTimeoutCallback(t OutstandingTasking, org *lc.Organization) Response {
+	if t.TimeoutCallbackID == "" {
+		return MakeSuccessResponse()
+	}
+	cb, ok := is.interactiveCallbacks[t.TimeoutCallbackID]
+	if !ok || cb == nil {
+		is.cs.desc.LogCritical(fmt.Sprintf("tasking %s has unknown timeout callbackID: %s", t.ID, t.TimeoutCallbackID))
+		return NewErrorResponse(fmt.Errorf("not implemented"))
+	}
+	req := InteractiveRequest{
+		Org:        org,
+		OID:        t.OID,
+		SID:        t.SID,
+		Context:    t.Context,
+		TaskingID:  t.ID,
+		IsTimedOut: true,
+	}
+	if t.JobID != "" {
+		req.Job = NewJob(t.JobID)
+	}
+	if t.SessionID != "" {
+		var err error
+		req.SessionID = t.SessionID
+		req.Session, err = is.recordSessionEvent(t.OID, t.SessionID, SessionEvent{
+			Type:       SessionEventTypes.Timeout,
+			SID:        t.SID,
+			TaskingID:  t.ID,
+			CallbackID: t.TimeoutCallbackID,
+		})
+		if err != nil {
+			is.cs.desc.LogCritical(fmt.Sprintf("error recording timeout in session %s: %v", t.SessionID, err))
+		}
+	}
+	return cb(req)
+}
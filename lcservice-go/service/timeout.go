@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	handlerRunning int32 = iota
+	handlerDone
+	handlerTimedOut
+)
+
+// Enforces the maximum runtime of the handlers and
+// measures the ones timing out and finishing late.
+type handlerTimeouts struct {
+	cs *CoreService
+
+	sync.Mutex
+	nTimeouts        map[string]uint64
+	nLateCompletions map[string]uint64
+	maxLateness      map[string]time.Duration
+}
+
+func newHandlerTimeouts(cs *CoreService) *handlerTimeouts {
+	return &handlerTimeouts{
+		cs:               cs,
+		nTimeouts:        map[string]uint64{},
+		nLateCompletions: map[string]uint64{},
+		maxLateness:      map[string]time.Duration{},
+	}
+}
+
+func hasTimeouts(d Descriptor) bool {
+	if len(d.CallbackTimeouts) != 0 {
+		return true
+	}
+	for _, cmd := range d.Commands.Descriptors {
+		if cmd.Timeout != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Name of a request for the measurements, commands
+// are measured by command name.
+func handlerName(e RequestEvent) string {
+	if e.Type == "command" {
+		return fmt.Sprintf("command/%v", e.Data["command_name"])
+	}
+	return e.Type
+}
+
+// Run the handler, returning a retriable Response if it takes
+// longer than the timeout. The handler's context is then cancelled
+// and the handler is left to finish in the background, calling
+// release once it does, in which case true is returned. Otherwise
+// release is left to the caller.
+func (t *handlerTimeouts) run(handler ServiceCallback, r Request, timeout time.Duration, release func()) (Response, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.ctx = ctx
+	name := handlerName(r.Event)
+	state := handlerRunning
+	// Buffered so the handler never blocks when finishing late.
+	results := make(chan Response, 1)
+	start := time.Now()
+	go func() {
+		defer cancel()
+		resp := t.callIsolated(handler, r, name)
+		if atomic.CompareAndSwapInt32(&state, handlerRunning, handlerDone) {
+			results <- resp
+			return
+		}
+		// Still counted as in progress until now.
+		release()
+		lateness := time.Since(start) - timeout
+		t.recordLateCompletion(name, lateness)
+		t.cs.Warn(fmt.Sprintf("handler of '%s' (%s) finished %v after timing out", name, r.Event.ID, lateness))
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-results:
+		return resp, false
+	case <-timer.C:
+	}
+	if !atomic.CompareAndSwapInt32(&state, handlerRunning, handlerTimedOut) {
+		// Finished just in time.
+		return <-results, false
+	}
+	cancel()
+	t.recordTimeout(name)
+	t.cs.Error(fmt.Sprintf("handler of '%s' (%s) timed out after %v", name, r.Event.ID, timeout))
+	return NewRetriableResponse(fmt.Errorf("handler timed out after %v", timeout)), true
+}
+
+// Call the handler, turning a panic into an error Response since
+// the handler runs outside of the goroutine of the request.
+func (t *handlerTimeouts) callIsolated(handler ServiceCallback, r Request, name string) (resp Response) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			t.cs.Error(fmt.Sprintf("handler of '%s' (%s) panicked: %v", name, r.Event.ID, rec))
+			resp = NewErrorResponse(fmt.Errorf("panic: %v", rec))
+		}
+	}()
+	return handler(r)
+}
+
+func (t *handlerTimeouts) recordTimeout(name string) {
+	t.Lock()
+	defer t.Unlock()
+	t.nTimeouts[name]++
+}
+
+func (t *handlerTimeouts) recordLateCompletion(name string, lateness time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.nLateCompletions[name]++
+	if lateness > t.maxLateness[name] {
+		t.maxLateness[name] = lateness
+	}
+}
+
+func (t *handlerTimeouts) getHealthMetadata() interface{} {
+	t.Lock()
+	defer t.Unlock()
+	timeouts := Dict{}
+	for name, n := range t.nTimeouts {
+		timeouts[name] = n
+	}
+	late := Dict{}
+	for name, n := range t.nLateCompletions {
+		late[name] = Dict{
+			"count":          n,
+			"max_lateness_s": t.maxLateness[name].Seconds(),
+		}
+	}
+	return Dict{
+		"timeouts":         timeouts,
+		"late_completions": late,
+	}
+}
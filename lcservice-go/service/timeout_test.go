@@ -0,0 +1,113 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerTimeouts(t *testing.T) {
+	a := assert.New(t)
+
+	mLogs := sync.Mutex{}
+	logs := []string{}
+	log := func(m string) {
+		mLogs.Lock()
+		defer mLogs.Unlock()
+		logs = append(logs, m)
+	}
+	isCancelled := make(chan bool, 1)
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	s, err := NewService(Descriptor{
+		SecretKey:        testSecretKey,
+		Log:              log,
+		LogCritical:      log,
+		CallbackTimeouts: map[string]time.Duration{"sensor_per_1h": 20 * time.Millisecond},
+		Callbacks: DescriptorCallbacks{
+			OnSensorPer1H: func(r Request) Response {
+				ctx, cancel := r.Context()
+				defer cancel()
+				<-ctx.Done()
+				isCancelled <- true
+				<-release
+				defer close(finished)
+				return MakeSuccessResponse()
+			},
+			OnSensorPer3H: func(r Request) Response {
+				return MakeSuccessResponse()
+			},
+		},
+		Commands: CommandsDescriptor{
+			Descriptors: []CommandDescriptor{
+				{
+					Name:        "quick",
+					Description: "quick command",
+					Args:        CommandParams{},
+					Timeout:     time.Second,
+					Handler:     func(r Request) Response { return MakeSuccessResponse(Dict{"is_quick": true}) },
+				},
+				{
+					Name:        "panicky",
+					Description: "panicking command",
+					Args:        CommandParams{},
+					Timeout:     time.Second,
+					Handler:     func(r Request) Response { panic("boom") },
+				},
+			},
+		},
+	})
+	a.NoError(err)
+
+	// Handlers within their timeout are unaffected.
+	resp := s.ProcessCommand(makeConfigCommand("o1", "quick", nil))
+	a.True(resp.IsSuccess)
+	a.Equal(true, resp.Data["is_quick"])
+	a.True(s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "sensor_per_3h", Data: Dict{}})).IsSuccess)
+
+	// Panics are returned as errors instead of crashing the service.
+	resp = s.ProcessCommand(makeConfigCommand("o1", "panicky", nil))
+	a.False(resp.IsSuccess)
+	a.Contains(resp.Error, "panic: boom")
+
+	// Slow handlers get cancelled and the response does not wait for them.
+	start := time.Now()
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, OID: "o1", Type: "sensor_per_1h", Data: Dict{}}))
+	a.False(resp.IsSuccess)
+	a.True(resp.IsRetriable)
+	a.Contains(resp.Error, "timed out")
+	a.True(time.Since(start) < time.Second)
+	a.True(<-isCancelled)
+
+	// The handler still counts as in progress until it returns.
+	callsInProgress := func() interface{} {
+		return s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}})).Data["calls_in_progress"]
+	}
+	a.Equal(uint32(2), callsInProgress())
+
+	// The late finisher is measured and logged.
+	close(release)
+	<-finished
+	a.Eventually(func() bool { return callsInProgress() == uint32(1) }, time.Second, time.Millisecond)
+	a.Eventually(func() bool {
+		m := s.timeouts.getHealthMetadata().(Dict)
+		return len(m["late_completions"].(Dict)) == 1
+	}, time.Second, time.Millisecond)
+	resp = s.ProcessRequest(makeRequest(lcRequest{Version: 1, Type: "health", Data: Dict{}}))
+	m := resp.Data["mtd"].(Dict)["timeouts"].(Dict)
+	a.Equal(Dict{"sensor_per_1h": uint64(1)}, m["timeouts"])
+	a.Equal(uint64(1), m["late_completions"].(Dict)["sensor_per_1h"].(Dict)["count"])
+
+	mLogs.Lock()
+	defer mLogs.Unlock()
+	isLogged := false
+	for _, l := range logs {
+		if strings.Contains(l, "finished") && strings.Contains(l, "after timing out") {
+			isLogged = true
+		}
+	}
+	a.True(isLogged)
+}